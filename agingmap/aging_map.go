@@ -6,93 +6,123 @@ import (
 	"sync"
 )
 
-const threadSafe = false
+// Map implements the Interface. It is safe for concurrent use; lookups only
+// contend with changes, not with each other.
+type Map[K comparable, V any] struct {
+	elements agingList[K, V]
+	rwLock   sync.RWMutex
+}
 
-// AgingMap implements the AgingMap interface.
-// This is my first attempt at an implementation.
-type AgingMap struct {
-	internalMap  map[string]*list.Element
-	internalList list.List
-	maxElements  int
-	rwLock       sync.RWMutex
+// AgingMap is the original map of strings to strings.
+type AgingMap = Map[string, string]
+
+func (am *Map[K, V]) Serialize() []Pair[K, V] {
+	am.rwLock.RLock()
+	defer am.rwLock.RUnlock()
+	return am.elements.serialize()
+}
+
+// Init initializes the map with a maximum size.
+func (am *Map[K, V]) Init(max int) {
+	am.rwLock.Lock()
+	defer am.rwLock.Unlock()
+	am.elements.init(max)
+}
+
+// Add places the key/value pair inside the map.
+// It refreshes the lifetime (and value) of key if it already exists
+// in the map.
+func (am *Map[K, V]) Add(key K, value V) {
+	am.rwLock.Lock()
+	defer am.rwLock.Unlock()
+	am.elements.add(key, value)
 }
 
-func (am *AgingMap) Serialize() []KeyValuePair {
-	pairs := make([]KeyValuePair, 0, am.maxElements)
+// Get retrieves the value for the key in the map (or returns the zero value
+// if it doesn't exist). Looking a key up doesn't refresh it, so only a read
+// lock is needed.
+func (am *Map[K, V]) Get(key K) V {
+	value, _ := am.Lookup(key)
+	return value
+}
 
+// Lookup is Get, also saying whether the key was there; for values whose
+// zero value means something.
+func (am *Map[K, V]) Lookup(key K) (V, bool) {
 	am.rwLock.RLock()
 	defer am.rwLock.RUnlock()
-	e := am.internalList.Front()
-	for e != nil {
-		pairs = append(pairs, e.Value.(KeyValuePair))
-		e = e.Next()
-	}
+	return am.elements.get(key)
+}
 
-	return pairs
+// Remove deletes the key/value pair from the map, and returns the value.
+func (am *Map[K, V]) Remove(key K) V {
+	am.rwLock.Lock()
+	defer am.rwLock.Unlock()
+	return am.elements.remove(key)
 }
 
-// Init initializes the map with a maximum size.
-func (am *AgingMap) Init(max int) {
-	am.internalMap = make(map[string]*list.Element)
-	am.internalList.Init()
-	am.maxElements = max
-	if am.maxElements <= 0 {
+// agingList is the map itself, without any locking: the newest pair is at
+// the front of the list, and the oldest is dropped to make room.
+type agingList[K comparable, V any] struct {
+	internalMap  map[K]*list.Element
+	internalList list.List
+	maxElements  int
+}
+
+func (l *agingList[K, V]) init(max int) {
+	l.internalMap = make(map[K]*list.Element)
+	l.internalList.Init()
+	l.maxElements = max
+	if l.maxElements <= 0 {
 		log.Fatal("Empty map")
 	}
 }
 
-// Add places the key/value pair inside the map.
-// It refreshes the lifetime of key if it already exists
-// in the map.
-func (am *AgingMap) Add(key string, value string) {
-	if threadSafe {
-		am.rwLock.Lock()
-		defer am.rwLock.Unlock()
+func (l *agingList[K, V]) serialize() []Pair[K, V] {
+	pairs := make([]Pair[K, V], 0, l.internalList.Len())
+	for e := l.internalList.Front(); e != nil; e = e.Next() {
+		pairs = append(pairs, e.Value.(Pair[K, V]))
 	}
-	if element, ok := am.internalMap[key]; ok {
-		// Refresh the age.
-		am.internalList.MoveToFront(element)
+	return pairs
+}
+
+func (l *agingList[K, V]) add(key K, value V) {
+	if element, ok := l.internalMap[key]; ok {
+		// Refresh the age, and the value.
+		element.Value = Pair[K, V]{key, value}
+		l.internalList.MoveToFront(element)
 		return
 	}
 
-	if len(am.internalMap) >= am.maxElements {
+	if len(l.internalMap) >= l.maxElements {
 		// Make room for the new element.
-		kvp := am.internalList.Remove(am.internalList.Back()).(KeyValuePair)
-		delete(am.internalMap, kvp.Key)
+		kvp := l.internalList.Remove(l.internalList.Back()).(Pair[K, V])
+		delete(l.internalMap, kvp.Key)
 	}
 
-	am.internalMap[key] = am.internalList.PushFront(KeyValuePair{key, value})
+	l.internalMap[key] = l.internalList.PushFront(Pair[K, V]{key, value})
 }
 
-// Get retrieves the value for the key in the map (or returns "" if it doesn't
-// exist).
-func (am *AgingMap) Get(key string) string {
-	if threadSafe {
-		am.rwLock.RLock()
-		defer am.rwLock.RUnlock()
-	}
-	element := am.internalMap[key]
+func (l *agingList[K, V]) get(key K) (V, bool) {
+	element := l.internalMap[key]
 	if element == nil {
-		return ""
+		var zero V
+		return zero, false
 	}
 
-	kvp := element.Value.(KeyValuePair)
-	return kvp.Value
+	kvp := element.Value.(Pair[K, V])
+	return kvp.Value, true
 }
 
-// Remove deletes the key/value pair from the map, and returns the value.
-func (am *AgingMap) Remove(key string) string {
-	if threadSafe {
-		am.rwLock.Lock()
-		defer am.rwLock.Unlock()
-	}
-	element := am.internalMap[key]
+func (l *agingList[K, V]) remove(key K) V {
+	element := l.internalMap[key]
 	if element == nil {
-		return ""
+		var zero V
+		return zero
 	}
 
-	kvp := element.Value.(KeyValuePair)
-	delete(am.internalMap, key)
-	am.internalList.Remove(element)
+	kvp := element.Value.(Pair[K, V])
+	delete(l.internalMap, key)
+	l.internalList.Remove(element)
 	return kvp.Value
 }
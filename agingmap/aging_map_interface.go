@@ -1,20 +1,28 @@
 package agingmap
 
-type KeyValuePair struct {
-	Key   string
-	Value string
+// Pair is a key and its value, as kept in a Map.
+type Pair[K comparable, V any] struct {
+	Key   K
+	Value V
 }
 
-// AgingMapInterface is a Map which also has a capped size.
+type KeyValuePair = Pair[string, string]
+
+// Interface is a Map which also has a capped size.
 // As more elements are added, old elements can be removed.
-type AgingMapInterface interface {
+type Interface[K comparable, V any] interface {
 	// Must be called before anything else. Set the max element size.
 	Init(int)
 
 	// Adding the same key multiple times "refreshes" the age and updates the
 	// value.
-	Add(key, value string)
-	Get(key string) string
-	Remove(key string) string
-	Serialize() []KeyValuePair
+	Add(key K, value V)
+	// Missing keys give the zero value.
+	Get(key K) V
+	Remove(key K) V
+	// Every pair, newest first.
+	Serialize() []Pair[K, V]
 }
+
+// AgingMapInterface is the original Interface, of strings to strings.
+type AgingMapInterface = Interface[string, string]
@@ -1,6 +1,10 @@
 package agingmap
 
-import "testing"
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
 
 func verifyKVPair(t *testing.T, am AgingMapInterface, key, eVal string) {
 	val := am.Get(key)
@@ -49,3 +53,210 @@ func TestAgingMapSize(t *testing.T) {
 	verifyKVPair(t, am, "foos", "ball")
 	verifyKVPair(t, am, "baz", "blat")
 }
+
+func TestAgingMapUpdate(t *testing.T) {
+	am := &AgingMap{}
+	am.Init(2)
+	am.Add("foo", "bar")
+	am.Add("foos", "ball")
+	am.Add("foo", "baz")
+	verifyKVPair(t, am, "foo", "baz")
+
+	// Updating "foo" also refreshed it, so "foos" is the oldest.
+	am.Add("bar", "blat")
+	verifyKVPair(t, am, "foos", "")
+	verifyKVPair(t, am, "foo", "baz")
+}
+
+func TestAgingMapConcurrentAccess(t *testing.T) {
+	const writers, readers, ops = 4, 4, 1000
+	am := &AgingMap{}
+	am.Init(100)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				key := strconv.Itoa(w*ops + i)
+				am.Add(key, key)
+				if i%3 == 0 {
+					am.Remove(key)
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < ops; i++ {
+				key := strconv.Itoa(i)
+				// Whatever is there must be what was added.
+				if val := am.Get(key); val != "" && val != key {
+					t.Error("Unexpected value: ", key, val)
+				}
+				if i%100 == 0 {
+					am.Serialize()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	pairs := am.Serialize()
+	if len(pairs) > 100 {
+		t.Error("Map outgrew its capacity: ", len(pairs))
+	}
+	for _, kvp := range pairs {
+		verifyKVPair(t, am, kvp.Key, kvp.Value)
+	}
+}
+
+// Enough keys that lookups miss the cache now and then, as in a feed's
+// history.
+const benchKeys = 1000
+
+func benchmarkKeys() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = "https://example.com/item/" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func BenchmarkAgingMapAdd(b *testing.B) {
+	keys := benchmarkKeys()
+	am := &AgingMap{}
+	am.Init(benchKeys / 2)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		am.Add(keys[i%benchKeys], "value")
+	}
+}
+
+func BenchmarkUnlockedAdd(b *testing.B) {
+	keys := benchmarkKeys()
+	var l agingList[string, string]
+	l.init(benchKeys / 2)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.add(keys[i%benchKeys], "value")
+	}
+}
+
+func BenchmarkAgingMapGet(b *testing.B) {
+	keys := benchmarkKeys()
+	am := &AgingMap{}
+	am.Init(benchKeys)
+	for _, key := range keys {
+		am.Add(key, "value")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		am.Get(keys[i%benchKeys])
+	}
+}
+
+func BenchmarkUnlockedGet(b *testing.B) {
+	keys := benchmarkKeys()
+	var l agingList[string, string]
+	l.init(benchKeys)
+	for _, key := range keys {
+		l.add(key, "value")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.get(keys[i%benchKeys])
+	}
+}
+
+// Readers sharing the map shouldn't slow each other down.
+func BenchmarkAgingMapParallelGet(b *testing.B) {
+	keys := benchmarkKeys()
+	am := &AgingMap{}
+	am.Init(benchKeys)
+	for _, key := range keys {
+		am.Add(key, "value")
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			am.Get(keys[i%benchKeys])
+		}
+	})
+}
+
+// One writer for every eight readers, as when a feed polls while the view
+// reads.
+func BenchmarkAgingMapParallelMixed(b *testing.B) {
+	keys := benchmarkKeys()
+	am := &AgingMap{}
+	am.Init(benchKeys / 2)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if i%8 == 0 {
+				am.Add(keys[i%benchKeys], "value")
+			} else {
+				am.Get(keys[i%benchKeys])
+			}
+		}
+	})
+}
+
+// seen is the sort of thing a feed might keep per item.
+type seen struct {
+	Fingerprint string
+	Polls       int
+}
+
+func TestMapTyped(t *testing.T) {
+	var _ Interface[int, seen] = (*Map[int, seen])(nil)
+
+	am := &Map[int, seen]{}
+	am.Init(2)
+	am.Add(1, seen{"a", 1})
+	am.Add(2, seen{"b", 1})
+	am.Add(1, seen{"a", 2})
+	am.Add(3, seen{"c", 1})
+
+	if value, ok := am.Lookup(2); ok {
+		t.Error("Unexpected value for the oldest key: ", value)
+	}
+	if value, ok := am.Lookup(1); !ok || value != (seen{"a", 2}) {
+		t.Error("Unexpected value for a refreshed key: ", value, ok)
+	}
+	if value := am.Remove(3); value != (seen{"c", 1}) {
+		t.Error("Unexpected removed value: ", value)
+	}
+	if value := am.Get(3); value != (seen{}) {
+		t.Error("Unexpected value after removing: ", value)
+	}
+
+	pairs := am.Serialize()
+	if len(pairs) != 1 || pairs[0] != (Pair[int, seen]{1, seen{"a", 2}}) {
+		t.Error("Unexpected pairs: ", pairs)
+	}
+}
+
+func TestMapSerializeNewestFirst(t *testing.T) {
+	am := &AgingMap{}
+	am.Init(3)
+	am.Add("a", "1")
+	am.Add("b", "2")
+	am.Add("c", "3")
+	am.Add("a", "4")
+	var pairs []KeyValuePair = am.Serialize()
+	expected := []KeyValuePair{{"a", "4"}, {"c", "3"}, {"b", "2"}}
+	if len(pairs) != len(expected) {
+		t.Fatal("Unexpected pairs: ", pairs, ", expected ", expected)
+	}
+	for i := range pairs {
+		if pairs[i] != expected[i] {
+			t.Error("Unexpected pairs: ", pairs, ", expected ", expected)
+			break
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+// This file handles the ":commands" a user can type into the entry line.
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smklein/toy-rss/feed"
+	"github.com/smklein/toy-rss/storage"
+	"github.com/smklein/toy-rss/view"
+)
+
+// findFeed looks up a feed by either its URL or its title.
+func (r *reader) findFeed(name string) (string, *runningFeed) {
+	if rf, ok := r.feedMap[name]; ok {
+		return name, rf
+	}
+	for URL, rf := range r.feedMap {
+		if rf.feed.GetTitle() == name {
+			return URL, rf
+		}
+	}
+	return "", nil
+}
+
+// setFeedInterval handles ":interval <feed> <duration|auto>".
+func (r *reader) setFeedInterval(args []string) view.StatusMsgStruct {
+	if len(args) < 2 {
+		return view.StatusMsgStruct{Message: "Usage: :interval <feed> <duration|auto>", Type: view.StatusError}
+	}
+	// Feed titles may contain spaces; the interval is always the last word.
+	name := strings.Join(args[:len(args)-1], " ")
+	URL, rf := r.findFeed(name)
+	if rf == nil {
+		return view.StatusMsgStruct{Message: "No such feed: " + name, Type: view.StatusError}
+	}
+	f := rf.feed
+
+	var interval time.Duration
+	if arg := args[len(args)-1]; arg != "auto" {
+		var err error
+		interval, err = time.ParseDuration(arg)
+		if err != nil {
+			return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+		}
+		if interval < feed.MinRefreshInterval {
+			return view.StatusMsgStruct{Message: "Interval must be at least " + feed.MinRefreshInterval.String(), Type: view.StatusError}
+		}
+	}
+	f.SetRefreshInterval(interval)
+	sub, _ := r.subscriptions.Get(URL)
+	sub.Settings.RefreshInterval = interval
+	r.subscriptions.SetSettings(URL, sub.Settings)
+	if interval == 0 {
+		return view.StatusMsgStruct{Message: "Refreshing [" + f.GetTitle() + "] automatically", Type: view.StatusSuccess}
+	}
+	return view.StatusMsgStruct{Message: "Refreshing [" + f.GetTitle() + "] every " + interval.String(), Type: view.StatusSuccess}
+}
+
+// setFeedDedupe handles ":dedupe <feed> <strategy|auto>", which picks how the
+// feed's items are told apart; see the storage.Dedupe* strategies.
+func (r *reader) setFeedDedupe(args []string) view.StatusMsgStruct {
+	usage := view.StatusMsgStruct{Message: "Usage: :dedupe <feed> auto|guid|link|normalized-link|title-date|content-hash", Type: view.StatusError}
+	if len(args) < 2 {
+		return usage
+	}
+	strategy := args[len(args)-1]
+	if strategy == "auto" {
+		strategy = storage.DedupeAuto
+	} else if strategy == storage.DedupeAuto || !feed.ValidDedupeStrategy(strategy) {
+		return usage
+	}
+	name := strings.Join(args[:len(args)-1], " ")
+	URL, rf := r.findFeed(name)
+	if rf == nil {
+		return view.StatusMsgStruct{Message: "No such feed: " + name, Type: view.StatusError}
+	}
+
+	var detected string
+	r.subscriptions.UpdateSettings(URL, func(settings *storage.FeedSettings) {
+		settings.Dedupe = strategy
+		detected = settings.DetectedDedupe
+	})
+	rf.feed.SetDedupeStrategy(strategy, detected)
+	if strategy == storage.DedupeAuto {
+		return view.StatusMsgStruct{Message: "Telling items of [" + rf.feed.GetTitle() + "] apart automatically", Type: view.StatusSuccess}
+	}
+	return view.StatusMsgStruct{Message: "Telling items of [" + rf.feed.GetTitle() + "] apart by " + strategy, Type: view.StatusSuccess}
+}
+
+// removeFeed handles ":remove [-purge] [-forget] <feed>".
+//
+// -purge deletes the feed's items from the view.
+// -forget deletes the feed's dedupe history, so re-adding it later shows
+// everything again.
+func (r *reader) removeFeed(args []string) view.StatusMsgStruct {
+	purge, forget := false, false
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-purge":
+			purge = true
+		case "-forget":
+			forget = true
+		default:
+			return view.StatusMsgStruct{Message: "Unknown flag: " + args[0], Type: view.StatusError}
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return view.StatusMsgStruct{Message: "Usage: :remove [-purge] [-forget] <feed>", Type: view.StatusError}
+	}
+	name := strings.Join(args, " ")
+	if r.starting[name] {
+		// Not ours to stop until its first poll is over.
+		return view.StatusMsgStruct{Message: name + " is still starting; remove it once it has", Type: view.StatusError}
+	}
+	URL, rf := r.findFeed(name)
+	var title string
+	if rf != nil {
+		// Stop polling, then wait for the last of the feed's items to be
+		// handed to the view, so nothing sneaks in after a purge.
+		title = rf.feed.GetTitle()
+		rf.feed.End()
+		<-rf.handlerDone
+		delete(r.feedMap, URL)
+	} else if _, ok := r.subscriptions.Get(name); ok {
+		// Subscribed, but not running (it failed to start, say).
+		URL = name
+		title = storage.MakeValidatorStorage(URL).Get().Title
+	} else {
+		return view.StatusMsgStruct{Message: "No such feed: " + name, Type: view.StatusError}
+	}
+	r.subscriptions.Remove(URL)
+
+	if purge && title != "" {
+		r.v.PurgeFeed(title)
+	}
+	if forget {
+		if title != "" {
+			if err := storage.DeleteFeedStorage(title); err != nil {
+				return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+			}
+		}
+		if err := storage.DeleteValidatorStorage(URL); err != nil {
+			return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+		}
+		if err := storage.DeleteHealthStorage(URL); err != nil {
+			return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+		}
+	}
+	if title == "" {
+		title = URL
+	}
+	return view.StatusMsgStruct{Message: "Removed Feed [" + title + "]", Type: view.StatusSuccess}
+}
+
+// pickDiscovered handles ":pick <n>", choosing among the feeds found on the
+// last web page the user entered.
+func (r *reader) pickDiscovered(args []string) view.StatusMsgStruct {
+	if len(r.discovered) == 0 {
+		return view.StatusMsgStruct{Message: "Nothing to pick from; enter a web page's URL first", Type: view.StatusError}
+	}
+	if len(args) != 1 {
+		return r.describeDiscovered()
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || len(r.discovered) < n {
+		return view.StatusMsgStruct{Message: "Pick a number from 1 to " + strconv.Itoa(len(r.discovered)), Type: view.StatusError}
+	}
+
+	URL := r.discovered[n-1].URL
+	r.discovered = nil
+	return r.addNewFeed(URL)
+}
+
+const commandHelp = ":interval <feed> <duration|auto>  :dedupe <feed> <strategy|auto>  :remove [-purge] [-forget] <feed>  :import <file.opml>  :export <file.opml>  :pick <n>  :auth <feed> none|basic <user> <secret>|bearer <secret>|cookie <secret>  :header <feed> <name> [value]  :useragent <feed> [agent]  :refresh <feed>  :rename <feed> <name>"
+
+func (r *reader) handleCommand(cmd view.Command) view.StatusMsgStruct {
+	switch cmd.Name {
+	case "help":
+		return view.StatusMsgStruct{Message: commandHelp, Type: view.StatusInfo}
+	case "interval":
+		return r.setFeedInterval(cmd.Args)
+	case "dedupe":
+		return r.setFeedDedupe(cmd.Args)
+	case "remove":
+		return r.removeFeed(cmd.Args)
+	case "pick":
+		return r.pickDiscovered(cmd.Args)
+	case "import":
+		return r.importOPML(cmd.Args)
+	case "export":
+		return r.exportOPML(cmd.Args)
+	case "feeds":
+		return r.showFeeds()
+	case "refresh":
+		return r.refreshFeed(cmd.Args)
+	case "rename":
+		return r.renameFeed(cmd.Args)
+	case "auth":
+		return r.setFeedAuth(cmd.Args)
+	case "header":
+		return r.setFeedHeader(cmd.Args)
+	case "useragent":
+		return r.setFeedUserAgent(cmd.Args)
+	default:
+		return view.StatusMsgStruct{Message: "Unknown command: " + cmd.Name, Type: view.StatusError}
+	}
+}
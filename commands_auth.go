@@ -0,0 +1,110 @@
+package main
+
+// This file handles ":auth", ":header" and ":useragent", which change how a
+// feed's server is asked for it.
+
+import (
+	"strings"
+
+	"github.com/smklein/toy-rss/feed"
+	"github.com/smklein/toy-rss/storage"
+	"github.com/smklein/toy-rss/view"
+)
+
+// updateRequestSettings changes how the feed called name (a URL, or a
+// single-word title) is fetched.
+//
+// A URL we aren't subscribed to yet is subscribed to, with the new settings.
+// That's how feeds which need credentials are added in the first place.
+func (r *reader) updateRequestSettings(name string, update func(*storage.RequestSettings)) view.StatusMsgStruct {
+	URL, rf := r.findFeed(name)
+	if rf == nil {
+		if !strings.Contains(name, "://") {
+			return view.StatusMsgStruct{Message: "No such feed: " + name, Type: view.StatusError}
+		}
+		URL = name
+	}
+
+	// Remembered even if the feed doesn't work yet, so it can be fixed.
+	r.subscriptions.Add(URL, "", "")
+	sub, _ := r.subscriptions.Get(URL)
+	update(&sub.Settings.Request)
+	r.subscriptions.SetSettings(URL, sub.Settings)
+
+	if rf != nil {
+		rf.feed.SetRequestSettings(sub.Settings.Request)
+		return view.StatusMsgStruct{Message: "Updated request settings for [" + rf.feed.GetTitle() + "]", Type: view.StatusSuccess}
+	}
+	err := r.subscribe(URL, "", "", false, func(rf *runningFeed, err error) view.StatusMsgStruct {
+		if err != nil {
+			return view.StatusMsgStruct{Message: err.Error() + " (settings saved; fix them and try again)", Type: view.StatusError}
+		}
+		return reportAdded(rf, nil)
+	})
+	if err != nil {
+		return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+	}
+	return view.StatusMsgStruct{Message: "Saved request settings; adding " + URL, Type: view.StatusInfo}
+}
+
+// setFeedAuth handles
+// ":auth <feed> none|basic <user> <secret>|bearer <secret>|cookie <secret>",
+// where <secret> is env:NAME or file:PATH.
+func (r *reader) setFeedAuth(args []string) view.StatusMsgStruct {
+	usage := view.StatusMsgStruct{Message: "Usage: :auth <feed> none|basic <user> <secret>|bearer <secret>|cookie <secret> (secret is env:NAME or file:PATH)", Type: view.StatusError}
+	if len(args) < 2 {
+		return usage
+	}
+	auth := storage.FeedAuth{Kind: args[1]}
+	switch {
+	case auth.Kind == "none" && len(args) == 2:
+		auth.Kind = storage.AuthNone
+	case auth.Kind == storage.AuthBasic && len(args) == 4:
+		auth.Username, auth.SecretSource = args[2], args[3]
+	case (auth.Kind == storage.AuthBearer || auth.Kind == storage.AuthCookie) && len(args) == 3:
+		auth.SecretSource = args[2]
+	default:
+		return usage
+	}
+	if auth.Kind != storage.AuthNone && !feed.ValidSecretSource(auth.SecretSource) {
+		// Don't save what is probably the secret itself.
+		return usage
+	}
+	return r.updateRequestSettings(args[0], func(settings *storage.RequestSettings) {
+		settings.Auth = auth
+	})
+}
+
+// setFeedHeader handles ":header <feed> <name> [value]". Without a value, the
+// header is no longer sent.
+func (r *reader) setFeedHeader(args []string) view.StatusMsgStruct {
+	if len(args) < 2 {
+		return view.StatusMsgStruct{Message: "Usage: :header <feed> <name> [value]", Type: view.StatusError}
+	}
+	name, value := strings.TrimSuffix(args[1], ":"), strings.Join(args[2:], " ")
+	return r.updateRequestSettings(args[0], func(settings *storage.RequestSettings) {
+		// Copied, since the running feed may still be using the old map.
+		headers := make(map[string]string)
+		for k, v := range settings.Headers {
+			headers[k] = v
+		}
+		if value == "" {
+			delete(headers, name)
+		} else {
+			headers[name] = value
+		}
+		settings.Headers = headers
+	})
+}
+
+// setFeedUserAgent handles ":useragent <feed> [agent]". Without an agent, the
+// default is sent.
+func (r *reader) setFeedUserAgent(args []string) view.StatusMsgStruct {
+	if len(args) < 1 {
+		return view.StatusMsgStruct{Message: "Usage: :useragent <feed> [agent]", Type: view.StatusError}
+	}
+	agent := strings.Join(args[1:], " ")
+	return r.updateRequestSettings(args[0], func(settings *storage.RequestSettings) {
+		settings.UserAgent = agent
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+// This file handles the feeds screen, and the ":commands" behind its actions.
+
+import (
+	"strings"
+
+	"github.com/smklein/toy-rss/storage"
+	"github.com/smklein/toy-rss/view"
+)
+
+// feedStatuses describes every subscription, running or not, oldest first.
+func (r *reader) feedStatuses() []view.FeedStatus {
+	subs := r.subscriptions.GetAll()
+	statuses := make([]view.FeedStatus, len(subs))
+	for i, sub := range subs {
+		status := view.FeedStatus{URL: sub.URL, Name: sub.Name}
+		if rf, ok := r.feedMap[sub.URL]; ok {
+			status.Title = rf.feed.GetTitle()
+			state, _ := rf.feed.GetState()
+			status.State = state.String()
+			status.Health = rf.feed.GetHealth()
+		} else {
+			status.Title = storage.MakeValidatorStorage(sub.URL).Get().Title
+			status.State = "stopped"
+			status.Health = storage.MakeHealthStorage(sub.URL).Get()
+		}
+		if status.Name == "" {
+			status.Name = status.Title
+		}
+		if status.Name == "" {
+			status.Name = sub.URL
+		}
+		statuses[i] = status
+	}
+	return statuses
+}
+
+// showFeeds handles ":feeds", (re)filling the feeds screen. It leaves the
+// status alone, so the outcome of the action before it stays visible.
+func (r *reader) showFeeds() view.StatusMsgStruct {
+	r.v.ShowFeedStatuses(r.feedStatuses())
+	return view.StatusMsgStruct{}
+}
+
+// refreshFeed handles ":refresh <feed>". A subscription which isn't running
+// (because it failed to start, say) is started again.
+func (r *reader) refreshFeed(args []string) view.StatusMsgStruct {
+	if len(args) == 0 {
+		return view.StatusMsgStruct{Message: "Usage: :refresh <feed>", Type: view.StatusError}
+	}
+	name := strings.Join(args, " ")
+	if _, rf := r.findFeed(name); rf != nil {
+		rf.feed.Refresh()
+		return view.StatusMsgStruct{Message: "Refreshing [" + rf.feed.GetTitle() + "]", Type: view.StatusSuccess}
+	}
+	sub, ok := r.subscriptions.Get(name)
+	if !ok {
+		return view.StatusMsgStruct{Message: "No such feed: " + name, Type: view.StatusError}
+	}
+	err := r.subscribe(sub.URL, sub.Name, sub.Folder, false, func(rf *runningFeed, err error) view.StatusMsgStruct {
+		if err != nil {
+			return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+		}
+		return view.StatusMsgStruct{Message: "Restarted Feed [" + rf.feed.GetTitle() + "]", Type: view.StatusSuccess}
+	})
+	if err != nil {
+		return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+	}
+	return view.StatusMsgStruct{Message: "Restarting " + sub.URL, Type: view.StatusInfo}
+}
+
+// renameFeed handles ":rename <feed> <name>", where <feed> is a URL or a
+// single-word title. The feed's items show the new name from then on.
+func (r *reader) renameFeed(args []string) view.StatusMsgStruct {
+	if len(args) < 2 {
+		return view.StatusMsgStruct{Message: "Usage: :rename <feed> <name>", Type: view.StatusError}
+	}
+	name := strings.Join(args[1:], " ")
+	URL, rf := r.findFeed(args[0])
+	if rf == nil {
+		if _, ok := r.subscriptions.Get(args[0]); !ok {
+			return view.StatusMsgStruct{Message: "No such feed: " + args[0], Type: view.StatusError}
+		}
+		URL = args[0]
+	}
+	r.subscriptions.Rename(URL, name)
+	if rf != nil {
+		r.v.SetChannelDisplayName(rf.feed.GetTitle(), name)
+	}
+	return view.StatusMsgStruct{Message: "Renamed [" + URL + "] to [" + name + "]", Type: view.StatusSuccess}
+}
@@ -0,0 +1,145 @@
+package main
+
+// This file handles ":import" and ":export" of OPML subscription lists.
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/smklein/toy-rss/opml"
+	"github.com/smklein/toy-rss/storage"
+	"github.com/smklein/toy-rss/view"
+)
+
+// opmlImport tracks a single ":import" while its feeds are added, one at a
+// time, so it can be summarized once the last one is done.
+type opmlImport struct {
+	filename   string
+	remaining  int
+	added      int
+	duplicates int
+	// Added, but their first fetch failed.
+	failed int
+}
+
+// pendingImport is a feed from an import, waiting for its turn to be added.
+type pendingImport struct {
+	entry opml.Entry
+	imp   *opmlImport
+}
+
+// finish records the outcome of adding one feed from the import.
+func (imp *opmlImport) finish(URL string, err error) view.StatusMsgStruct {
+	imp.remaining--
+	imp.added++
+	if err != nil {
+		imp.failed++
+		log.Println("Import of", URL, "failed:", err)
+		if imp.remaining > 0 {
+			// Keep going; the summary will count this one.
+			return view.StatusMsgStruct{Message: "Import: " + URL + ": " + err.Error() + " (subscribed anyway; :refresh it to try again)", Type: view.StatusError}
+		}
+	}
+	if imp.remaining > 0 {
+		return view.StatusMsgStruct{Message: "Importing " + imp.filename + ": " + strconv.Itoa(imp.remaining) + " left", Type: view.StatusInfo}
+	}
+	return imp.summary()
+}
+
+func (imp *opmlImport) summary() view.StatusMsgStruct {
+	status := view.StatusMsgStruct{
+		Message: "Imported " + strconv.Itoa(imp.added) + " feeds from " + imp.filename +
+			" (" + strconv.Itoa(imp.duplicates) + " duplicates, " + strconv.Itoa(imp.failed) + " failed to fetch)",
+		Type: view.StatusSuccess,
+	}
+	if imp.failed > 0 {
+		status.Type = view.StatusError
+	}
+	return status
+}
+
+// importOPML handles ":import <file>".
+// Feeds are added in the background, and kept even if their first fetch
+// fails; duplicates are skipped.
+func (r *reader) importOPML(args []string) view.StatusMsgStruct {
+	if len(args) == 0 {
+		return view.StatusMsgStruct{Message: "Usage: :import <file.opml>", Type: view.StatusError}
+	}
+	filename := strings.Join(args, " ")
+	file, err := os.Open(filename)
+	if err != nil {
+		return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+	}
+	defer file.Close()
+	entries, err := opml.Parse(file)
+	if err != nil {
+		return view.StatusMsgStruct{Message: "Import: " + err.Error(), Type: view.StatusError}
+	}
+
+	// By canonical URL, so "http://example.com/feed/" is already known as
+	// "https://example.com/feed".
+	known := make(map[string]bool)
+	for _, sub := range r.subscriptions.GetAll() {
+		known[storage.CanonicalURL(sub.URL)] = true
+	}
+	for URL := range r.feedMap {
+		known[storage.CanonicalURL(URL)] = true
+	}
+	for URL := range r.starting {
+		known[storage.CanonicalURL(URL)] = true
+	}
+	for URL := range r.pendingImports {
+		known[storage.CanonicalURL(URL)] = true
+	}
+
+	imp := &opmlImport{filename: filename}
+	var queued []storage.Subscription
+	for _, entry := range entries {
+		canonical := storage.CanonicalURL(entry.URL)
+		if known[canonical] {
+			imp.duplicates++
+			continue
+		}
+		known[canonical] = true
+		r.pendingImports[entry.URL] = &pendingImport{entry: entry, imp: imp}
+		queued = append(queued, storage.Subscription{URL: entry.URL})
+	}
+	imp.remaining = len(queued)
+	if imp.remaining == 0 {
+		return imp.summary()
+	}
+	r.queueNewFeeds(queued)
+	return view.StatusMsgStruct{Message: "Importing " + strconv.Itoa(imp.remaining) + " feeds from " + filename, Type: view.StatusInfo}
+}
+
+// exportOPML handles ":export <file>".
+func (r *reader) exportOPML(args []string) view.StatusMsgStruct {
+	if len(args) == 0 {
+		return view.StatusMsgStruct{Message: "Usage: :export <file.opml>", Type: view.StatusError}
+	}
+	filename := strings.Join(args, " ")
+
+	subs := r.subscriptions.GetAll()
+	entries := make([]opml.Entry, len(subs))
+	for i, sub := range subs {
+		entries[i] = opml.Entry{URL: sub.URL, Title: sub.Name, Folder: sub.Folder}
+		if entries[i].Title == "" {
+			entries[i].Title = sub.URL
+		}
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+	}
+	err = opml.Write(file, "toy-rss subscriptions", entries)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return view.StatusMsgStruct{Message: "Export: " + err.Error(), Type: view.StatusError}
+	}
+	return view.StatusMsgStruct{Message: "Exported " + strconv.Itoa(len(entries)) + " feeds to " + filename, Type: view.StatusSuccess}
+}
@@ -0,0 +1,392 @@
+// Package download fetches files (like podcast episodes) in the background,
+// a few at a time, picking up where it left off if interrupted.
+package download
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// partialSuffix marks files which haven't finished downloading yet.
+const partialSuffix = ".part"
+
+// progressInterval is how often a running download reports how it's going.
+const progressInterval = 500 * time.Millisecond
+
+// Defaults for Limits' zero fields.
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultReadTimeout    = 30 * time.Second
+	DefaultMaxSize        = 2 << 30
+)
+
+// Limits bounds what a download may cost. Zero fields are given their
+// defaults. How long a download takes in all isn't limited: a large file on
+// a slow link takes a while, and that's fine, so long as it keeps coming.
+type Limits struct {
+	// How long to wait for a server to accept a connection.
+	ConnectTimeout time.Duration
+	// How long to wait for a server to send more, once connected.
+	ReadTimeout time.Duration
+	// The largest file, in bytes, to download.
+	MaxSize int64
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.ConnectTimeout <= 0 {
+		l.ConnectTimeout = DefaultConnectTimeout
+	}
+	if l.ReadTimeout <= 0 {
+		l.ReadTimeout = DefaultReadTimeout
+	}
+	if l.MaxSize <= 0 {
+		l.MaxSize = DefaultMaxSize
+	}
+	return l
+}
+
+// defaultClient gives up on servers which don't answer within limits.
+func defaultClient(limits Limits) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: limits.ConnectTimeout}).DialContext,
+		TLSHandshakeTimeout:   limits.ConnectTimeout,
+		ResponseHeaderTimeout: limits.ReadTimeout,
+	}}
+}
+
+// Progress describes how far along a single download is.
+type Progress struct {
+	URL string
+	// Where the file is (or will be) saved.
+	Path     string
+	Received int64
+	// Zero if the server didn't say.
+	Total int64
+	Done  bool
+	// Set if the download failed. Done is set too.
+	Err error
+}
+
+func (p Progress) String() string {
+	name := filepath.Base(p.Path)
+	switch {
+	case p.Err != nil:
+		return "Download of " + name + " failed: " + p.Err.Error()
+	case p.Done:
+		return "Downloaded " + name + " (" + FormatSize(p.Received) + ")"
+	case p.Total > 0:
+		return "Downloading " + name + ": " + strconv.FormatInt(p.Received*100/p.Total, 10) + "% (" +
+			FormatSize(p.Received) + "/" + FormatSize(p.Total) + ")"
+	default:
+		return "Downloading " + name + ": " + FormatSize(p.Received)
+	}
+}
+
+// FormatSize turns a number of bytes into something readable, like "1.5 MB".
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "B"
+}
+
+type job struct {
+	URL  string
+	Path string
+}
+
+// Queue downloads files into a directory, a limited number at a time.
+type Queue struct {
+	dir    string
+	client *http.Client
+	limits Limits
+	// Downloads stop (keeping what they have) when this is cancelled.
+	ctx context.Context
+
+	jobRequest   chan job
+	progressPipe chan Progress
+
+	// URLs queued or in progress, so nothing is downloaded twice at once.
+	active     map[string]bool
+	activeLock sync.Mutex
+}
+
+// MakeQueue starts concurrency workers, downloading into dir within limits
+// until ctx is done. If client is nil, one which times out unresponsive
+// servers is used.
+func MakeQueue(ctx context.Context, dir string, concurrency int, limits Limits, client *http.Client) *Queue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	limits = limits.withDefaults()
+	if client == nil {
+		client = defaultClient(limits)
+	}
+	q := &Queue{
+		dir:          dir,
+		client:       client,
+		limits:       limits,
+		ctx:          ctx,
+		jobRequest:   make(chan job, 100),
+		progressPipe: make(chan Progress, 20),
+		active:       make(map[string]bool),
+	}
+	for i := 0; i < concurrency; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// GetChanProgress returns the pipe on which downloads report how they're
+// doing. Someone must be reading from it, or downloads will stall.
+func (q *Queue) GetChanProgress() chan Progress {
+	return q.progressPipe
+}
+
+// Add queues URL for download into the subdirectory group (the feed title,
+// say). Returns the path the file will be saved to.
+func (q *Queue) Add(URL, group string) (string, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return "", errors.New("Bad download URL: " + err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New("Cannot download " + URL + ": not an HTTP URL")
+	}
+	p := filepath.Join(q.dir, sanitizeFilename(group), filenameFor(URL, u))
+
+	q.activeLock.Lock()
+	defer q.activeLock.Unlock()
+	if q.active[URL] {
+		return "", errors.New("Already downloading " + URL)
+	}
+	select {
+	case q.jobRequest <- job{URL: URL, Path: p}:
+	default:
+		return "", errors.New("Too many downloads queued; try again later")
+	}
+	q.active[URL] = true
+	return p, nil
+}
+
+// filenameFor names the file URL is saved to: the name it has on the server,
+// tagged with a short hash of the whole URL, since different enclosures
+// (episode 12 of two podcasts, say) often share a name.
+func filenameFor(URL string, u *url.URL) string {
+	sum := sha1.Sum([]byte(URL))
+	tag := hex.EncodeToString(sum[:4])
+	name := sanitizeFilename(path.Base(u.Path))
+	ext := filepath.Ext(name)
+	if ext == name {
+		// A dotfile, or "download"; there's nothing to keep at the end.
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext) + "-" + tag + ext
+}
+
+// sanitizeFilename makes name safe to use as a single path element.
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|', 0:
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" || name == "." || name == ".." {
+		return "download"
+	}
+	return name
+}
+
+func (q *Queue) worker() {
+	for {
+		var j job
+		select {
+		case j = <-q.jobRequest:
+		case <-q.ctx.Done():
+			return
+		}
+		err := q.fetch(j)
+		if err != nil {
+			log.Println("Download of", j.URL, "failed:", err)
+		}
+		q.activeLock.Lock()
+		delete(q.active, j.URL)
+		q.activeLock.Unlock()
+		if err != nil {
+			q.report(Progress{URL: j.URL, Path: j.Path, Done: true, Err: err})
+		}
+	}
+}
+
+// report passes p along, unless the queue has been stopped and nobody is
+// listening any more.
+func (q *Queue) report(p Progress) {
+	select {
+	case q.progressPipe <- p:
+	case <-q.ctx.Done():
+	}
+}
+
+// rangeStart returns the offset a Content-Range header (like
+// "bytes 1234-4999/5000") starts at.
+func rangeStart(contentRange string) (int64, bool) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, false
+	}
+	dash := strings.Index(contentRange, "-")
+	if dash < 0 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(contentRange[len("bytes "):dash]), 10, 64)
+	return start, err == nil
+}
+
+// fetch downloads j into a partial file next to its final path, resuming the
+// partial file if one is already there, and renames it once complete.
+func (q *Queue) fetch(j job) error {
+	if info, err := os.Stat(j.Path); err == nil {
+		// Finished some previous time.
+		q.report(Progress{URL: j.URL, Path: j.Path, Received: info.Size(), Total: info.Size(), Done: true})
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(j.Path), 0755); err != nil {
+		return err
+	}
+	partial := j.Path + partialSuffix
+
+	var offset int64
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequest("GET", j.URL, nil)
+	if err != nil {
+		return err
+	}
+	// Cancelled if the server goes quiet for too long.
+	ctx, cancel := context.WithCancel(q.ctx)
+	defer cancel()
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if start, ok := rangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			// Appending would leave a hole, or a repeat, in the file.
+			os.Remove(partial)
+			return errors.New("Server resumed from the wrong place (" + resp.Header.Get("Content-Range") +
+				"); starting over next time")
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// The server ignored the Range; start over.
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is already the whole thing.
+		if offset == 0 {
+			return errors.New(resp.Status)
+		}
+		resp.Body.Close()
+		return q.finish(j, partial, offset)
+	default:
+		return errors.New(resp.Status)
+	}
+
+	var total int64
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	tooLarge := errors.New("Larger than " + FormatSize(q.limits.MaxSize) + "; not downloading it")
+	if total > q.limits.MaxSize {
+		os.Remove(partial)
+		return tooLarge
+	}
+	out, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	stalled := time.AfterFunc(q.limits.ReadTimeout, cancel)
+	defer stalled.Stop()
+	received := offset
+	lastReport := time.Now()
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		stalled.Reset(q.limits.ReadTimeout)
+		if received+int64(n) > q.limits.MaxSize {
+			out.Close()
+			os.Remove(partial)
+			return tooLarge
+		}
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				out.Close()
+				return err
+			}
+			received += int64(n)
+			if time.Since(lastReport) >= progressInterval {
+				lastReport = time.Now()
+				q.report(Progress{URL: j.URL, Path: j.Path, Received: received, Total: total})
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// Keep what we have; the next attempt resumes from here.
+			out.Close()
+			if ctx.Err() != nil && q.ctx.Err() == nil {
+				return errors.New("Server stopped sending for " + q.limits.ReadTimeout.String())
+			}
+			return readErr
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if total > 0 && received < total {
+		return errors.New("Download ended early: got " + FormatSize(received) + " of " + FormatSize(total))
+	}
+	return q.finish(j, partial, received)
+}
+
+func (q *Queue) finish(j job, partial string, size int64) error {
+	if err := os.Rename(partial, j.Path); err != nil {
+		return err
+	}
+	q.report(Progress{URL: j.URL, Path: j.Path, Received: size, Total: size, Done: true})
+	return nil
+}
@@ -0,0 +1,317 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var episode = bytes.Repeat([]byte("0123456789"), 10000)
+
+// rangeServer serves episode, honoring Range requests, and remembers the last
+// Range it was asked for.
+type rangeServer struct {
+	*httptest.Server
+	lock      sync.Mutex
+	lastRange string
+}
+
+func makeRangeServer() *rangeServer {
+	s := &rangeServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.lastRange = r.Header.Get("Range")
+		s.lock.Unlock()
+		http.ServeContent(w, r, "episode.mp3", time.Time{}, bytes.NewReader(episode))
+	}))
+	return s
+}
+
+func (s *rangeServer) getLastRange() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lastRange
+}
+
+// waitForDone skips over progress reports until the download finishes.
+func waitForDone(t *testing.T, q *Queue) Progress {
+	for {
+		select {
+		case p := <-q.GetChanProgress():
+			if p.Done {
+				return p
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Download never finished")
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	s := makeRangeServer()
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := MakeQueue(context.Background(), dir, 2, Limits{}, nil)
+	p, err := q.Add(s.URL+"/episodes/episode.mp3", "My/Podcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(p) != filepath.Join(dir, "My_Podcast") || !strings.HasPrefix(filepath.Base(p), "episode-") || filepath.Ext(p) != ".mp3" {
+		t.Error("Unexpected path: ", p, ", expected My_Podcast/episode-<hash>.mp3")
+	}
+
+	result := waitForDone(t, q)
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if result.Received != int64(len(episode)) {
+		t.Error("Unexpected size: ", result.Received, ", expected ", len(episode))
+	}
+	if got, _ := ioutil.ReadFile(p); !bytes.Equal(got, episode) {
+		t.Error("Downloaded file does not match")
+	}
+	if _, err := os.Stat(p + partialSuffix); !os.IsNotExist(err) {
+		t.Error("Partial file left behind: ", err)
+	}
+}
+
+func TestDownloadResumes(t *testing.T) {
+	s := makeRangeServer()
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Pretend we were interrupted part way through, last time.
+	URL := s.URL + "/episode.mp3"
+	u, _ := url.Parse(URL)
+	p := filepath.Join(dir, "Podcast", filenameFor(URL, u))
+	os.MkdirAll(filepath.Dir(p), 0755)
+	if err := ioutil.WriteFile(p+partialSuffix, episode[:1234], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q := MakeQueue(context.Background(), dir, 1, Limits{}, nil)
+	if _, err := q.Add(URL, "Podcast"); err != nil {
+		t.Fatal(err)
+	}
+	if result := waitForDone(t, q); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if r := s.getLastRange(); r != "bytes=1234-" {
+		t.Error("Unexpected Range: ", r, ", expected bytes=1234-")
+	}
+	if got, _ := ioutil.ReadFile(p); !bytes.Equal(got, episode) {
+		t.Error("Resumed file does not match")
+	}
+}
+
+func TestDownloadRefusesMisplacedResume(t *testing.T) {
+	// Answers every Range with the start of the file.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-99/"+strconv.Itoa(len(episode)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(episode[:100])
+	}))
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	URL := s.URL + "/episode.mp3"
+	u, _ := url.Parse(URL)
+	p := filepath.Join(dir, "Podcast", filenameFor(URL, u))
+	os.MkdirAll(filepath.Dir(p), 0755)
+	if err := ioutil.WriteFile(p+partialSuffix, episode[:1234], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q := MakeQueue(context.Background(), dir, 1, Limits{}, nil)
+	if _, err := q.Add(URL, "Podcast"); err != nil {
+		t.Fatal(err)
+	}
+	if result := waitForDone(t, q); result.Err == nil {
+		t.Error("Expected an error for a resume from the wrong place")
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Error("Mismatched resume was saved: ", err)
+	}
+	if _, err := os.Stat(p + partialSuffix); !os.IsNotExist(err) {
+		t.Error("Partial file kept after a mismatched resume: ", err)
+	}
+}
+
+func TestFilenamesAreUnique(t *testing.T) {
+	a, _ := url.Parse("http://example.com/one/episode.mp3")
+	b, _ := url.Parse("http://example.com/two/episode.mp3")
+	nameA, nameB := filenameFor(a.String(), a), filenameFor(b.String(), b)
+	if nameA == nameB {
+		t.Error("Different enclosures share a filename: ", nameA)
+	}
+	if filepath.Ext(nameA) != ".mp3" {
+		t.Error("Unexpected extension: ", nameA, ", expected .mp3")
+	}
+	if again := filenameFor(a.String(), a); again != nameA {
+		t.Error("Unexpected filename for the same URL: ", again, ", expected ", nameA)
+	}
+}
+
+func TestDownloadStopsWithContext(t *testing.T) {
+	cancelled := make(chan bool)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(episode[:100])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := MakeQueue(ctx, dir, 1, Limits{}, nil)
+	if _, err := q.Add(s.URL+"/episode.mp3", "Podcast"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("Download carried on after its context was cancelled")
+	}
+}
+
+func TestDownloadSizeLimit(t *testing.T) {
+	s := makeRangeServer()
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := MakeQueue(context.Background(), dir, 1, Limits{MaxSize: int64(len(episode) - 1)}, nil)
+	p, err := q.Add(s.URL+"/episode.mp3", "Podcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := waitForDone(t, q); result.Err == nil || !strings.Contains(result.Err.Error(), "Larger than") {
+		t.Error("Unexpected error for an oversized file: ", result.Err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Error("Oversized file was saved: ", err)
+	}
+}
+
+func TestDownloadTimesOutStalledServer(t *testing.T) {
+	release := make(chan bool)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(episode[:100])
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer s.Close()
+	defer close(release)
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := MakeQueue(context.Background(), dir, 1, Limits{ReadTimeout: 50 * time.Millisecond}, nil)
+	p, err := q.Add(s.URL+"/episode.mp3", "Podcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := waitForDone(t, q); result.Err == nil || !strings.Contains(result.Err.Error(), "stopped sending") {
+		t.Error("Unexpected error for a stalled server: ", result.Err)
+	}
+	// What arrived is kept, to resume from.
+	if got, _ := ioutil.ReadFile(p + partialSuffix); !bytes.Equal(got, episode[:100]) {
+		t.Error("Unexpected partial file: ", len(got), " bytes, expected 100")
+	}
+}
+
+func TestDownloadConcurrencyLimit(t *testing.T) {
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	release := make(chan bool)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		<-release
+		lock.Lock()
+		running--
+		lock.Unlock()
+		w.Write([]byte("done"))
+	}))
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := MakeQueue(context.Background(), dir, 2, Limits{}, nil)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := q.Add(s.URL+"/"+name, "Podcast"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.Add(s.URL+"/a", "Podcast"); err == nil || !strings.Contains(err.Error(), "Already") {
+		t.Error("Unexpected error re-adding a queued download: ", err)
+	}
+	// Both workers should pick something up; nobody else should.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		r := running
+		lock.Unlock()
+		if r == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Unexpected concurrent downloads: ", r, ", expected 2")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		release <- true
+		if result := waitForDone(t, q); result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if maxRunning != 2 {
+		t.Error("Unexpected concurrent downloads: ", maxRunning, ", expected 2")
+	}
+}
@@ -1,90 +1,466 @@
 package feed
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
+	"io"
 	"log"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/SlyMarbo/rss"
 	"github.com/smklein/toy-rss/storage"
 )
 
+func init() {
+	// We are going to handle a database of items ourselves. This is set once,
+	// rather than by every feed as it starts, since it's shared by them all.
+	rss.CacheParsedItemIDs(false)
+}
+
 // GetTitle does what you would expect.
 func (f *Feed) GetTitle() string {
-	return f.Title
+	f.stateLock.RLock()
+	defer f.stateLock.RUnlock()
+	return f.title
+}
+
+func (f *Feed) setTitle(title string) {
+	f.stateLock.Lock()
+	defer f.stateLock.Unlock()
+	f.title = title
+}
+
+// SetRefreshInterval overrides how often the feed is polled. Zero restores
+// the automatic schedule.
+func (f *Feed) SetRefreshInterval(interval time.Duration) {
+	f.scheduleLock.Lock()
+	defer f.scheduleLock.Unlock()
+	f.scheduler.override = interval
+
+	// Wake up doFeed, if it's waiting, so the new interval applies now.
+	select {
+	case f.rescheduleRequest <- true:
+	default:
+	}
+}
+
+// Refresh polls the feed again as soon as the fetch scheduler allows.
+func (f *Feed) Refresh() {
+	f.scheduleLock.Lock()
+	defer f.scheduleLock.Unlock()
+	f.refreshNow = true
+
+	select {
+	case f.rescheduleRequest <- true:
+	default:
+	}
+}
+
+// awaitTurn waits until the fetch scheduler lets us poll, no earlier than
+// due. If the feed's settings change in the meantime, reschedule picks a new
+// due time. Once it returns true, the caller must call releaseTurn after
+// fetching. Returns false if the feed (or the fetch scheduler) was ended in
+// the meantime.
+func (f *Feed) awaitTurn(due time.Time, reschedule func() time.Time) bool {
+	for !f.fetchScheduler().acquire(f.ctx, f.host, due, f.rescheduleRequest) {
+		if f.ctx.Err() != nil || f.fetchScheduler().ctx.Err() != nil {
+			return false
+		}
+		due = reschedule()
+	}
+	return true
+}
+
+func (f *Feed) releaseTurn() {
+	f.fetchScheduler().release(f.host)
+}
+
+// waitToRetry waits for d after a failed poll, or less if the feed's settings
+// change in the meantime. Returns false if the feed was ended in the meantime.
+func (f *Feed) waitToRetry(d time.Duration) bool {
+	return f.awaitTurn(f.clock().Now().Add(d), f.clock().Now)
+}
+
+// waitForNextPoll waits until the feed is due again, plus jitter. If the
+// refresh interval changes in the meantime, the wait is recomputed from
+// lastPoll. Returns false if the feed was ended in the meantime.
+func (f *Feed) waitForNextPoll(lastPoll time.Time, result *fetchResult, jitter time.Duration) bool {
+	f.scheduleLock.Lock()
+	if result.doc != nil {
+		f.scheduler.observeDocument(result.body, result.doc)
+	}
+	f.scheduleLock.Unlock()
+
+	nextPoll := func() time.Time {
+		f.scheduleLock.Lock()
+		defer f.scheduleLock.Unlock()
+		if f.refreshNow {
+			f.refreshNow = false
+			return f.clock().Now()
+		}
+		nextPoll := f.scheduler.nextPoll(lastPoll, result.cacheExpiry).Add(jitter)
+		log.Println("Next poll of", f.GetTitle(), "at", nextPoll)
+		return nextPoll
+	}
+	return f.awaitTurn(nextPoll(), nextPoll)
+}
+
+// GetState returns whether the feed is working, and if not, why.
+func (f *Feed) GetState() (FeedState, error) {
+	f.stateLock.RLock()
+	defer f.stateLock.RUnlock()
+	return f.state, f.lastErr
+}
+
+// GetChanErrors returns the pipe on which failed polls are reported.
+func (f *Feed) GetChanErrors() chan *FeedError {
+	return f.errorPipe
+}
+
+// GetMetadata returns what the feed last said about itself.
+func (f *Feed) GetMetadata() storage.ChannelMetadata {
+	f.stateLock.RLock()
+	defer f.stateLock.RUnlock()
+	return f.metadata
+}
+
+// GetChanMetadata returns the pipe on which metadata changes are reported.
+func (f *Feed) GetChanMetadata() chan storage.ChannelMetadata {
+	return f.metadataPipe
+}
+
+// updateMetadata records the latest metadata, reporting it if it changed.
+// Returns false if the feed was ended in the meantime.
+func (f *Feed) updateMetadata(metadata storage.ChannelMetadata) bool {
+	f.stateLock.Lock()
+	changed := !reflect.DeepEqual(f.metadata, metadata)
+	f.metadata = metadata
+	f.stateLock.Unlock()
+	if !changed {
+		return true
+	}
+
+	select {
+	case f.metadataPipe <- metadata:
+		return true
+	case <-f.ctx.Done():
+		return false
+	}
+}
+
+// GetHealth returns how polling the feed has been going.
+func (f *Feed) GetHealth() storage.FeedHealth {
+	f.stateLock.RLock()
+	defer f.stateLock.RUnlock()
+	return f.health
+}
+
+func (f *Feed) setHealth(healthStorage *storage.HealthStorage, health storage.FeedHealth) {
+	f.stateLock.Lock()
+	f.health = health
+	f.stateLock.Unlock()
+	if err := healthStorage.Set(health); err != nil {
+		log.Println(err)
+	}
+}
+
+func (f *Feed) setState(state FeedState, err error) {
+	f.stateLock.Lock()
+	defer f.stateLock.Unlock()
+	f.state = state
+	f.lastErr = err
+}
+
+// fingerprintPrefix marks fingerprints in the feed's history, as opposed to
+// the titles which were stored there before.
+const fingerprintPrefix = "sha1:"
+
+// fingerprint summarizes what an item says, so edits can be spotted. The link
+// and date are left out; they churn without the item really changing.
+func fingerprint(item *documentItem) string {
+	h := sha1.New()
+	io.WriteString(h, item.Title)
+	h.Write([]byte{0})
+	io.WriteString(h, item.Summary)
+	h.Write([]byte{0})
+	io.WriteString(h, item.Content)
+	return fingerprintPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
+// makeEntry turns a parsed item into what we hand to the view.
+func (f *Feed) makeEntry(item *documentItem) *storage.RssEntry {
+	date, estimated := itemDate(item, f.clock().Now())
+	return &storage.RssEntry{
+		FeedTitle:   f.GetTitle(),
+		ItemID:      item.ID,
+		ItemTitle:   item.Title,
+		ItemSummary: item.Summary,
+		ItemContent: item.Content,
+		URL:         item.Link,
+		ItemDate:    date,
+		ItemAuthor:  item.Author,
+		Enclosures:  item.Enclosures,
+
+		ItemRawDate:       item.RawDate,
+		ItemDateEstimated: estimated,
+	}
 }
 
 func (f *Feed) doFeed(initPipe chan error) {
+	defer close(f.done)
 	defer close(f.itemPipe)
+	defer close(f.errorPipe)
+	defer close(f.metadataPipe)
+	defer close(f.dedupePipe)
+	defer close(f.movedPipe)
 	defer close(initPipe)
 
-	// We are going to handle a database of items ourselves.
-	rss.CacheParsedItemIDs(false)
-
 	// Avoid duplicates, up to a limit, but let expirations occur.
 	var feedStorage *storage.FeedStorage
+	// Lets us skip downloading and parsing documents which haven't changed.
+	validatorStorage := storage.MakeValidatorStorage(f.URL)
+
+	// Counts failures in a row, so we know how long to back off.
+	var retries retryState
+	// The items from the last poll which returned any, for spotting IDs
+	// which churn.
+	var lastItems []*documentItem
+	// How polling has gone, for anyone who asks.
+	healthStorage := storage.MakeHealthStorage(f.URL)
+	health := healthStorage.Get()
+
+	// Spreads out feeds which start together, from their second poll on.
+	// Unless asked to, the first can't wait; someone wants the title.
+	jitter := f.fetchScheduler().jitter()
+	firstPoll := f.clock().Now()
+	if f.SpreadFirstPoll {
+		firstPoll, jitter = firstPoll.Add(jitter), 0
+	}
+
+	// Only this goroutine changes the title; others read it through
+	// GetTitle.
+	var title string
+	// Set once Start has been told how the first poll went.
+	initialized := false
 
+	if !f.awaitTurn(firstPoll, f.clock().Now) {
+		return
+	}
 	for {
-		if f.disabled {
+		// This poll is whatever refresh was asked for, even if it came
+		// early for some other reason (like a retry).
+		f.scheduleLock.Lock()
+		f.refreshNow = false
+		f.scheduleLock.Unlock()
+
+		lastPoll := f.clock().Now()
+		validators := validatorStorage.Get()
+		result, err := f.fetchConditionally(validators)
+		f.releaseTurn()
+		if f.ctx.Err() != nil {
+			// Ended mid-fetch.
 			return
 		}
-
-		rssFeed, err := rss.Fetch(f.URL)
+		health.LastPoll = lastPoll
+		health.LastLatency = f.clock().Now().Sub(lastPoll)
+		if err != nil {
+			health.LastError = lastPoll
+			health.LastErrorMessage = err.Error()
+			health.LastStatusCode = statusCodeOf(err)
+			health.ConsecutiveFailures++
+		} else {
+			health.LastSuccess = lastPoll
+			health.LastStatusCode = result.statusCode
+			health.ConsecutiveFailures = 0
+			if result.doc != nil {
+				health.ItemCount = len(result.doc.Items)
+			}
+		}
 		if err != nil {
 			log.Println(err)
-			initPipe <- errors.New("Fetching RSS feed failed: " + err.Error())
-			f.disabled = true
-			return
+			if !initialized && validators.Title == "" {
+				// We've never seen this feed work, so don't bother retrying;
+				// let whoever is adding it know right away.
+				initPipe <- errors.New("Fetching RSS feed failed: " + err.Error())
+				return
+			}
+			// Otherwise, this is probably a blip. We still know the title
+			// from last time, so start up anyway and retry in the background.
+			title = validators.Title
+		} else {
+			retries.reset()
+			f.setState(FeedHealthy, nil)
+
+			if result.doc != nil {
+				title = result.doc.Title
+			} else {
+				// Not modified since the last poll; nothing new to parse.
+				title = result.validators.Title
+			}
+			result.validators.Title = title
+			if result.movedTo != "" && !f.move(result.movedTo, validatorStorage, healthStorage) {
+				return
+			}
 		}
-		// TODO(smklein): Set other non-Item features here
-		f.Title = rssFeed.Title
+		f.setTitle(title)
 
-		if !f.initialized {
+		if !initialized {
 			initPipe <- nil
-			f.initialized = true
-			feedStorage = storage.MakeFeedStorage(f.Title, 1000)
+			initialized = true
+			feedStorage = storage.MakeFeedStorage(title, 1000)
 		}
-		for _, item := range rssFeed.Items {
-			if feedStorage.Get(item.ID) == "" {
-				feedStorage.Add(item.ID, item.Title)
-				// Only place items in the itemPipe if they are not visible in
-				// the feedStorage.
-				newItem := &storage.RssEntry{}
-				newItem.FeedTitle = f.Title
-				newItem.ItemTitle = item.Title
-				newItem.ItemSummary = item.Summary
-				newItem.ItemContent = item.Content
-				newItem.URL = item.Link
-				newItem.ItemDate = item.Date
-				f.itemPipe <- newItem
+
+		if err != nil {
+			f.setHealth(healthStorage, health)
+			state, wait := retries.recordFailure(err)
+			f.setState(state, err)
+			// Init is over, so nobody is listening on initPipe any more.
+			select {
+			case f.errorPipe <- &FeedError{Title: title, State: state, Err: err}:
+			case <-f.ctx.Done():
+				return
+			}
+			log.Println("Retrying", title, "in", wait)
+			if !f.waitToRetry(wait) {
+				return
+			}
+			continue
+		}
+
+		// A nil document means "not modified"; everything was seen last time.
+		newItems := 0
+		if result.doc != nil {
+			if !f.updateMetadata(result.doc.Metadata) {
+				return
 			}
+			strategy, auto, adopt := f.dedupeStrategy()
+			if auto && strategy == storage.DedupeGUID {
+				if detected := detectChurn(lastItems, result.doc.Items); detected != "" {
+					log.Println("IDs of", title, "keep changing; deduping by", detected)
+					if !f.switchDedupe(detected) {
+						return
+					}
+					strategy, adopt = detected, true
+				}
+			}
+			// After switching strategies, items from the last poll are
+			// already known, but not under their new keys. With no last
+			// poll to go on, every item is assumed known.
+			var known map[string]bool
+			if adopt {
+				known = make(map[string]bool)
+				for _, item := range lastItems {
+					known[dedupeKey(strategy, item)] = true
+				}
+			}
+			for _, item := range result.doc.Items {
+				// The history maps each item's key to its fingerprint.
+				key := dedupeKey(strategy, item)
+				fp := fingerprint(item)
+				seen := feedStorage.Get(key)
+				if seen == "" && item.ID == "" && item.Link != "" {
+					// Items without IDs used to be recorded under the one
+					// the rss package made up: their link.
+					if seen = feedStorage.Get(item.Link); seen != "" {
+						feedStorage.Add(key, seen)
+					}
+				}
+				if seen == fp {
+					continue
+				}
+				if seen != "" && !strings.HasPrefix(seen, fingerprintPrefix) {
+					// Recorded before fingerprints were; we can't tell
+					// whether it changed, so assume it didn't.
+					feedStorage.Add(key, fp)
+					continue
+				}
+				if seen == "" && adopt && (lastItems == nil || known[key]) {
+					feedStorage.Add(key, fp)
+					continue
+				}
+
+				// Only place items in the itemPipe if they are new, or have
+				// changed since they were last sent. They're only recorded
+				// once sent, so an item cut off by End comes again next time.
+				newItem := f.makeEntry(item)
+				newItem.Updated = seen != ""
+				select {
+				case f.itemPipe <- newItem:
+				case <-f.ctx.Done():
+					return
+				}
+				feedStorage.Add(key, fp)
+				if !newItem.Updated {
+					newItems++
+				}
+			}
+			lastItems = result.doc.Items
+		}
+		// Only now is everything in the document sent; saved any sooner, the
+		// validators would have an item cut off by End answered with "not
+		// modified" next time.
+		if err := validatorStorage.Set(result.validators); err != nil {
+			// The next poll just fetches the whole document.
+			log.Println(err)
 		}
+		if newItems > 0 {
+			health.LastNewItem = lastPoll
+			health.NewItemCount += newItems
+		}
+		f.setHealth(healthStorage, health)
 
-		// TODO(smklein): Make this more conservative (rssFeed.Refresh)
-		<-time.After(time.Duration(20 * time.Second))
+		if !f.waitForNextPoll(lastPoll, result, jitter) {
+			return
+		}
+		jitter = 0
 	}
 }
 
 // Start begins the feed. It will continue to retrieve items from the URL at an
-// interval. Although no formal guarantees are made regarding duplicates,
-// generally, it can be assumed that duplicates will not be sent on the pipe
-// for a while.
-func (f *Feed) Start(URL string) (chan *storage.RssEntry, error) {
+// interval, until ctx is cancelled or End is called. Although no formal
+// guarantees are made regarding duplicates, generally, it can be assumed that
+// duplicates will not be sent on the pipe for a while.
+func (f *Feed) Start(ctx context.Context, URL string) (chan *storage.RssEntry, error) {
 	log.Println("Start: ", URL)
 	f.URL = URL
+	f.host = hostOf(URL)
 	f.itemPipe = make(chan *storage.RssEntry, 20)
+	f.errorPipe = make(chan *FeedError, 5)
+	f.metadataPipe = make(chan storage.ChannelMetadata, 1)
+	f.dedupePipe = make(chan string, 1)
+	f.movedPipe = make(chan FeedMove, 1)
+	f.rescheduleRequest = make(chan bool, 1)
+	f.done = make(chan bool)
+	f.ctx, f.cancel = context.WithCancel(ctx)
 
 	initPipe := make(chan error)
 	go f.doFeed(initPipe)
-	err := <-initPipe
+	err, ok := <-initPipe
+	if !ok {
+		// Cancelled before the first poll finished.
+		err = errors.New("Starting feed: " + f.ctx.Err().Error())
+	}
 	if err != nil {
-		f.disabled = true
+		f.cancel()
+		<-f.done
 		return nil, err
 	}
 	return f.itemPipe, nil
 }
 
-// End terminates the feed.
+// End terminates the feed, interrupting any fetch or wait in progress. Once it
+// returns, the feed has stopped touching its storage, and the item pipe has
+// been closed. Calling End more than once, or after the context given to
+// Start was cancelled, is harmless.
 func (f *Feed) End() {
-	f.disabled = true
+	if f.cancel == nil {
+		// Never started.
+		return
+	}
+	f.cancel()
+	<-f.done
 }
@@ -0,0 +1,153 @@
+package feed
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+// Prefixes of a FeedAuth's SecretSource.
+const (
+	secretFromEnv  = "env:"
+	secretFromFile = "file:"
+)
+
+// authError is returned when a feed's credentials can't be sent, or were
+// refused.
+type authError struct {
+	err error
+}
+
+func (e *authError) Error() string {
+	return "Authentication failed: " + e.err.Error()
+}
+
+// ValidSecretSource reports whether source says where to find a secret,
+// rather than (say) being the secret itself.
+func ValidSecretSource(source string) bool {
+	return (strings.HasPrefix(source, secretFromEnv) && len(source) > len(secretFromEnv)) ||
+		(strings.HasPrefix(source, secretFromFile) && len(source) > len(secretFromFile))
+}
+
+// resolveSecret reads the secret that source points at. It's read on every
+// request, so rotated tokens are picked up without a restart.
+func resolveSecret(source string) (string, error) {
+	switch {
+	case !ValidSecretSource(source):
+		return "", errors.New("Secret source must be env:NAME or file:PATH")
+	case strings.HasPrefix(source, secretFromEnv):
+		name := strings.TrimPrefix(source, secretFromEnv)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("Environment variable " + name + " is not set")
+		}
+		return secret, nil
+	default:
+		b, err := ioutil.ReadFile(strings.TrimPrefix(source, secretFromFile))
+		if err != nil {
+			return "", errors.New("Reading secret failed: " + err.Error())
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+}
+
+// SetRequestSettings changes the credentials and headers sent to the feed's
+// server. A feed that is waiting to retry tries again right away.
+func (f *Feed) SetRequestSettings(settings storage.RequestSettings) {
+	f.requestLock.Lock()
+	f.requestSettings = settings
+	f.requestLock.Unlock()
+
+	select {
+	case f.rescheduleRequest <- true:
+	default:
+	}
+}
+
+// applyRequestSettings adds the feed's credentials and custom headers to req.
+func (f *Feed) applyRequestSettings(req *http.Request) error {
+	f.requestLock.RLock()
+	settings := f.requestSettings
+	f.requestLock.RUnlock()
+
+	for name, value := range settings.Headers {
+		req.Header.Set(name, value)
+	}
+	if settings.UserAgent != "" {
+		req.Header.Set("User-Agent", settings.UserAgent)
+	}
+
+	auth := settings.Auth
+	if auth.Kind == storage.AuthNone {
+		return nil
+	}
+	secret, err := resolveSecret(auth.SecretSource)
+	if err != nil {
+		return &authError{err}
+	}
+	switch auth.Kind {
+	case storage.AuthBasic:
+		req.SetBasicAuth(auth.Username, secret)
+	case storage.AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+secret)
+	case storage.AuthCookie:
+		req.Header.Set("Cookie", secret)
+	default:
+		return &authError{errors.New("Unknown kind of authentication: " + auth.Kind)}
+	}
+	return nil
+}
+
+// credentialHeaders names the headers applyRequestSettings may send which
+// are nobody's business but the feed's server.
+func (f *Feed) credentialHeaders() []string {
+	f.requestLock.RLock()
+	defer f.requestLock.RUnlock()
+	names := []string{"Authorization", "Cookie"}
+	for name := range f.requestSettings.Headers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// leavesOrigin reports whether a request for to, made on behalf of from, would
+// go to another server, or go unencrypted where from was not.
+func leavesOrigin(from, to *url.URL) bool {
+	return !strings.EqualFold(from.Host, to.Host) || (from.Scheme == "https" && to.Scheme != "https")
+}
+
+// keepingCredentials returns fetcher, changed so that redirects which leave
+// the first request's origin don't carry headers along. Only an
+// *http.Client can be changed; any other Fetcher must see to it itself.
+func keepingCredentials(fetcher Fetcher, headers []string) Fetcher {
+	client, ok := fetcher.(*http.Client)
+	if !ok {
+		return fetcher
+	}
+	check := client.CheckRedirect
+	guarded := *client
+	guarded.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if check != nil {
+			if err := check(req, via); err != nil {
+				return err
+			}
+		} else if len(via) >= 10 {
+			// As http.Client would have.
+			return errors.New("Stopped after 10 redirects")
+		}
+		// Each hop starts from the first request's headers, so each is
+		// checked against where that went.
+		if leavesOrigin(via[0].URL, req.URL) {
+			for _, name := range headers {
+				req.Header.Del(name)
+			}
+		}
+		return nil
+	}
+	return &guarded
+}
@@ -0,0 +1,37 @@
+package feed
+
+import (
+	"net/http"
+	"time"
+)
+
+// Fetcher performs the HTTP requests a feed makes. *http.Client is one.
+type Fetcher interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Clock is the feed's source of time, so polling can be driven by tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (f *Feed) fetcher() Fetcher {
+	if f.Fetcher == nil {
+		return http.DefaultClient
+	}
+	return f.Fetcher
+}
+
+func (f *Feed) clock() Clock {
+	if f.Clock == nil {
+		return realClock{}
+	}
+	return f.Clock
+}
@@ -0,0 +1,24 @@
+package feed
+
+// This file decides which date each item is shown with.
+
+import "time"
+
+// How far ahead of us an item may date itself before we stop believing it:
+// enough for clocks which are a little off, or a timezone mixed up.
+const maxFutureDate = 24 * time.Hour
+
+// itemDate is when item says it was published, unless it doesn't say, or
+// says it's from the future; then it's when we first saw it, and estimated
+// is set.
+func itemDate(item *documentItem, firstSeen time.Time) (date time.Time, estimated bool) {
+	if item.Date.IsZero() || item.RawDate == "" {
+		// Without a date in the document, any date we have was made up
+		// while parsing.
+		return firstSeen, true
+	}
+	if item.Date.After(firstSeen.Add(maxFutureDate)) {
+		return firstSeen, true
+	}
+	return item.Date, false
+}
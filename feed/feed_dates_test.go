@@ -0,0 +1,48 @@
+package feed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestItemDate(t *testing.T) {
+	firstSeen := time.Date(2016, 5, 31, 12, 0, 0, 0, time.UTC)
+	published := time.Date(2016, 5, 30, 8, 0, 0, 0, time.FixedZone("PDT", -7*60*60))
+
+	tests := []struct {
+		item      documentItem
+		date      time.Time
+		estimated bool
+	}{
+		{documentItem{Date: published, RawDate: "Mon, 30 May 2016 08:00:00 PDT"}, published, false},
+		// Made up by the parser.
+		{documentItem{Date: published}, firstSeen, true},
+		{documentItem{}, firstSeen, true},
+		// A clock a few hours off is believable; next year isn't.
+		{documentItem{Date: firstSeen.Add(3 * time.Hour), RawDate: "soon"}, firstSeen.Add(3 * time.Hour), false},
+		{documentItem{Date: firstSeen.AddDate(1, 0, 0), RawDate: "next year"}, firstSeen, true},
+	}
+	for _, test := range tests {
+		date, estimated := itemDate(&test.item, firstSeen)
+		if !date.Equal(test.date) || estimated != test.estimated {
+			t.Error("Unexpected date for ", test.item.RawDate, ": ", date, estimated, ", expected ", test.date, test.estimated)
+		}
+	}
+}
+
+func TestParseRawItems(t *testing.T) {
+	body := []byte(`<rss><channel><pubDate>Channel date</pubDate>
+<item><guid>1</guid><updated>Later</updated><pubDate>First</pubDate></item>
+<item><title>No date</title><source><id>Not mine</id></source></item>
+</channel></rss>`)
+	items := parseRawItems(body)
+	if len(items) != 2 {
+		t.Fatal("Unexpected number of items: ", len(items), ", expected 2")
+	}
+	if items[0].ID != "1" || items[0].Date != "First" {
+		t.Error("Unexpected first item: ", items[0])
+	}
+	if items[1].ID != "" || items[1].Date != "" {
+		t.Error("Unexpected second item: ", items[1])
+	}
+}
@@ -0,0 +1,191 @@
+package feed
+
+// This file decides which of an item's fields identify it, for feeds whose
+// GUIDs are missing or keep changing.
+
+import (
+	"strings"
+	"time"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+// The fewest items whose IDs must change between polls, without the items
+// themselves changing, before we stop trusting a feed's IDs.
+const minChurnedItems = 2
+
+// ValidDedupeStrategy says whether strategy is one we know.
+func ValidDedupeStrategy(strategy string) bool {
+	switch strategy {
+	case storage.DedupeAuto, storage.DedupeGUID, storage.DedupeLink,
+		storage.DedupeNormalizedLink, storage.DedupeTitleDate, storage.DedupeContentHash:
+		return true
+	}
+	return false
+}
+
+// SetDedupeStrategy picks how items are told apart. With storage.DedupeAuto,
+// detected (what the feed picked last time, if anything) is used, and the
+// feed may switch away from GUIDs by itself if they churn; switches are
+// reported on GetChanDedupe.
+func (f *Feed) SetDedupeStrategy(strategy, detected string) {
+	auto := strategy == storage.DedupeAuto
+	if auto {
+		strategy = detected
+	}
+	if strategy == storage.DedupeAuto {
+		strategy = storage.DedupeGUID
+	}
+
+	f.dedupeLock.Lock()
+	defer f.dedupeLock.Unlock()
+	if f.dedupe != "" && f.dedupe != strategy {
+		// Everything seen so far was recorded under the old strategy.
+		f.adoptKeys = true
+	}
+	f.dedupe = strategy
+	f.dedupeAuto = auto
+}
+
+// GetChanDedupe returns the pipe on which the feed reports switching its
+// dedupe strategy by itself.
+func (f *Feed) GetChanDedupe() chan string {
+	return f.dedupePipe
+}
+
+// dedupeStrategy returns the strategy to use for the next poll, whether the
+// feed may change it, and whether it just changed.
+func (f *Feed) dedupeStrategy() (strategy string, auto, adopt bool) {
+	f.dedupeLock.Lock()
+	defer f.dedupeLock.Unlock()
+	strategy, auto, adopt = f.dedupe, f.dedupeAuto, f.adoptKeys
+	f.adoptKeys = false
+	if strategy == "" {
+		strategy = storage.DedupeGUID
+	}
+	return
+}
+
+// switchDedupe changes strategy after spotting churning IDs, unless the user
+// picked one in the meantime. Returns false if the feed was ended.
+func (f *Feed) switchDedupe(strategy string) bool {
+	f.dedupeLock.Lock()
+	if !f.dedupeAuto {
+		f.dedupeLock.Unlock()
+		return true
+	}
+	f.dedupe = strategy
+	f.dedupeLock.Unlock()
+
+	select {
+	case f.dedupePipe <- strategy:
+		return true
+	case <-f.ctx.Done():
+		return false
+	}
+}
+
+// titleDate identifies an item by when it says it was published, and as what.
+func titleDate(item *documentItem) string {
+	if item.Title == "" {
+		return ""
+	}
+	if item.Date.IsZero() {
+		return item.Title
+	}
+	return item.Title + "|" + item.Date.UTC().Format(time.RFC3339)
+}
+
+// dedupeKey is what item is recorded under in the feed's history. Items
+// lacking what strategy needs fall back to their ID, then their link, then
+// their content. GUIDs are used as they are, so histories recorded before
+// there were strategies carry on working; the rest are prefixed.
+func dedupeKey(strategy string, item *documentItem) string {
+	switch strategy {
+	case storage.DedupeLink:
+		if item.Link != "" {
+			return "link:" + item.Link
+		}
+	case storage.DedupeNormalizedLink:
+		if item.Link != "" {
+			return "normalized-link:" + storage.CanonicalURL(item.Link)
+		}
+	case storage.DedupeTitleDate:
+		if key := titleDate(item); key != "" {
+			return "title-date:" + key
+		}
+	case storage.DedupeContentHash:
+		return "content-hash:" + strings.TrimPrefix(fingerprint(item), fingerprintPrefix)
+	}
+	if item.ID != "" {
+		return item.ID
+	}
+	if item.Link != "" {
+		return "normalized-link:" + storage.CanonicalURL(item.Link)
+	}
+	return "content-hash:" + strings.TrimPrefix(fingerprint(item), fingerprintPrefix)
+}
+
+// detectChurn compares two consecutive polls. If most of the items have new
+// IDs but are otherwise the ones we saw last time, the IDs can't be trusted,
+// and it returns a strategy which would have recognized them. Otherwise, it
+// returns "".
+func detectChurn(previous, current []*documentItem) string {
+	if len(previous) == 0 {
+		return ""
+	}
+	ids := make(map[string]bool)
+	links := make(map[string]bool)
+	titleDates := make(map[string]bool)
+	for _, item := range previous {
+		ids[item.ID] = true
+		if item.Link != "" {
+			links[storage.CanonicalURL(item.Link)] = true
+		}
+		if key := titleDate(item); key != "" {
+			titleDates[key] = true
+		}
+	}
+
+	churned := 0
+	for _, item := range current {
+		if ids[item.ID] {
+			continue
+		}
+		if (item.Link != "" && links[storage.CanonicalURL(item.Link)]) || titleDates[titleDate(item)] {
+			churned++
+		}
+	}
+	if churned < minChurnedItems || churned*2 < len(current) {
+		return ""
+	}
+
+	// Prefer whichever tells every item apart.
+	if distinct(current, func(item *documentItem) string { return item.Link }, storage.CanonicalURL) {
+		return storage.DedupeNormalizedLink
+	}
+	if distinct(current, titleDate, nil) {
+		return storage.DedupeTitleDate
+	}
+	return storage.DedupeContentHash
+}
+
+// distinct says whether field is present, and unique once normalized, for
+// every item.
+func distinct(items []*documentItem, field func(*documentItem) string, normalize func(string) string) bool {
+	seen := make(map[string]bool)
+	for _, item := range items {
+		value := field(item)
+		if value == "" {
+			return false
+		}
+		if normalize != nil {
+			value = normalize(value)
+		}
+		if seen[value] {
+			return false
+		}
+		seen[value] = true
+	}
+	return true
+}
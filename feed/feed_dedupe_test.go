@@ -0,0 +1,50 @@
+package feed
+
+import (
+	"testing"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+func TestDedupeKeyFallsBack(t *testing.T) {
+	noID := &documentItem{Title: "Untitled", Link: "https://example.com/a?utm_campaign=x"}
+	if key := dedupeKey(storage.DedupeGUID, noID); key != "normalized-link:example.com/a" {
+		t.Error("Unexpected key for an item without an ID: ", key)
+	}
+	noLink := &documentItem{ID: "tag:example.com,2016:1"}
+	if key := dedupeKey(storage.DedupeNormalizedLink, noLink); key != noLink.ID {
+		t.Error("Unexpected key for an item without a link: ", key)
+	}
+	if key := dedupeKey(storage.DedupeTitleDate, noID); key != "title-date:Untitled" {
+		t.Error("Unexpected title-date key: ", key)
+	}
+}
+
+func TestDetectChurn(t *testing.T) {
+	poll := func(idPrefix string, links ...string) []*documentItem {
+		items := make([]*documentItem, len(links))
+		for i, link := range links {
+			items[i] = &documentItem{ID: idPrefix + link, Title: "Story " + link, Link: "https://example.com/" + link}
+		}
+		return items
+	}
+
+	previous := poll("first-", "a", "b", "c")
+	if strategy := detectChurn(previous, poll("first-", "a", "b", "c", "d")); strategy != "" {
+		t.Error("Stable IDs were reported as churning: ", strategy)
+	}
+	if strategy := detectChurn(previous, poll("second-", "a", "b", "c")); strategy != storage.DedupeNormalizedLink {
+		t.Error("Unexpected strategy for churning IDs: ", strategy, ", expected ", storage.DedupeNormalizedLink)
+	}
+	// Every item links to the same page, so only the titles tell them apart.
+	sharedLink := func(idPrefix string) []*documentItem {
+		items := poll(idPrefix, "x", "x", "x")
+		for i, item := range items {
+			item.Title += string(rune('1' + i))
+		}
+		return items
+	}
+	if strategy := detectChurn(sharedLink("third-"), sharedLink("fourth-")); strategy != storage.DedupeTitleDate {
+		t.Error("Unexpected strategy when links repeat: ", strategy, ", expected ", storage.DedupeTitleDate)
+	}
+}
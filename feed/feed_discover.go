@@ -0,0 +1,147 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Candidate is a feed found while looking around a website.
+type Candidate struct {
+	URL   string
+	Title string
+}
+
+// feedLinkTypes are the <link type="..."> values which point at feeds.
+var feedLinkTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+}
+
+// commonFeedPaths are tried when a page doesn't advertise any feeds.
+var commonFeedPaths = []string{
+	"/feed",
+	"/rss.xml",
+	"/feed.xml",
+	"/atom.xml",
+	"/index.xml",
+	"/rss",
+	"/feed.json",
+}
+
+var linkTagRegexp = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+var attributeRegexp = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// discoveryTimeout bounds looking around a site as a whole, which can take
+// several fetches.
+const discoveryTimeout = time.Minute
+
+// Discoverer looks for feeds, fetching within the same limits as a feed.
+type Discoverer struct {
+	// Fetcher sends discovery's requests; if nil, http.DefaultClient is used.
+	Fetcher Fetcher
+	Limits  FetchLimits
+}
+
+// Discover works out which feeds URL refers to. If URL is a feed itself, it
+// is the only candidate. If it is a web page, the feeds it advertises with
+// <link rel="alternate"> are returned, or failing that, any feeds found at
+// the usual places on the same site. It gives up once ctx is done.
+func (d *Discoverer) Discover(ctx context.Context, URL string) ([]Candidate, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+	// Borrowed for its fetching, and never started.
+	f := &Feed{Fetcher: d.Fetcher, Limits: d.Limits, ctx: ctx}
+
+	body, contentType, err := f.discoveryGet(URL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(contentType, "html") && isFeedDocument(contentType, body) {
+		return []Candidate{{URL: URL}}, nil
+	}
+
+	base, err := url.Parse(URL)
+	if err != nil {
+		return nil, err
+	}
+	candidates := findFeedLinks(base, string(body))
+	if len(candidates) == 0 {
+		for _, p := range commonFeedPaths {
+			guess := base.ResolveReference(&url.URL{Path: p}).String()
+			if body, contentType, err := f.discoveryGet(guess); err == nil && isFeedDocument(contentType, body) {
+				candidates = append(candidates, Candidate{URL: guess})
+			}
+			if ctx.Err() != nil {
+				return nil, errors.New("Looking for feeds at " + URL + " took too long")
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("No feed found at " + URL)
+	}
+	return candidates, nil
+}
+
+func (f *Feed) discoveryGet(URL string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", URL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	fetch, err := startFetch(f.ctx, f.fetcher(), req, f.limits())
+	if err != nil {
+		return nil, "", err
+	}
+	defer fetch.close()
+	resp := fetch.resp
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		return nil, "", &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	body, err := fetch.body()
+	return body, resp.Header.Get("Content-Type"), err
+}
+
+// isFeedDocument reports whether body is something we know how to read.
+func isFeedDocument(contentType string, body []byte) bool {
+	_, err := parseDocument(contentType, body)
+	return err == nil
+}
+
+// findFeedLinks pulls the advertised feeds out of an HTML page, resolving
+// them against the page's URL.
+func findFeedLinks(base *url.URL, page string) []Candidate {
+	var candidates []Candidate
+	seen := make(map[string]bool)
+	for _, tag := range linkTagRegexp.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range attributeRegexp.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3] + m[4])
+		}
+
+		isAlternate := false
+		for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+			isAlternate = isAlternate || rel == "alternate"
+		}
+		linkType := strings.ToLower(strings.TrimSpace(attrs["type"]))
+		if !isAlternate || !feedLinkTypes[linkType] || attrs["href"] == "" {
+			continue
+		}
+
+		href, err := url.Parse(strings.TrimSpace(attrs["href"]))
+		if err != nil {
+			continue
+		}
+		feedURL := base.ResolveReference(href).String()
+		if !seen[feedURL] {
+			seen[feedURL] = true
+			candidates = append(candidates, Candidate{URL: feedURL, Title: attrs["title"]})
+		}
+	}
+	return candidates
+}
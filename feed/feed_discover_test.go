@@ -0,0 +1,96 @@
+package feed
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const discoveryPage = `<!DOCTYPE html>
+<html><head>
+	<title>A blog</title>
+	<link rel="stylesheet" href="/style.css">
+	<link rel="alternate" type="application/rss+xml" title="Posts &amp; news" href="/feed.xml">
+	<LINK REL='alternate' TYPE='application/atom+xml' HREF='https://example.com/atom'>
+	<link rel="alternate" type="text/html" hreflang="fr" href="/fr/">
+	<link type="application/feed+json" rel="alternate home" href="feed.json" />
+	<link rel="alternate" type="application/rss+xml" href="/feed.xml">
+</head><body></body></html>`
+
+func TestFindFeedLinks(t *testing.T) {
+	base, _ := url.Parse("http://example.com/blog/")
+	candidates := findFeedLinks(base, discoveryPage)
+	expected := []Candidate{
+		{URL: "http://example.com/feed.xml", Title: "Posts & news"},
+		{URL: "https://example.com/atom"},
+		{URL: "http://example.com/blog/feed.json"},
+	}
+	if len(candidates) != len(expected) {
+		t.Fatal("Unexpected candidates: ", candidates)
+	}
+	for i := range candidates {
+		if candidates[i] != expected[i] {
+			t.Error("Unexpected candidate: ", candidates[i], ", expected ", expected[i])
+		}
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	hn := readFixture(t, "hn_rss.txt")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<link rel="alternate" type="application/rss+xml" href="/posts.xml">`))
+	})
+	mux.HandleFunc("/posts.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Write([]byte(hn))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	d := &Discoverer{Fetcher: server.Client()}
+
+	candidates, err := d.Discover(context.Background(), server.URL+"/")
+	if err != nil || len(candidates) != 1 || candidates[0].URL != server.URL+"/posts.xml" {
+		t.Error("Unexpected candidates for a page: ", candidates, ", ", err)
+	}
+	candidates, err = d.Discover(context.Background(), server.URL+"/posts.xml")
+	if err != nil || len(candidates) != 1 || candidates[0].URL != server.URL+"/posts.xml" {
+		t.Error("Unexpected candidates for a feed: ", candidates, ", ", err)
+	}
+}
+
+func TestDiscoverWithinLimits(t *testing.T) {
+	release := make(chan bool)
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer stalled.Close()
+	defer close(release)
+	d := &Discoverer{Fetcher: stalled.Client(), Limits: FetchLimits{ReadTimeout: 50 * time.Millisecond}}
+
+	start := time.Now()
+	_, err := d.Discover(context.Background(), stalled.URL)
+	if kind, ok := limitKindOf(err); !ok || kind != limitReadTimeout {
+		t.Error("Unexpected error: ", err, ", expected a read timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("Unexpected wait for a stalled server: ", elapsed)
+	}
+
+	huge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("<p>", 1000)))
+	}))
+	defer huge.Close()
+	d = &Discoverer{Fetcher: huge.Client(), Limits: FetchLimits{MaxBodySize: 100}}
+	_, err = d.Discover(context.Background(), huge.URL)
+	if kind, ok := limitKindOf(err); !ok || kind != limitBodySize {
+		t.Error("Unexpected error: ", err, ", expected a size limit")
+	}
+}
@@ -0,0 +1,140 @@
+package feed
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+// fetchResult is everything we learned from a single poll of a feed.
+type fetchResult struct {
+	// The parsed feed, or nil if the server said it was not modified.
+	doc *document
+	// The raw bytes behind doc.
+	body []byte
+	// The validators to send on the next poll.
+	validators storage.SavedValidators
+	// When the server says the response goes stale (zero if unknown).
+	cacheExpiry time.Time
+	statusCode  int
+	// Where the feed has permanently moved to, if it has.
+	movedTo     string
+	contentType string
+}
+
+// fetchConditionally retrieves the feed, passing along any cache validators
+// we already have for it.
+//
+// If the server answers "304 Not Modified", the returned feed is nil and the
+// body is never parsed. Otherwise, the returned validators are the ones sent
+// with the new document.
+func (f *Feed) fetchConditionally(validators storage.SavedValidators) (*fetchResult, error) {
+	req, err := http.NewRequest("GET", f.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.applyRequestSettings(req); err != nil {
+		return nil, err
+	}
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+
+	fetcher := keepingCredentials(f.fetcher(), f.credentialHeaders())
+	fetch, err := startFetch(f.ctx, fetcher, req, f.limits())
+	if err != nil {
+		return nil, err
+	}
+	defer fetch.close()
+	resp := fetch.resp
+
+	result := &fetchResult{
+		validators:  validators,
+		cacheExpiry: parseCacheExpiry(resp.Header, f.clock().Now()),
+		statusCode:  resp.StatusCode,
+		contentType: resp.Header.Get("Content-Type"),
+	}
+	if movedTo := permanentlyMovedTo(resp); movedTo != f.URL {
+		result.movedTo = movedTo
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return result, nil
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, &authError{&httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}}
+	}
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		return nil, &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	result.body, err = fetch.body()
+	if err != nil {
+		return nil, err
+	}
+	result.doc, err = parseDocument(result.contentType, result.body)
+	if _, ok := err.(*limitError); ok {
+		return nil, err
+	} else if err != nil {
+		return nil, &parseError{err}
+	}
+
+	result.validators.ETag = resp.Header.Get("ETag")
+	result.validators.LastModified = resp.Header.Get("Last-Modified")
+	return result, nil
+}
+
+// boundedFetch is a request in flight, within FetchLimits.
+type boundedFetch struct {
+	resp    *http.Response
+	limits  FetchLimits
+	stalled *watchdog
+	cancel  context.CancelFunc
+}
+
+// startFetch sends req through fetcher, giving up if connecting or the
+// server stalls, or once ctx is done. The response's body is for body to
+// read; close must be called either way.
+func startFetch(ctx context.Context, fetcher Fetcher, req *http.Request, limits FetchLimits) (*boundedFetch, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stalled := &watchdog{cancel: cancel}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, stalled.trace(limits)))
+	// Asking explicitly means we decompress explicitly, under our limits.
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+	stalled.arm(limits.ConnectTimeout, &limitError{kind: limitConnectTimeout, detail: limits.ConnectTimeout.String()})
+	resp, err := fetcher.Do(req)
+	if err != nil {
+		stalled.stop()
+		cancel()
+		return nil, stalled.explain(err)
+	}
+	return &boundedFetch{resp: resp, limits: limits, stalled: stalled, cancel: cancel}, nil
+}
+
+// body reads the response's body, decompressed, failing if it's too large.
+func (b *boundedFetch) body() ([]byte, error) {
+	readTimeout := &limitError{kind: limitReadTimeout, detail: b.limits.ReadTimeout.String()}
+	decoded, err := decodeBody(b.resp.Header.Get("Content-Encoding"),
+		&watchedReader{r: b.resp.Body, w: b.stalled, timeout: b.limits.ReadTimeout, deadline: readTimeout})
+	if err != nil {
+		return nil, b.stalled.explain(err)
+	}
+	body, err := readLimited(decoded, b.limits.MaxBodySize)
+	if err != nil {
+		return nil, b.stalled.explain(err)
+	}
+	b.stalled.stop()
+	return body, nil
+}
+
+func (b *boundedFetch) close() {
+	b.stalled.stop()
+	b.resp.Body.Close()
+	b.cancel()
+}
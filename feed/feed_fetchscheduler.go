@@ -0,0 +1,234 @@
+package feed
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Used by feeds which aren't given a FetchScheduler of their own.
+const (
+	defaultMaxConcurrentFetches = 8
+	defaultMaxFetchesPerHost    = 2
+	defaultStartupJitter        = time.Minute
+)
+
+// FetchScheduler decides when feeds may fetch. Rather than each feed keeping
+// its own timer, feeds wait here for their turn, which comes once they're due
+// and there's room: no more than maxConcurrent fetches at once, and no more
+// than maxPerHost against any one server. Among feeds that could go, the one
+// that has been due longest goes first.
+type FetchScheduler struct {
+	maxConcurrent int
+	maxPerHost    int
+	startupJitter time.Duration
+	clock         Clock
+	// The dispatch goroutine stops once this is done.
+	ctx context.Context
+
+	// INCOMING (to the dispatch goroutine)
+	turnRequest    chan *fetchTurn
+	cancelRequest  chan *fetchTurn
+	releaseRequest chan string /* Host */
+}
+
+// MakeFetchScheduler starts a scheduler, which runs until ctx is done. Feeds'
+// first polls after starting are spread over up to startupJitter, so feeds
+// started together don't keep polling together. If clock is nil, the wall
+// clock is used; feeds using the scheduler must use the same clock.
+func MakeFetchScheduler(ctx context.Context, maxConcurrent, maxPerHost int, startupJitter time.Duration, clock Clock) *FetchScheduler {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	if maxPerHost < 1 {
+		maxPerHost = 1
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	s := &FetchScheduler{
+		maxConcurrent:  maxConcurrent,
+		maxPerHost:     maxPerHost,
+		startupJitter:  startupJitter,
+		clock:          clock,
+		ctx:            ctx,
+		turnRequest:    make(chan *fetchTurn),
+		cancelRequest:  make(chan *fetchTurn),
+		releaseRequest: make(chan string),
+	}
+	go s.dispatch()
+	return s
+}
+
+var defaultFetchScheduler *FetchScheduler
+var defaultFetchSchedulerOnce sync.Once
+
+func (f *Feed) fetchScheduler() *FetchScheduler {
+	if f.FetchScheduler == nil {
+		defaultFetchSchedulerOnce.Do(func() {
+			defaultFetchScheduler = MakeFetchScheduler(context.Background(), defaultMaxConcurrentFetches,
+				defaultMaxFetchesPerHost, defaultStartupJitter, nil)
+		})
+		return defaultFetchScheduler
+	}
+	return f.FetchScheduler
+}
+
+// hostOf is what politeness limits are counted against.
+func hostOf(URL string) string {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return URL
+	}
+	return strings.ToLower(u.Host)
+}
+
+// jitter picks how much to delay a feed's first scheduled poll.
+func (s *FetchScheduler) jitter() time.Duration {
+	if s.startupJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(s.startupJitter)))
+}
+
+// acquire waits until due, and until there is room to fetch from host.
+// Returns true once the caller may fetch; it must call release when done.
+// Returns false, without a turn, if ctx (or the scheduler) ends or interrupt
+// fires first.
+func (s *FetchScheduler) acquire(ctx context.Context, host string, due time.Time, interrupt <-chan bool) bool {
+	turn := &fetchTurn{host: host, due: due, granted: make(chan bool, 1)}
+	select {
+	case s.turnRequest <- turn:
+	case <-ctx.Done():
+		return false
+	case <-s.ctx.Done():
+		return false
+	}
+	select {
+	case <-turn.granted:
+		return true
+	case <-interrupt:
+	case <-ctx.Done():
+	case <-s.ctx.Done():
+		return false
+	}
+	// If the turn was granted in the meantime, this gives it back.
+	select {
+	case s.cancelRequest <- turn:
+	case <-s.ctx.Done():
+	}
+	return false
+}
+
+// release ends a fetch started by acquire.
+func (s *FetchScheduler) release(host string) {
+	select {
+	case s.releaseRequest <- host:
+	case <-s.ctx.Done():
+		// Nobody is counting any more.
+	}
+}
+
+// dispatch owns the queue of waiting feeds, and the single timer they share.
+func (s *FetchScheduler) dispatch() {
+	var waiting turnQueue
+	inFlight := 0
+	perHost := make(map[string]int)
+	var timer <-chan time.Time
+	var timerDue time.Time
+
+	finished := func(host string) {
+		inFlight--
+		if perHost[host]--; perHost[host] <= 0 {
+			delete(perHost, host)
+		}
+	}
+
+	for {
+		// Grant every turn which is due and has room, earliest first, and
+		// find the earliest one that will be able to go once it's due.
+		now := s.clock.Now()
+		var next *fetchTurn
+		var skipped []*fetchTurn
+		for len(waiting) > 0 && inFlight < s.maxConcurrent {
+			turn := heap.Pop(&waiting).(*fetchTurn)
+			skipped = append(skipped, turn)
+			if perHost[turn.host] >= s.maxPerHost {
+				continue
+			}
+			if turn.due.After(now) {
+				next = turn
+				break
+			}
+			skipped = skipped[:len(skipped)-1]
+			inFlight++
+			perHost[turn.host]++
+			turn.granted <- true
+		}
+		for _, turn := range skipped {
+			heap.Push(&waiting, turn)
+		}
+
+		// Only ask the clock again if the next deadline moved.
+		if next == nil {
+			timer, timerDue = nil, time.Time{}
+		} else if !next.due.Equal(timerDue) {
+			timer, timerDue = s.clock.After(next.due.Sub(now)), next.due
+		}
+
+		select {
+		case turn := <-s.turnRequest:
+			heap.Push(&waiting, turn)
+		case turn := <-s.cancelRequest:
+			if turn.index >= 0 {
+				heap.Remove(&waiting, turn.index)
+			} else {
+				// Granted, but never used.
+				finished(turn.host)
+			}
+		case host := <-s.releaseRequest:
+			finished(host)
+		case <-timer:
+			timer, timerDue = nil, time.Time{}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchTurn is a feed waiting to fetch.
+type fetchTurn struct {
+	host    string
+	due     time.Time
+	granted chan bool
+	// Position in the turnQueue, or -1 once out of it.
+	index int
+}
+
+// turnQueue is a heap of fetchTurns, earliest due first.
+type turnQueue []*fetchTurn
+
+func (q turnQueue) Len() int           { return len(q) }
+func (q turnQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q turnQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *turnQueue) Push(x interface{}) {
+	turn := x.(*fetchTurn)
+	turn.index = len(*q)
+	*q = append(*q, turn)
+}
+func (q *turnQueue) Pop() interface{} {
+	old := *q
+	turn := old[len(old)-1]
+	old[len(old)-1] = nil
+	turn.index = -1
+	*q = old[:len(old)-1]
+	return turn
+}
@@ -0,0 +1,141 @@
+package feed
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// queueTurn hands a turn straight to the dispatcher. Once it returns, the
+// dispatcher has queued it.
+func queueTurn(s *FetchScheduler, host string, due time.Time) *fetchTurn {
+	turn := &fetchTurn{host: host, due: due, granted: make(chan bool, 1)}
+	s.turnRequest <- turn
+	return turn
+}
+
+func expectGranted(t *testing.T, turn *fetchTurn) {
+	select {
+	case <-turn.granted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Turn for ", turn.host, " was never granted")
+	}
+}
+
+func expectWaiting(t *testing.T, turn *fetchTurn) {
+	if len(turn.granted) != 0 {
+		t.Error("Turn for ", turn.host, " was granted early")
+	}
+}
+
+func TestFetchSchedulerOrdersByDueTime(t *testing.T) {
+	clock := newFakeClock()
+	s := MakeFetchScheduler(context.Background(), 1, 10, 0, clock)
+	now := clock.Now()
+
+	blocker := queueTurn(s, "blocker", now)
+	expectGranted(t, blocker)
+
+	later := queueTurn(s, "later", now.Add(2*time.Minute))
+	sooner := queueTurn(s, "sooner", now.Add(time.Minute))
+	overdue := queueTurn(s, "overdue", now.Add(-time.Minute))
+	clock.Advance(5 * time.Minute)
+
+	for _, turn := range []*fetchTurn{overdue, sooner, later} {
+		s.release(blocker.host)
+		expectGranted(t, turn)
+		blocker = turn
+	}
+}
+
+func TestFetchSchedulerPerHostLimit(t *testing.T) {
+	clock := newFakeClock()
+	s := MakeFetchScheduler(context.Background(), 4, 1, 0, clock)
+	now := clock.Now()
+
+	first := queueTurn(s, "reddit.com", now)
+	second := queueTurn(s, "reddit.com", now)
+	other := queueTurn(s, "lwn.net", now)
+	expectGranted(t, first)
+	expectGranted(t, other)
+	// Queued before "other", so already passed over.
+	expectWaiting(t, second)
+
+	s.release("reddit.com")
+	expectGranted(t, second)
+}
+
+func TestFetchSchedulerWaitsUntilDue(t *testing.T) {
+	clock := newFakeClock()
+	s := MakeFetchScheduler(context.Background(), 1, 1, 0, clock)
+
+	turn := queueTurn(s, "example.org", clock.Now().Add(time.Minute))
+	select {
+	case d := <-clock.waiting:
+		if d != time.Minute {
+			t.Error("Unexpected wait: ", d, ", expected ", time.Minute)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scheduler never started waiting")
+	}
+	expectWaiting(t, turn)
+
+	clock.Advance(time.Minute)
+	expectGranted(t, turn)
+}
+
+func TestFetchSchedulerInterrupt(t *testing.T) {
+	clock := newFakeClock()
+	s := MakeFetchScheduler(context.Background(), 1, 1, 0, clock)
+	now := clock.Now()
+
+	blocker := queueTurn(s, "example.org", now)
+	expectGranted(t, blocker)
+
+	interrupt := make(chan bool)
+	acquired := make(chan bool)
+	go func() {
+		acquired <- s.acquire(context.Background(), "example.org", now, interrupt)
+	}()
+	interrupt <- true
+	if <-acquired {
+		t.Error("An interrupted acquire should not get a turn")
+	}
+
+	// The abandoned turn doesn't hold up anyone else.
+	s.release("example.org")
+	expectGranted(t, queueTurn(s, "example.org", now))
+}
+
+func TestFetchSchedulerStopsWithContext(t *testing.T) {
+	clock := newFakeClock()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := MakeFetchScheduler(ctx, 1, 1, 0, clock)
+
+	blocker := queueTurn(s, "example.org", clock.Now())
+	expectGranted(t, blocker)
+	cancel()
+
+	// Nothing blocks on a scheduler which has stopped.
+	done := make(chan bool)
+	go func() {
+		s.release(blocker.host)
+		if s.acquire(context.Background(), "example.org", clock.Now(), nil) {
+			t.Error("Unexpected turn from a stopped scheduler")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stopped scheduler blocked its callers")
+	}
+
+	// Once the dispatcher has noticed, it takes no more turns.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case s.turnRequest <- &fetchTurn{host: "example.org", due: clock.Now(), granted: make(chan bool, 1)}:
+		t.Error("Scheduler is still dispatching after its context was cancelled")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -1,20 +1,112 @@
 package feed
 
-import "github.com/smklein/toy-rss/storage"
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/smklein/toy-rss/storage"
+)
 
 // Feed implements the FeedInterface.
 type Feed struct {
-	itemPipe    chan *storage.RssEntry
-	Title       string
-	URL         string
-	initialized bool
-	disabled    bool
+	itemPipe chan *storage.RssEntry
+	// Where the feed is polled from. Once started, only doFeed changes it
+	// (when the feed moves), under stateLock; others use GetURL.
+	URL       string
+	movedPipe chan FeedMove
+	// A move we didn't follow, so it's only reported once. Only doFeed
+	// touches it.
+	declinedMove string
+
+	// Optional; may be set before Start to replace the network and the wall
+	// clock (handy for tests). If nil, the real ones are used.
+	Fetcher Fetcher
+	Clock   Clock
+	// Optional; zero fields are given their defaults.
+	Limits FetchLimits
+	// Optional; decides when the feed may fetch, alongside other feeds. If
+	// nil, a shared default is used. It must use the same clock as the feed.
+	FetchScheduler *FetchScheduler
+	// Optional; delays even the first poll by the fetch scheduler's startup
+	// jitter, for feeds nobody is waiting on (like those restored when the
+	// reader starts). Start takes as long.
+	SpreadFirstPoll bool
+	// The server FetchScheduler counts our fetches against.
+	host string
+
+	// Cancelled by End, or along with the context given to Start. Closing
+	// "done" signals that doFeed has returned.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan bool
+
+	// Whether the feed is working, and if not, why.
+	state     FeedState
+	lastErr   error
+	stateLock sync.RWMutex
+	errorPipe chan *FeedError
+
+	// Guarded by stateLock, like everything else doFeed changes while others
+	// read it.
+	title string
+	// What the feed says about itself, also guarded by stateLock.
+	metadata     storage.ChannelMetadata
+	metadataPipe chan storage.ChannelMetadata
+	// How polling has been going, also guarded by stateLock.
+	health storage.FeedHealth
+
+	// Credentials and headers to send with each request.
+	requestSettings storage.RequestSettings
+	requestLock     sync.RWMutex
+
+	// Decides how long to wait between polls.
+	scheduler         pollScheduler
+	scheduleLock      sync.Mutex
+	rescheduleRequest chan bool
+	// Set by Refresh; the next poll happens right away. Guarded by
+	// scheduleLock.
+	refreshNow bool
+
+	// How items are told apart; see SetDedupeStrategy.
+	dedupe     string
+	dedupeAuto bool
+	// Set when dedupe changes, so the next poll knows the history was
+	// recorded under another strategy.
+	adoptKeys  bool
+	dedupeLock sync.Mutex
+	dedupePipe chan string
 }
 
 // FeedInterface decouples the "RSS/Atom" interface from our implementation.
 type FeedInterface interface {
 	// The channel returned from "Start" will never return duplicate entries.
-	Start(URL string) (chan *storage.RssEntry, error)
+	// The feed stops once ctx is cancelled, closing the channel.
+	Start(ctx context.Context, URL string) (chan *storage.RssEntry, error)
 	GetTitle() string
+	GetState() (FeedState, error)
+	GetHealth() storage.FeedHealth
+	// Failed polls are reported here once the feed has started.
+	GetChanErrors() chan *FeedError
+	GetMetadata() storage.ChannelMetadata
+	// Changes to the feed's metadata are sent here once the feed has started.
+	GetChanMetadata() chan storage.ChannelMetadata
+	// Zero means "pick an interval automatically".
+	SetRefreshInterval(interval time.Duration)
+	SetRequestSettings(settings storage.RequestSettings)
+	// strategy is one of the storage.Dedupe* strategies; detected is what
+	// the feed picked by itself last time, for storage.DedupeAuto.
+	SetDedupeStrategy(strategy, detected string)
+	// Strategies the feed switches to by itself are sent here once the feed
+	// has started.
+	GetChanDedupe() chan string
+	// Where the feed is polled from, which changes if it moves for good.
+	GetURL() string
+	// Permanent redirects are reported here once the feed has started;
+	// temporary ones aren't.
+	GetChanMoved() chan FeedMove
+	// Polls again as soon as the fetch scheduler allows.
+	Refresh()
+	// Blocks until the feed has stopped.
 	End()
 }
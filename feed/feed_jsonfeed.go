@@ -0,0 +1,129 @@
+package feed
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+// jsonFeedVersionPrefix starts the "version" of every JSON Feed (1.0 or 1.1).
+const jsonFeedVersionPrefix = "https://jsonfeed.org/version/"
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	SizeInBytes int64  `json:"size_in_bytes"`
+}
+
+type jsonFeedItem struct {
+	// Strings in the spec, but some 1.0 feeds publish numbers.
+	ID            interface{}          `json:"id"`
+	URL           string               `json:"url"`
+	Title         string               `json:"title"`
+	ContentHTML   string               `json:"content_html"`
+	ContentText   string               `json:"content_text"`
+	Summary       string               `json:"summary"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified"`
+	Author        *jsonFeedAuthor      `json:"author"`  /* 1.0 */
+	Authors       []jsonFeedAuthor     `json:"authors"` /* 1.1 */
+	Attachments   []jsonFeedAttachment `json:"attachments"`
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	Description string         `json:"description"`
+	Icon        string         `json:"icon"`
+	Favicon     string         `json:"favicon"`
+	Language    string         `json:"language"` /* 1.1 */
+	Items       []jsonFeedItem `json:"items"`
+}
+
+// parseJSONFeed handles JSON Feed (https://jsonfeed.org) 1.0 and 1.1.
+func parseJSONFeed(body []byte) (*document, error) {
+	var jf jsonFeed
+	if err := json.Unmarshal(body, &jf); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(jf.Version, jsonFeedVersionPrefix) {
+		return nil, errors.New("Not a JSON Feed: unknown version \"" + jf.Version + "\"")
+	}
+
+	doc := &document{
+		Title: jf.Title,
+		Metadata: storage.ChannelMetadata{
+			Description: jf.Description,
+			SiteLink:    jf.HomePageURL,
+			ImageURL:    jf.Icon,
+			Language:    jf.Language,
+		},
+		Items: make([]*documentItem, 0, len(jf.Items)),
+	}
+	if doc.Metadata.ImageURL == "" {
+		doc.Metadata.ImageURL = jf.Favicon
+	}
+	for _, item := range jf.Items {
+		newItem := &documentItem{
+			Title:   item.Title,
+			Summary: item.Summary,
+			Content: item.ContentHTML,
+			Link:    item.URL,
+		}
+
+		switch id := item.ID.(type) {
+		case string:
+			newItem.ID = id
+		case float64:
+			newItem.ID = strconv.FormatFloat(id, 'f', -1, 64)
+		}
+		if newItem.ID == "" {
+			newItem.ID = item.URL
+		}
+
+		if newItem.Content == "" {
+			newItem.Content = item.ContentText
+		}
+
+		date := item.DatePublished
+		if date == "" {
+			date = item.DateModified
+		}
+		newItem.RawDate = date
+		if t, err := time.Parse(time.RFC3339, date); err == nil {
+			newItem.Date = t
+			// JSON Feed has no feed-level date; the newest item will do.
+			if t.After(doc.Metadata.LastUpdated) {
+				doc.Metadata.LastUpdated = t
+			}
+		}
+
+		authors := item.Authors
+		if len(authors) == 0 && item.Author != nil {
+			authors = []jsonFeedAuthor{*item.Author}
+		}
+		names := make([]string, 0, len(authors))
+		for _, a := range authors {
+			if a.Name != "" {
+				names = append(names, a.Name)
+			}
+		}
+		newItem.Author = strings.Join(names, ", ")
+
+		for _, a := range item.Attachments {
+			newItem.addEnclosure(storage.Enclosure{URL: a.URL, Type: a.MimeType, Length: a.SizeInBytes})
+		}
+
+		doc.Items = append(doc.Items, newItem)
+	}
+	return doc, nil
+}
@@ -0,0 +1,53 @@
+package feed
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestParseJSONFeed(t *testing.T) {
+	body, err := ioutil.ReadFile("../test_server/test_files/json_feed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Detected by its body, even without a helpful Content-Type.
+	doc, err := parseDocument("text/plain", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Title != "JSON Feed Example" || len(doc.Items) != 3 {
+		t.Fatal("Unexpected document: ", doc.Title, len(doc.Items))
+	}
+
+	second := doc.Items[0]
+	if second.ID != "2" || second.Content != "This is a second item." || second.Author != "Alice, Bob" {
+		t.Error("Unexpected item: ", *second)
+	}
+	if e := time.Date(2016, time.May, 31, 2, 0, 0, 0, time.UTC); !second.Date.Equal(e) {
+		t.Error("Unexpected date: ", second.Date, ", expected ", e)
+	}
+
+	first := doc.Items[1]
+	if first.ID != "1" || first.Content != "<p>Hello, world!</p>" || first.Summary != "Hello" || first.Author != "Carol" {
+		t.Error("Unexpected item: ", *first)
+	}
+	if e := time.Date(2016, time.May, 29, 8, 30, 0, 0, time.UTC); !first.Date.Equal(e) {
+		t.Error("Unexpected date: ", first.Date, ", expected ", e)
+	}
+
+	if len(first.Enclosures) != 1 || first.Enclosures[0].URL != "https://example.org/hello.mp3" ||
+		first.Enclosures[0].Type != "audio/mpeg" || first.Enclosures[0].Length != 1024 {
+		t.Error("Unexpected attachments: ", first.Enclosures)
+	}
+
+	if noID := doc.Items[2]; noID.ID != "https://example.org/no-id" {
+		t.Error("Items without an id should fall back to their URL, got ", noID.ID)
+	}
+}
+
+func TestParseJSONFeedRejectsOtherJSON(t *testing.T) {
+	if _, err := parseDocument("application/json", []byte(`{"version": "2", "items": []}`)); err == nil {
+		t.Error("Expected an error for JSON which isn't a JSON Feed")
+	}
+}
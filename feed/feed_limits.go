@@ -0,0 +1,233 @@
+package feed
+
+// This file keeps a misbehaving server from hanging a feed, or exhausting
+// memory: stalled requests time out, bodies are capped (after decompression,
+// too), and XML is checked for entity declarations and absurd nesting before
+// anyone parses it.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Used for any FetchLimits left at zero.
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultReadTimeout    = 30 * time.Second
+	DefaultMaxBodySize    = 10 << 20
+)
+
+// How deeply elements may nest in a feed. Real feeds need a handful of
+// levels; content is escaped HTML, which doesn't count.
+const maxXMLDepth = 64
+
+// FetchLimits bound each request a feed makes.
+type FetchLimits struct {
+	// How long to wait for a connection to the server.
+	ConnectTimeout time.Duration
+	// How long to wait for the server to say anything more, once connected.
+	ReadTimeout time.Duration
+	// The largest document we'll take, in bytes, once decompressed.
+	MaxBodySize int64
+}
+
+func (f *Feed) limits() FetchLimits {
+	limits := f.Limits
+	if limits.ConnectTimeout <= 0 {
+		limits.ConnectTimeout = DefaultConnectTimeout
+	}
+	if limits.ReadTimeout <= 0 {
+		limits.ReadTimeout = DefaultReadTimeout
+	}
+	if limits.MaxBodySize <= 0 {
+		limits.MaxBodySize = DefaultMaxBodySize
+	}
+	return limits
+}
+
+// limitKind says which limit a feed broke.
+type limitKind uint8
+
+const (
+	limitConnectTimeout limitKind = iota
+	limitReadTimeout
+	limitBodySize
+	limitEncoding
+	limitEntities
+	limitDepth
+)
+
+// limitError is returned when a feed breaks one of our limits.
+type limitError struct {
+	kind   limitKind
+	detail string
+}
+
+func (e *limitError) Error() string {
+	switch e.kind {
+	case limitConnectTimeout:
+		return "Connecting timed out after " + e.detail
+	case limitReadTimeout:
+		return "Server stopped responding for " + e.detail
+	case limitBodySize:
+		return "Feed is larger than " + e.detail
+	case limitEncoding:
+		return "Unsupported Content-Encoding: " + e.detail
+	case limitEntities:
+		return "Feed declares XML entities, which aren't allowed"
+	case limitDepth:
+		return "Feed nests XML deeper than " + e.detail + " levels"
+	default:
+		return "Feed exceeded a limit: " + e.detail
+	}
+}
+
+func (e *limitError) timeout() bool {
+	return e.kind == limitConnectTimeout || e.kind == limitReadTimeout
+}
+
+// watchdog cancels a request which stalls, remembering why.
+type watchdog struct {
+	lock   sync.Mutex
+	timer  *time.Timer
+	cause  *limitError
+	cancel func()
+}
+
+// arm (re)starts the countdown; if it runs out, the request is cancelled
+// with cause.
+func (w *watchdog) arm(d time.Duration, cause *limitError) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timer = time.AfterFunc(d, func() {
+		w.lock.Lock()
+		w.cause = cause
+		w.lock.Unlock()
+		w.cancel()
+	})
+}
+
+func (w *watchdog) stop() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// explain replaces err with why the watchdog fired, if it did.
+func (w *watchdog) explain(err error) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.cause != nil {
+		return w.cause
+	}
+	return err
+}
+
+// trace moves the watchdog from waiting to connect, to waiting to read,
+// once connected.
+func (w *watchdog) trace(limits FetchLimits) *httptrace.ClientTrace {
+	readTimeout := &limitError{kind: limitReadTimeout, detail: limits.ReadTimeout.String()}
+	return &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			w.arm(limits.ReadTimeout, readTimeout)
+		},
+	}
+}
+
+// watchedReader restarts the watchdog's read countdown with every read, so
+// slow-but-steady servers are fine, and stalled ones aren't.
+type watchedReader struct {
+	r        io.Reader
+	w        *watchdog
+	timeout  time.Duration
+	deadline *limitError
+}
+
+func (r *watchedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.w.arm(r.timeout, r.deadline)
+	}
+	return n, err
+}
+
+// readLimited reads all of r, failing once it has more than max bytes.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > max {
+		return nil, &limitError{kind: limitBodySize, detail: strconv.FormatInt(max, 10) + " bytes"}
+	}
+	return body, nil
+}
+
+// decodeBody undoes the response's Content-Encoding. We ask for gzip and
+// deflate; anything else is refused.
+func decodeBody(encoding string, body io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		// Supposed to be zlib-wrapped, but some servers send raw deflate.
+		buffered := bufio.NewReader(body)
+		header, err := buffered.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	default:
+		return nil, &limitError{kind: limitEncoding, detail: encoding}
+	}
+}
+
+// checkXML refuses documents which declare entities (the stuff of "billion
+// laughs" attacks) or nest elements deeper than maxXMLDepth.
+func checkXML(body []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	dec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	depth := 0
+	for {
+		tok, err := dec.RawToken()
+		if err != nil {
+			// Malformed documents are for the parser to complain about.
+			return nil
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth++; depth > maxXMLDepth {
+				return &limitError{kind: limitDepth, detail: strconv.Itoa(maxXMLDepth)}
+			}
+		case xml.EndElement:
+			depth--
+		case xml.Directive:
+			// Either a DOCTYPE with declarations inside, or a bare one.
+			directive := bytes.ToUpper(t)
+			if bytes.Contains(directive, []byte("<!ENTITY")) || bytes.HasPrefix(directive, []byte("ENTITY")) {
+				return &limitError{kind: limitEntities}
+			}
+		}
+	}
+}
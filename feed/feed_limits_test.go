@@ -0,0 +1,166 @@
+package feed
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+// fetchFrom fetches once from a server answering with handler, under limits.
+func fetchFrom(t *testing.T, limits FetchLimits, handler http.HandlerFunc) (*fetchResult, error) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	f := &Feed{URL: server.URL, Fetcher: server.Client(), Limits: limits}
+	f.ctx = context.Background()
+	return f.fetchConditionally(storage.SavedValidators{})
+}
+
+func compress(t *testing.T, encoding, body string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func limitKindOf(err error) (limitKind, bool) {
+	e, ok := err.(*limitError)
+	if !ok {
+		return 0, false
+	}
+	return e.kind, true
+}
+
+func TestFetchDecompresses(t *testing.T) {
+	hn := readFixture(t, "hn_rss.txt")
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate"} {
+		header := strings.TrimPrefix(encoding, "raw-")
+		body := compress(t, encoding, hn)
+		result, err := fetchFrom(t, FetchLimits{}, func(w http.ResponseWriter, r *http.Request) {
+			if accept := r.Header.Get("Accept-Encoding"); accept != "gzip, deflate" {
+				t.Error("Unexpected Accept-Encoding: ", accept, ", expected gzip, deflate")
+			}
+			w.Header().Set("Content-Encoding", header)
+			w.Write(body)
+		})
+		if err != nil {
+			t.Error("Unexpected error fetching ", encoding, " body: ", err)
+			continue
+		}
+		if string(result.body) != hn {
+			t.Error("Unexpected ", encoding, " body, of ", len(result.body), " bytes, expected ", len(hn))
+		}
+	}
+}
+
+func TestFetchRefusesUnknownEncoding(t *testing.T) {
+	_, err := fetchFrom(t, FetchLimits{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Write([]byte("not really brotli"))
+	})
+	if kind, ok := limitKindOf(err); !ok || kind != limitEncoding {
+		t.Error("Unexpected error: ", err, ", expected an encoding limit")
+	}
+}
+
+func TestFetchCapsBodySize(t *testing.T) {
+	hn := readFixture(t, "hn_rss.txt")
+	limits := FetchLimits{MaxBodySize: int64(len(hn) - 1)}
+
+	_, err := fetchFrom(t, limits, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(hn))
+	})
+	if kind, ok := limitKindOf(err); !ok || kind != limitBodySize {
+		t.Error("Unexpected error: ", err, ", expected a size limit")
+	}
+
+	// Small on the wire is no excuse.
+	zipped := compress(t, "gzip", hn)
+	if int64(len(zipped)) > limits.MaxBodySize {
+		t.Fatal("Fixture doesn't compress well enough for this test")
+	}
+	_, err = fetchFrom(t, limits, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(zipped)
+	})
+	if kind, ok := limitKindOf(err); !ok || kind != limitBodySize {
+		t.Error("Unexpected error: ", err, ", expected a size limit once decompressed")
+	}
+}
+
+func TestFetchTimesOutStalledServer(t *testing.T) {
+	release := make(chan bool)
+	defer close(release)
+	limits := FetchLimits{ReadTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	_, err := fetchFrom(t, limits, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<rss><channel>"))
+		w.(http.Flusher).Flush()
+		<-release
+	})
+	if kind, ok := limitKindOf(err); !ok || kind != limitReadTimeout {
+		t.Error("Unexpected error: ", err, ", expected a read timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Error("Unexpected wait for a stalled server: ", elapsed)
+	}
+}
+
+func TestCheckXML(t *testing.T) {
+	billionLaughs := `<?xml version="1.0"?>
+<!DOCTYPE rss [
+  <!ENTITY lol "lol">
+  <!ENTITY lol2 "&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;">
+]>
+<rss><channel><title>&lol2;</title></channel></rss>`
+	if kind, ok := limitKindOf(checkXML([]byte(billionLaughs))); !ok || kind != limitEntities {
+		t.Error("Unexpected result for entity declarations, expected an entity limit")
+	}
+
+	deep := strings.Repeat("<a>", maxXMLDepth+1) + strings.Repeat("</a>", maxXMLDepth+1)
+	if kind, ok := limitKindOf(checkXML([]byte(deep))); !ok || kind != limitDepth {
+		t.Error("Unexpected result for deep nesting, expected a depth limit")
+	}
+
+	if err := checkXML([]byte(readFixture(t, "hn_rss.txt"))); err != nil {
+		t.Error("Unexpected error for a real feed: ", err)
+	}
+	if err := checkXML([]byte(readFixture(t, "podcast_rss.txt"))); err != nil {
+		t.Error("Unexpected error for a real feed: ", err)
+	}
+}
+
+func TestLimitErrorClassification(t *testing.T) {
+	var r retryState
+	for _, kind := range []limitKind{limitConnectTimeout, limitReadTimeout} {
+		if state, _ := r.recordFailure(&limitError{kind: kind}); state != FeedRetrying {
+			t.Error("Unexpected state after timeout ", kind, ": ", state, ", expected ", FeedRetrying)
+		}
+	}
+	for _, kind := range []limitKind{limitBodySize, limitEncoding, limitEntities, limitDepth} {
+		if state, _ := r.recordFailure(&limitError{kind: kind}); state != FeedFailing {
+			t.Error("Unexpected state after limit ", kind, ": ", state, ", expected ", FeedFailing)
+		}
+	}
+}
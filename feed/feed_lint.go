@@ -0,0 +1,240 @@
+package feed
+
+// This file checks a feed for the mistakes which make it misbehave in the
+// view: missing or repeated IDs, dates nobody can read, relative links, and
+// text in the wrong encoding.
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+// LintSeverity says whether a problem breaks a feed, or just makes it worse.
+type LintSeverity uint8
+
+const (
+	LintWarning LintSeverity = iota
+	LintError
+)
+
+func (s LintSeverity) String() string {
+	if s == LintError {
+		return "error"
+	}
+	return "warning"
+}
+
+// LintProblem is one thing wrong with a feed.
+type LintProblem struct {
+	Severity LintSeverity
+	// Which item has the problem, counting from 1, or 0 for the feed as a
+	// whole.
+	Item      int
+	ItemTitle string
+	Message   string
+}
+
+// LintReport is everything Lint found wrong with a feed.
+type LintReport struct {
+	Target   string
+	Title    string
+	Items    int
+	Problems []LintProblem
+}
+
+// Errors counts the problems which break the feed.
+func (r *LintReport) Errors() int {
+	return r.count(LintError)
+}
+
+// Warnings counts the problems which don't.
+func (r *LintReport) Warnings() int {
+	return r.count(LintWarning)
+}
+
+func (r *LintReport) count(severity LintSeverity) int {
+	n := 0
+	for _, p := range r.Problems {
+		if p.Severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *LintReport) add(severity LintSeverity, item int, itemTitle, message string) {
+	r.Problems = append(r.Problems, LintProblem{Severity: severity, Item: item, ItemTitle: itemTitle, Message: message})
+}
+
+// Lint fetches target (a URL, or failing that, a file) and parses it the
+// way a running feed would, reporting whatever is amiss.
+func Lint(ctx context.Context, target string, limits FetchLimits) *LintReport {
+	report := &LintReport{Target: target}
+	f := &Feed{URL: target, Limits: limits, ctx: ctx}
+
+	var body []byte
+	var contentType string
+	var doc *document
+	if u, err := url.Parse(target); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		result, err := f.fetchConditionally(storage.SavedValidators{})
+		if err != nil {
+			report.add(LintError, 0, "", err.Error())
+			return report
+		}
+		if result.movedTo != "" {
+			report.add(LintWarning, 0, "", "Moved permanently to "+result.movedTo)
+		}
+		if result.doc == nil {
+			// Nothing was asked to be "not modified" since.
+			report.add(LintError, 0, "", "Answered \"304 Not Modified\" to an unconditional request")
+			return report
+		}
+		body, contentType, doc = result.body, result.contentType, result.doc
+	} else {
+		body, err = readFeedFile(target, f.limits())
+		if err != nil {
+			report.add(LintError, 0, "", err.Error())
+			return report
+		}
+		doc, err = parseDocument("", body)
+		if _, ok := err.(*limitError); !ok && err != nil {
+			err = &parseError{err}
+		}
+		if err != nil {
+			// Mangled text is a likely reason.
+			report.lintCharset("", body)
+			report.add(LintError, 0, "", err.Error())
+			return report
+		}
+	}
+
+	report.lintCharset(contentType, body)
+	report.lintDocument(doc)
+	return report
+}
+
+// readFeedFile reads a feed from a file, within the same limits as a fetch.
+func readFeedFile(name string, limits FetchLimits) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, errors.New("Reading feed failed: " + err.Error())
+	}
+	defer file.Close()
+	return readLimited(file, limits.MaxBodySize)
+}
+
+// Matches the encoding in an XML declaration.
+var xmlEncoding = regexp.MustCompile(`^\s*<\?xml[^>]*encoding\s*=\s*["']([^"']+)["']`)
+
+// lintCharset checks that body is UTF-8, which is all the feed ever reads,
+// and says so.
+func (r *LintReport) lintCharset(contentType string, body []byte) {
+	declared := ""
+	if m := xmlEncoding.FindSubmatch(body); m != nil {
+		declared = string(m[1])
+	}
+	served := ""
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		served = params["charset"]
+	}
+
+	if declared != "" && served != "" && !strings.EqualFold(declared, served) {
+		r.add(LintWarning, 0, "", "Served as "+served+", but declares itself "+declared)
+	}
+	for _, charset := range []string{declared, served} {
+		if charset != "" && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "utf8") {
+			r.add(LintWarning, 0, "", "Encoded as "+charset+"; only UTF-8 is read reliably")
+			break
+		}
+	}
+	for offset := 0; offset < len(body); {
+		c, size := utf8.DecodeRune(body[offset:])
+		if c == utf8.RuneError && size == 1 {
+			r.add(LintError, 0, "", "Not valid UTF-8, from byte "+strconv.Itoa(offset))
+			return
+		}
+		offset += size
+	}
+}
+
+// lintDocument checks the parsed feed.
+func (r *LintReport) lintDocument(doc *document) {
+	r.Title = doc.Title
+	r.Items = len(doc.Items)
+	if doc.Title == "" {
+		r.add(LintWarning, 0, "", "No title")
+	}
+	if len(doc.Items) == 0 {
+		r.add(LintWarning, 0, "", "No items")
+	}
+	r.lintLink(0, "", "Site link", doc.Metadata.SiteLink)
+	r.lintLink(0, "", "Image", doc.Metadata.ImageURL)
+
+	// The first item with each ID.
+	ids := make(map[string]int)
+	// Items lacking an ID, or a date; said once if it's all of them.
+	var noID, noDate []int
+	for i, item := range doc.Items {
+		n := i + 1
+		id := item.ID
+		if id == "" {
+			noID = append(noID, n)
+		} else if first, ok := ids[id]; ok {
+			r.add(LintError, n, item.Title, "Duplicate ID \""+id+"\" (first seen on item "+strconv.Itoa(first)+")")
+		} else {
+			ids[id] = n
+		}
+
+		if item.RawDate == "" {
+			noDate = append(noDate, n)
+		} else if item.Date.IsZero() {
+			// Judged by what the feed itself made of it.
+			r.add(LintError, n, item.Title, "Unparseable date \""+item.RawDate+"\"")
+		} else if item.Date.After(time.Now().Add(maxFutureDate)) {
+			r.add(LintWarning, n, item.Title, "Dated in the future: "+item.RawDate)
+		}
+
+		r.lintLink(n, item.Title, "Link", item.Link)
+		for _, e := range item.Enclosures {
+			r.lintLink(n, item.Title, "Enclosure", e.URL)
+		}
+	}
+	r.addMissing(doc, noID, "No ID", "No item has an ID", "; told apart by link or content instead")
+	r.addMissing(doc, noDate, "No date", "No item has a date", "")
+}
+
+// addMissing warns about items lacking something, with one warning for the
+// feed if they all do.
+func (r *LintReport) addMissing(doc *document, items []int, each, all, consequence string) {
+	if len(items) > 1 && len(items) == len(doc.Items) {
+		r.add(LintWarning, 0, "", all+consequence)
+		return
+	}
+	for _, n := range items {
+		r.add(LintWarning, n, doc.Items[n-1].Title, each+consequence)
+	}
+}
+
+// lintLink complains if link is malformed or relative: with nothing to
+// resolve it against, the view can't open it.
+func (r *LintReport) lintLink(item int, itemTitle, what, link string) {
+	if link == "" {
+		return
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		r.add(LintError, item, itemTitle, what+" is malformed: "+link)
+	} else if !u.IsAbs() {
+		r.add(LintError, item, itemTitle, what+" is relative: "+link)
+	}
+}
@@ -0,0 +1,135 @@
+package feed
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const brokenRSS = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0"><channel>
+<title>Broken</title>
+<link>http://example.org/</link>
+<item><title>One</title><guid>same</guid><link>http://example.org/1</link><pubDate>Mon, 02 Jan 2006 15:04:05 -0700</pubDate></item>
+<item><title>Two</title><guid>same</guid><link>/2</link><pubDate>yesterday-ish</pubDate></item>
+<item><title>Three</title><link>http://example.org/3</link></item>
+</channel></rss>`
+
+// lintProblems gathers the report's problems as "severity item: message".
+func lintProblems(report *LintReport) []string {
+	var problems []string
+	for _, p := range report.Problems {
+		problems = append(problems, p.Severity.String()+" "+strconv.Itoa(p.Item)+": "+p.Message)
+	}
+	return problems
+}
+
+func expectProblem(t *testing.T, problems []string, prefix string) {
+	for _, p := range problems {
+		if strings.HasPrefix(p, prefix) {
+			return
+		}
+	}
+	t.Error("Expected a problem starting ", prefix, ", got ", problems)
+}
+
+func TestLintFindsProblems(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "broken.rss")
+	if err := ioutil.WriteFile(name, []byte(brokenRSS), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report := Lint(context.Background(), name, FetchLimits{})
+	if report.Items != 3 {
+		t.Error("Unexpected item count: ", report.Items, ", expected 3")
+	}
+	problems := lintProblems(report)
+	expectProblem(t, problems, `error 2: Duplicate ID "same"`)
+	expectProblem(t, problems, `error 2: Unparseable date "yesterday-ish"`)
+	expectProblem(t, problems, "error 2: Link is relative: /2")
+	expectProblem(t, problems, "warning 3: No ID")
+	expectProblem(t, problems, "warning 3: No date")
+	if report.Errors() != 3 {
+		t.Error("Unexpected error count: ", report.Errors(), ", expected 3: ", problems)
+	}
+}
+
+func TestLintDatesAsTheFeedReadsThem(t *testing.T) {
+	var report LintReport
+	report.lintDocument(&document{Title: "Dates", Items: []*documentItem{
+		{ID: "1", Title: "Read", RawDate: "an odd format", Date: time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: "2", Title: "Dropped", RawDate: "2018-01-02T00:00:00Z"},
+	}})
+	problems := lintProblems(&report)
+	if len(problems) != 1 || problems[0] != `error 2: Unparseable date "2018-01-02T00:00:00Z"` {
+		t.Error("Unexpected problems: ", problems)
+	}
+}
+
+func TestLintCharset(t *testing.T) {
+	var report LintReport
+	report.lintCharset("application/rss+xml; charset=utf-8", []byte(`<?xml version="1.0" encoding="ISO-8859-1"?><rss>Caf`+"\xe9"+`</rss>`))
+	problems := lintProblems(&report)
+	expectProblem(t, problems, "warning 0: Served as utf-8, but declares itself ISO-8859-1")
+	expectProblem(t, problems, "warning 0: Encoded as ISO-8859-1")
+	expectProblem(t, problems, "error 0: Not valid UTF-8, from byte 51")
+
+	report = LintReport{}
+	report.lintCharset("text/xml", []byte(`<?xml version="1.0" encoding="utf-8"?><rss>Café</rss>`))
+	if len(report.Problems) != 0 {
+		t.Error("Unexpected problems for UTF-8: ", lintProblems(&report))
+	}
+}
+
+func TestLintCleanFeeds(t *testing.T) {
+	for _, name := range []string{"podcast_rss.txt", "reddit_rss.txt", "json_feed.txt"} {
+		report := Lint(context.Background(), filepath.Join(fixtureDir, name), FetchLimits{})
+		if report.Errors() != 0 {
+			t.Error("Unexpected errors for ", name, ": ", lintProblems(report))
+		}
+	}
+
+	// Every item lacking an ID is said once.
+	report := Lint(context.Background(), filepath.Join(fixtureDir, "hn_rss.txt"), FetchLimits{})
+	if problems := lintProblems(report); len(problems) != 1 || !strings.HasPrefix(problems[0], "warning 0: No item has an ID") {
+		t.Error("Unexpected problems for hn_rss.txt: ", problems)
+	}
+}
+
+func TestLintFetches(t *testing.T) {
+	hn := readFixture(t, "hn_rss.txt")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unchanged" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.URL.Path != "/feed" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml; charset=windows-1252")
+		w.Write([]byte(hn))
+	}))
+	defer server.Close()
+
+	report := Lint(context.Background(), server.URL+"/feed", FetchLimits{})
+	if report.Title != "Hacker News" || report.Items != 30 {
+		t.Error("Unexpected report: ", report.Title, ", ", report.Items, " items")
+	}
+	expectProblem(t, lintProblems(report), "warning 0: Encoded as windows-1252")
+
+	report = Lint(context.Background(), server.URL+"/missing", FetchLimits{})
+	if report.Errors() != 1 {
+		t.Error("Unexpected problems for a missing feed: ", lintProblems(report))
+	}
+
+	report = Lint(context.Background(), server.URL+"/unchanged", FetchLimits{})
+	if report.Errors() != 1 || report.Items != 0 {
+		t.Error("Unexpected problems for a 304: ", lintProblems(report))
+	}
+}
@@ -0,0 +1,384 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SlyMarbo/rss"
+	"github.com/smklein/toy-rss/storage"
+)
+
+// document is a parsed feed, whichever format it arrived in.
+type document struct {
+	Title    string
+	Metadata storage.ChannelMetadata
+	// When the feed itself suggests polling again (zero if it doesn't say).
+	Refresh time.Time
+	Items   []*documentItem
+}
+
+// documentItem is a single entry in a document.
+type documentItem struct {
+	ID      string
+	Title   string
+	Summary string
+	Content string
+	Link    string
+	Date    time.Time
+	// Date as the feed wrote it, parseable or not.
+	RawDate string
+	Author  string
+	// Attached files, like podcast episodes.
+	Enclosures []storage.Enclosure
+}
+
+// parseDocument picks a parser based on the response's Content-Type or, if
+// that's unhelpful, on what the body looks like.
+func parseDocument(contentType string, body []byte) (*document, error) {
+	if isJSONFeed(contentType, body) {
+		return parseJSONFeed(body)
+	}
+	if err := checkXML(body); err != nil {
+		return nil, err
+	}
+	return parseRSS(body)
+}
+
+// parseRSS handles RSS and Atom, by way of the rss package.
+func parseRSS(body []byte) (*document, error) {
+	rssFeed, err := rss.Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	doc := &document{
+		Title:    rssFeed.Title,
+		Metadata: parseChannelMetadata(body),
+		Refresh:  rssFeed.Refresh,
+		Items:    make([]*documentItem, len(rssFeed.Items)),
+	}
+	// Prefer the rss package's take on anything we both understand.
+	if rssFeed.Description != "" {
+		doc.Metadata.Description = rssFeed.Description
+	}
+	if rssFeed.Link != "" {
+		doc.Metadata.SiteLink = rssFeed.Link
+	}
+	if rssFeed.Image != nil && rssFeed.Image.URL != "" {
+		doc.Metadata.ImageURL = rssFeed.Image.URL
+	}
+	raw := parseRawItems(body)
+	next := 0
+	for i, item := range rssFeed.Items {
+		doc.Items[i] = &documentItem{
+			ID:      item.ID,
+			Title:   item.Title,
+			Summary: item.Summary,
+			Content: item.Content,
+			Link:    item.Link,
+			Date:    item.Date,
+		}
+		for _, e := range item.Enclosures {
+			doc.Items[i].addEnclosure(storage.Enclosure{URL: e.URL, Type: e.Type, Length: int64(e.Length)})
+		}
+		found := raw.find(next, item.ID, item.Link)
+		if found < 0 {
+			continue
+		}
+		r := raw[found]
+		next = found + 1
+		doc.Items[i].RawDate = r.Date
+		if r.ID == "" {
+			// The rss package made one up; dedupeKey's fallbacks do better.
+			doc.Items[i].ID = ""
+		}
+		for _, e := range r.Media {
+			doc.Items[i].addEnclosure(e)
+		}
+	}
+	return doc, nil
+}
+
+// addEnclosure attaches e to the item, unless it's already attached; feeds
+// often list the same file as both an <enclosure> and <media:content>.
+func (item *documentItem) addEnclosure(e storage.Enclosure) {
+	if e.URL == "" {
+		return
+	}
+	for _, existing := range item.Enclosures {
+		if existing.URL == e.URL {
+			return
+		}
+	}
+	item.Enclosures = append(item.Enclosures, e)
+}
+
+// rawItem is what an item says about itself, before the rss package tidies
+// it up: it fills in missing IDs, drops dates it can't read, and ignores
+// Media RSS files.
+type rawItem struct {
+	ID   string
+	Date string
+	// Every link to the item; feeds sometimes give several.
+	Links []string
+	Media []storage.Enclosure
+}
+
+// rawItems are the items of a document, in document order.
+type rawItems []rawItem
+
+// find returns the index of the first item from start on with the given ID
+// or, if it had none (and was given its link instead), link; or -1 if there
+// isn't one. The rss package skips items it can't identify, so its items
+// don't line up with ours by position, but they do keep their order.
+func (items rawItems) find(start int, ID, link string) int {
+	for i := start; i < len(items); i++ {
+		if items[i].ID != "" {
+			if items[i].ID == ID {
+				return i
+			}
+			continue
+		}
+		for _, l := range items[i].Links {
+			if link != "" && l == link {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// itemDateElements are where items keep their dates, most preferred first.
+var itemDateElements = []string{"pubDate", "published", "date", "issued", "updated", "modified"}
+
+// mediaRSSNamespace is where Media RSS (<media:content>) elements live.
+const mediaRSSNamespace = "http://search.yahoo.com/mrss/"
+
+// parseRawItems finds the ID, date, links and Media RSS files of each item in
+// body, in document order.
+func parseRawItems(body []byte) rawItems {
+	var items rawItems
+	// The rank in itemDateElements of the current item's date.
+	dateRank := len(itemDateElements)
+
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	dec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	// Elements within the current item, outermost first.
+	var within []string
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			if len(within) == 0 {
+				if name == "item" || name == "entry" {
+					items = append(items, rawItem{})
+					dateRank = len(itemDateElements)
+					within = append(within, name)
+				}
+				continue
+			}
+			item := &items[len(items)-1]
+			if len(within) == 1 && name == "link" {
+				// Atom's links are attributes; RSS's are text, below.
+				if href, rel := attrValue(t, "href"), attrValue(t, "rel"); href != "" && (rel == "" || rel == "alternate") {
+					item.Links = append(item.Links, href)
+				}
+			}
+			// Undeclared prefixes are left as-is by the decoder.
+			if name == "content" && (t.Name.Space == mediaRSSNamespace || t.Name.Space == "media") {
+				if e, ok := parseMediaContent(t); ok {
+					item.Media = append(item.Media, e)
+				}
+			}
+			within = append(within, name)
+		case xml.EndElement:
+			if len(within) > 0 {
+				within = within[:len(within)-1]
+			}
+		case xml.CharData:
+			if len(within) != 2 {
+				// Only the item's own children count.
+				break
+			}
+			text := strings.TrimSpace(string(t))
+			if text == "" {
+				break
+			}
+			item := &items[len(items)-1]
+			name := within[1]
+			if name == "guid" || name == "id" {
+				item.ID = text
+			}
+			if name == "link" {
+				item.Links = append(item.Links, text)
+			}
+			for rank, element := range itemDateElements {
+				if name == element && rank < dateRank {
+					item.Date, dateRank = text, rank
+				}
+			}
+		}
+	}
+	return items
+}
+
+func attrValue(t xml.StartElement, name string) string {
+	for _, attr := range t.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// parseMediaContent reads a <media:content> element, which the rss package
+// ignores.
+func parseMediaContent(t xml.StartElement) (storage.Enclosure, bool) {
+	var e storage.Enclosure
+	var medium string
+	for _, attr := range t.Attr {
+		switch attr.Name.Local {
+		case "url":
+			e.URL = attr.Value
+		case "type":
+			e.Type = attr.Value
+		case "medium":
+			medium = attr.Value
+		case "fileSize":
+			e.Length, _ = strconv.ParseInt(attr.Value, 10, 64)
+		}
+	}
+	if e.Type == "" {
+		// Better than nothing: "audio", "video", "image"...
+		e.Type = medium
+	}
+	return e, e.URL != ""
+}
+
+func isJSONFeed(contentType string, body []byte) bool {
+	if strings.Contains(contentType, "json") {
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("{"))
+}
+
+// dateLayouts are the formats seen in the wild for feed dates, most likely
+// first.
+var dateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC822Z,
+	time.RFC822,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// parseDate tries each of dateLayouts in turn.
+func parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseChannelMetadata pulls what RSS and Atom documents say about the channel
+// itself out of body, stopping at the first item. The rss package only keeps
+// a few of these.
+func parseChannelMetadata(body []byte) storage.ChannelMetadata {
+	var md storage.ChannelMetadata
+
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	dec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	var parents []string
+	parent := func(depth int) string {
+		if len(parents) < depth {
+			return ""
+		}
+		return parents[len(parents)-depth]
+	}
+tokens:
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			if name == "item" || name == "entry" {
+				break tokens
+			}
+			attrs := make(map[string]string)
+			for _, attr := range t.Attr {
+				attrs[attr.Name.Local] = attr.Value
+			}
+			switch {
+			case name == "feed" && len(parents) == 0:
+				// Atom puts the language on the root element.
+				md.Language = attrs["lang"]
+			case name == "link" && parent(1) == "feed" && attrs["href"] != "":
+				if rel := attrs["rel"]; rel == "" || rel == "alternate" {
+					md.SiteLink = attrs["href"]
+				}
+			case name == "category" && parent(1) == "feed" && attrs["term"] != "":
+				md.Categories = append(md.Categories, attrs["term"])
+			}
+			parents = append(parents, name)
+		case xml.EndElement:
+			if len(parents) > 0 {
+				parents = parents[:len(parents)-1]
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if text == "" || len(parents) < 2 {
+				break
+			}
+			name, within := parent(1), parent(2)
+			if within == "image" && name == "url" {
+				md.ImageURL = text
+			}
+			if within != "channel" && within != "feed" {
+				break
+			}
+			switch name {
+			case "description", "subtitle":
+				md.Description = text
+			case "language":
+				md.Language = text
+			case "category":
+				md.Categories = append(md.Categories, text)
+			case "generator":
+				md.Generator = text
+			case "icon", "logo":
+				if md.ImageURL == "" {
+					md.ImageURL = text
+				}
+			case "lastBuildDate", "pubDate", "updated", "date":
+				if date, ok := parseDate(text); ok && date.After(md.LastUpdated) {
+					md.LastUpdated = date
+				}
+			}
+		}
+	}
+	return md
+}
@@ -0,0 +1,154 @@
+package feed
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+func TestParseChannelMetadata(t *testing.T) {
+	rssBody := []byte(`<?xml version="1.0"?>
+<rss version="2.0"><channel>
+<title>Example</title>
+<link>https://example.org/</link>
+<description>All about examples.</description>
+<language>en-us</language>
+<category>News</category>
+<category>Examples</category>
+<generator>Hand</generator>
+<lastBuildDate>Tue, 31 May 2016 02:00:00 GMT</lastBuildDate>
+<image><url>https://example.org/logo.png</url><title>Example</title></image>
+<item><title>Item</title><description>Not the channel description.</description></item>
+</channel></rss>`)
+	md := parseChannelMetadata(rssBody)
+	if md.Description != "All about examples." || md.Language != "en-us" || md.Generator != "Hand" {
+		t.Error("Unexpected metadata: ", md)
+	}
+	if md.ImageURL != "https://example.org/logo.png" {
+		t.Error("Unexpected image: ", md.ImageURL)
+	}
+	if len(md.Categories) != 2 || md.Categories[0] != "News" || md.Categories[1] != "Examples" {
+		t.Error("Unexpected categories: ", md.Categories)
+	}
+	if e := time.Date(2016, time.May, 31, 2, 0, 0, 0, time.UTC); !md.LastUpdated.Equal(e) {
+		t.Error("Unexpected last update: ", md.LastUpdated, ", expected ", e)
+	}
+
+	atomBody := []byte(`<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom" xml:lang="fr">
+<title>Exemple</title>
+<subtitle>Tout sur les exemples.</subtitle>
+<link rel="self" href="https://example.org/feed.atom"/>
+<link rel="alternate" href="https://example.org/"/>
+<category term="Nouvelles"/>
+<icon>https://example.org/favicon.ico</icon>
+<updated>2016-05-31T02:00:00Z</updated>
+<entry><title>Entry</title><updated>2017-01-01T00:00:00Z</updated></entry>
+</feed>`)
+	md = parseChannelMetadata(atomBody)
+	if md.Description != "Tout sur les exemples." || md.Language != "fr" || md.SiteLink != "https://example.org/" {
+		t.Error("Unexpected metadata: ", md)
+	}
+	if md.ImageURL != "https://example.org/favicon.ico" {
+		t.Error("Unexpected image: ", md.ImageURL)
+	}
+	if len(md.Categories) != 1 || md.Categories[0] != "Nouvelles" {
+		t.Error("Unexpected categories: ", md.Categories)
+	}
+	if e := time.Date(2016, time.May, 31, 2, 0, 0, 0, time.UTC); !md.LastUpdated.Equal(e) {
+		t.Error("Entry dates should not count as channel updates, got ", md.LastUpdated)
+	}
+}
+
+func TestParseRSSWithoutGUIDs(t *testing.T) {
+	doc, err := parseDocument("", []byte(readFixture(t, "hn_rss.txt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Items) == 0 {
+		t.Fatal("Expected items")
+	}
+	for _, item := range doc.Items {
+		if item.ID != "" {
+			t.Error("Unexpected ID for an item without a GUID: ", item.ID)
+		}
+	}
+	if key := dedupeKey(storage.DedupeGUID, doc.Items[0]); key != "normalized-link:"+storage.CanonicalURL(doc.Items[0].Link) {
+		t.Error("Unexpected key for an item without a GUID: ", key)
+	}
+
+	doc, err = parseDocument("", []byte(readFixture(t, "podcast_rss.txt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range doc.Items {
+		if item.ID == "" {
+			t.Error("Item with a GUID lost it: ", item.Title)
+		}
+	}
+}
+
+func TestParseEnclosures(t *testing.T) {
+	body, err := ioutil.ReadFile("../test_server/test_files/podcast_rss.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := parseDocument("application/rss+xml", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Items) != 2 {
+		t.Fatal("Unexpected number of items: ", len(doc.Items))
+	}
+
+	// Listed as both an <enclosure> and <media:content>, but it's one file.
+	e := storage.Enclosure{URL: "https://podcast.example.org/2.mp3", Type: "audio/mpeg", Length: 12345678}
+	if encs := doc.Items[0].Enclosures; len(encs) != 1 || encs[0] != e {
+		t.Error("Unexpected enclosures: ", encs, ", expected ", e)
+	}
+
+	expected := []storage.Enclosure{
+		{URL: "https://podcast.example.org/1.mp4", Type: "video", Length: 99999},
+		{URL: "https://podcast.example.org/1.ogg", Type: "audio/ogg"},
+	}
+	encs := doc.Items[1].Enclosures
+	if len(encs) != len(expected) {
+		t.Fatal("Unexpected enclosures: ", encs, ", expected ", expected)
+	}
+	for i := range expected {
+		if encs[i] != expected[i] {
+			t.Error("Unexpected enclosure: ", encs[i], ", expected ", expected[i])
+		}
+	}
+}
+
+func TestParseRSSSkippedItem(t *testing.T) {
+	// The second item has neither a GUID nor a link, so the rss package
+	// drops it; what the later items said mustn't shift onto their
+	// neighbours.
+	doc, err := parseDocument("application/rss+xml", []byte(readFixture(t, "skipped_item_rss.txt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		title, ID, rawDate, enclosure string
+	}{
+		{"First", "first", "Mon, 01 Jan 2018 00:00:00 GMT", "https://skipped.example.org/1.mp3"},
+		{"Third", "", "sometime on the third", "https://skipped.example.org/3.mp3"},
+		{"Fourth", "fourth", "Thu, 04 Jan 2018 00:00:00 GMT", "https://skipped.example.org/4.mp3"},
+	}
+	if len(doc.Items) != len(expected) {
+		t.Fatal("Unexpected number of items: ", len(doc.Items), ", expected ", len(expected))
+	}
+	for i, e := range expected {
+		item := doc.Items[i]
+		if item.Title != e.title || item.ID != e.ID || item.RawDate != e.rawDate {
+			t.Error("Unexpected item: ", item.Title, ", ", item.ID, ", ", item.RawDate, ", expected ", e)
+		}
+		if len(item.Enclosures) != 1 || item.Enclosures[0].URL != e.enclosure {
+			t.Error("Unexpected enclosures for ", item.Title, ": ", item.Enclosures, ", expected ", e.enclosure)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package feed
+
+// This file notices feeds which have moved for good, and moves what we keep
+// per URL along with them. Temporary redirects are followed, but forgotten.
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+// FeedMove is sent when a feed answers from a new URL for good.
+type FeedMove struct {
+	From string
+	To   string
+	// Set if the feed stays at From, because its credentials or headers
+	// would be sent somewhere they weren't meant for.
+	Declined bool
+}
+
+// GetURL returns where the feed is polled from now, which changes if it
+// moves.
+func (f *Feed) GetURL() string {
+	f.stateLock.RLock()
+	defer f.stateLock.RUnlock()
+	return f.URL
+}
+
+// GetChanMoved returns the pipe on which the feed reports moving.
+func (f *Feed) GetChanMoved() chan FeedMove {
+	return f.movedPipe
+}
+
+func isPermanentRedirect(statusCode int) bool {
+	return statusCode == http.StatusMovedPermanently || statusCode == http.StatusPermanentRedirect
+}
+
+// permanentlyMovedTo follows the redirects which led to resp, returning where
+// the first request should go from now on: the target of the last of the
+// permanent redirects it started with. If the first redirect was temporary (or
+// there were none), it returns "".
+func permanentlyMovedTo(resp *http.Response) string {
+	// Each request knows the redirect which caused it; walk back to the
+	// first.
+	var hops []*http.Request
+	for req := resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		hops = append(hops, req)
+	}
+	movedTo := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isPermanentRedirect(hops[i].Response.StatusCode) {
+			break
+		}
+		movedTo = hops[i].URL.String()
+	}
+	return movedTo
+}
+
+// safeToMove reports whether the feed's credentials and headers may follow
+// it to URL for good. (Redirects never carry them off; see
+// keepingCredentials. This decides where they're sent from now on.)
+func (f *Feed) safeToMove(URL string) bool {
+	f.requestLock.RLock()
+	settings := f.requestSettings
+	f.requestLock.RUnlock()
+	if settings.Auth.Kind == storage.AuthNone && len(settings.Headers) == 0 {
+		return true
+	}
+	from, err := url.Parse(f.URL)
+	if err != nil {
+		return false
+	}
+	to, err := url.Parse(URL)
+	if err != nil {
+		return false
+	}
+	return !leavesOrigin(from, to)
+}
+
+// move starts polling URL instead, taking the validators and health recorded
+// for the old URL along. The history of items is kept by title, so it needn't
+// move. If the feed's credentials can't safely follow, it stays put, and the
+// move is reported as declined (once). Only doFeed may call this, between
+// turns. Returns false if the feed was ended.
+func (f *Feed) move(URL string, validatorStorage *storage.ValidatorStorage, healthStorage *storage.HealthStorage) bool {
+	from := f.URL
+	if !f.safeToMove(URL) {
+		if f.declinedMove == URL {
+			return true
+		}
+		f.declinedMove = URL
+		log.Println("Feed moved, but not following with credentials:", from, "->", URL)
+		select {
+		case f.movedPipe <- FeedMove{From: from, To: URL, Declined: true}:
+			return true
+		case <-f.ctx.Done():
+			return false
+		}
+	}
+	log.Println("Feed moved:", from, "->", URL)
+	if err := validatorStorage.Move(URL); err != nil {
+		log.Println(err)
+	}
+	if err := healthStorage.Move(URL); err != nil {
+		log.Println(err)
+	}
+
+	f.stateLock.Lock()
+	f.URL = URL
+	f.host = hostOf(URL)
+	f.stateLock.Unlock()
+
+	select {
+	case f.movedPipe <- FeedMove{From: from, To: URL}:
+		return true
+	case <-f.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,148 @@
+package feed
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	// The first retry happens after about this long...
+	retryBackoffBase = 30 * time.Second
+	// ... doubling on each consecutive failure, up to this.
+	retryBackoffCap = time.Hour
+	// Feeds which fail to parse this many times in a row are marked failing.
+	parseFailureThreshold = 5
+)
+
+// FeedState summarizes whether a feed is being fetched successfully.
+type FeedState uint8
+
+const (
+	// FeedHealthy means the last poll worked.
+	FeedHealthy FeedState = iota
+	// FeedRetrying means the last poll hit a (probably) transient error.
+	FeedRetrying
+	// FeedFailing means the feed looks gone or broken. It is still polled,
+	// rarely, in case it comes back.
+	FeedFailing
+	// FeedUnauthorized means the server refused our credentials (or we had
+	// none to send). It is polled rarely until the credentials change.
+	FeedUnauthorized
+)
+
+func (s FeedState) String() string {
+	switch s {
+	case FeedHealthy:
+		return "healthy"
+	case FeedRetrying:
+		return "retrying"
+	case FeedFailing:
+		return "failing"
+	case FeedUnauthorized:
+		return "unauthorized"
+	default:
+		return "unknown"
+	}
+}
+
+// FeedError is reported on the feed's error pipe whenever a poll fails.
+type FeedError struct {
+	Title string
+	State FeedState
+	Err   error
+}
+
+func (e *FeedError) Error() string {
+	return "[" + e.Title + "] " + e.State.String() + ": " + e.Err.Error()
+}
+
+// httpStatusError is returned when a server answers with a non-2xx status.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return "Unexpected HTTP status: " + e.Status
+}
+
+// parseError is returned when a document was fetched, but couldn't be parsed.
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return "Parsing feed failed: " + e.err.Error()
+}
+
+// statusCodeOf digs the HTTP status out of a failed fetch, or returns zero if
+// the server never answered.
+func statusCodeOf(err error) int {
+	if e, ok := err.(*authError); ok {
+		err = e.err
+	}
+	if e, ok := err.(*httpStatusError); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// retryState counts consecutive failures, deciding how long to back off and
+// whether the feed should be considered failing.
+type retryState struct {
+	failures      int
+	parseFailures int
+}
+
+func (r *retryState) reset() {
+	r.failures = 0
+	r.parseFailures = 0
+}
+
+// recordFailure notes another failed poll, returning the state the feed is now
+// in and how long to wait before polling again.
+func (r *retryState) recordFailure(err error) (FeedState, time.Duration) {
+	r.failures++
+	if _, ok := err.(*parseError); ok {
+		r.parseFailures++
+	} else {
+		r.parseFailures = 0
+	}
+
+	if _, ok := err.(*authError); ok {
+		// Retrying won't help until someone fixes the credentials.
+		return FeedUnauthorized, maxPollInterval
+	}
+	if r.isPermanent(err) {
+		return FeedFailing, maxPollInterval
+	}
+	return FeedRetrying, retryBackoff(r.failures)
+}
+
+func (r *retryState) isPermanent(err error) bool {
+	switch e := err.(type) {
+	case *httpStatusError:
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone
+	case *parseError:
+		return r.parseFailures >= parseFailureThreshold
+	case *limitError:
+		// A stall may clear up; an oversized or hostile document won't.
+		return !e.timeout()
+	}
+	return false
+}
+
+// retryBackoff returns how long to wait after the given number of consecutive
+// failures. The delay doubles each time, with jitter so that many feeds on a
+// flaky network don't all retry in lockstep.
+func retryBackoff(failures int) time.Duration {
+	d := retryBackoffBase
+	for i := 1; i < failures && d < retryBackoffCap; i++ {
+		d *= 2
+	}
+	if d > retryBackoffCap {
+		d = retryBackoffCap
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,51 @@
+package feed
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestRetryBackoffBounds(t *testing.T) {
+	for failures := 1; failures < 20; failures++ {
+		d := retryBackoff(failures)
+		if d < retryBackoffBase/2 || retryBackoffCap < d {
+			t.Error("Backoff out of range after ", failures, " failures: ", d)
+		}
+	}
+	if d := retryBackoff(1); retryBackoffBase < d {
+		t.Error("First backoff too long: ", d)
+	}
+}
+
+func TestRetryStateClassification(t *testing.T) {
+	var r retryState
+
+	state, _ := r.recordFailure(errors.New("dial tcp: no such host"))
+	if state != FeedRetrying {
+		t.Error("Network errors should be retried, got ", state)
+	}
+	state, _ = r.recordFailure(&httpStatusError{StatusCode: http.StatusServiceUnavailable})
+	if state != FeedRetrying {
+		t.Error("503 should be retried, got ", state)
+	}
+	state, wait := r.recordFailure(&httpStatusError{StatusCode: http.StatusGone})
+	if state != FeedFailing || wait != maxPollInterval {
+		t.Error("410 should be failing, got ", state, wait)
+	}
+
+	state, wait = r.recordFailure(&authError{&httpStatusError{StatusCode: http.StatusForbidden}})
+	if state != FeedUnauthorized || wait != maxPollInterval {
+		t.Error("403 should be unauthorized, got ", state, wait)
+	}
+
+	r.reset()
+	for i := 1; i < parseFailureThreshold; i++ {
+		if state, _ = r.recordFailure(&parseError{errors.New("bad xml")}); state != FeedRetrying {
+			t.Error("Parse failure ", i, " should be retried, got ", state)
+		}
+	}
+	if state, _ = r.recordFailure(&parseError{errors.New("bad xml")}); state != FeedFailing {
+		t.Error("Repeated parse failures should be failing, got ", state)
+	}
+}
@@ -0,0 +1,220 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPollInterval is used when a feed gives us nothing better to go on.
+	defaultPollInterval = 15 * time.Minute
+	// maxPollInterval bounds how long we leave even the sleepiest feed alone.
+	maxPollInterval = 24 * time.Hour
+	// MinRefreshInterval keeps user overrides from hammering a server.
+	MinRefreshInterval = 1 * time.Minute
+	// How many recent items we look at to guess how often a feed posts.
+	postingSampleSize = 10
+)
+
+// documentHints are what a feed document tells us about how often it is worth
+// polling. They are only refreshed when the document is actually parsed.
+type documentHints struct {
+	ttl          time.Duration         // <ttl>
+	updatePeriod time.Duration         // sy:updatePeriod / sy:updateFrequency
+	skipHours    map[int]bool          // <skipHours>, in GMT
+	skipDays     map[time.Weekday]bool // <skipDays>, in GMT
+	refresh      time.Time             // document.Refresh
+	// The typical gap between items, judging by their dates.
+	postingInterval time.Duration
+}
+
+// pollScheduler decides when a feed should next be polled.
+type pollScheduler struct {
+	doc documentHints
+	// If non-zero, the user has picked an interval; use it verbatim.
+	override time.Duration
+}
+
+// observeDocument updates the hints which come from a freshly parsed document.
+func (s *pollScheduler) observeDocument(body []byte, doc *document) {
+	s.doc = parseDocumentHints(body)
+	s.doc.refresh = doc.Refresh
+	s.doc.postingInterval = estimatePostingInterval(doc.Items)
+}
+
+// nextPoll returns the time at which the feed should next be fetched.
+// cacheExpiry comes from the most recent HTTP response, and may be zero.
+func (s *pollScheduler) nextPoll(now, cacheExpiry time.Time) time.Time {
+	if s.override > 0 {
+		return now.Add(s.override)
+	}
+
+	interval := defaultPollInterval
+	// Posting slowly is a hint, not a promise, so check twice as often.
+	for _, d := range []time.Duration{
+		s.doc.ttl,
+		s.doc.updatePeriod,
+		s.doc.postingInterval / 2,
+		s.doc.refresh.Sub(now),
+		cacheExpiry.Sub(now),
+	} {
+		if d > interval {
+			interval = d
+		}
+	}
+	if interval > maxPollInterval {
+		interval = maxPollInterval
+	}
+	return s.doc.skipForward(now.Add(interval))
+}
+
+// skipForward moves t past any hours or days the feed asked us to skip.
+func (h documentHints) skipForward(t time.Time) time.Time {
+	// A feed which skips every hour of the week gets ignored, not obeyed.
+	for i := 0; i < 7*24; i++ {
+		gmt := t.UTC()
+		if !h.skipHours[gmt.Hour()] && !h.skipDays[gmt.Weekday()] {
+			return t
+		}
+		t = gmt.Truncate(time.Hour).Add(time.Hour)
+	}
+	return t
+}
+
+// estimatePostingInterval returns the median gap between the most recent
+// dated items, or zero if there aren't enough of them to tell.
+func estimatePostingInterval(items []*documentItem) time.Duration {
+	dates := make([]time.Time, 0, len(items))
+	for _, item := range items {
+		if !item.Date.IsZero() {
+			dates = append(dates, item.Date)
+		}
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i].After(dates[j]) })
+	if len(dates) > postingSampleSize {
+		dates = dates[:postingSampleSize]
+	}
+	if len(dates) < 2 {
+		return 0
+	}
+
+	gaps := make([]time.Duration, len(dates)-1)
+	for i := range gaps {
+		gaps[i] = dates[i].Sub(dates[i+1])
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i] < gaps[j] })
+	return gaps[len(gaps)/2]
+}
+
+var syndicationPeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseDocumentHints pulls the channel-level scheduling elements out of an RSS
+// or Atom document. The rss package doesn't expose most of these, so we take
+// our own (lenient) pass over the XML, stopping at the first item.
+func parseDocumentHints(body []byte) documentHints {
+	h := documentHints{
+		skipHours: make(map[int]bool),
+		skipDays:  make(map[time.Weekday]bool),
+	}
+	period := time.Duration(0)
+	frequency := 1
+
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	dec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	var parents []string
+tokens:
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "item" || t.Name.Local == "entry" {
+				break tokens
+			}
+			parents = append(parents, t.Name.Local)
+		case xml.EndElement:
+			if len(parents) > 0 {
+				parents = parents[:len(parents)-1]
+			}
+		case xml.CharData:
+			if len(parents) == 0 {
+				break
+			}
+			text := strings.TrimSpace(string(t))
+			name := parents[len(parents)-1]
+			parent := ""
+			if len(parents) > 1 {
+				parent = parents[len(parents)-2]
+			}
+			switch {
+			case name == "ttl":
+				if minutes, err := strconv.Atoi(text); err == nil && minutes > 0 {
+					h.ttl = time.Duration(minutes) * time.Minute
+				}
+			case name == "updatePeriod":
+				period = syndicationPeriods[strings.ToLower(text)]
+			case name == "updateFrequency":
+				if n, err := strconv.Atoi(text); err == nil && n > 0 {
+					frequency = n
+				}
+			case name == "hour" && parent == "skipHours":
+				if hour, err := strconv.Atoi(text); err == nil {
+					h.skipHours[hour%24] = true
+				}
+			case name == "day" && parent == "skipDays":
+				if day, ok := weekdays[strings.ToLower(text)]; ok {
+					h.skipDays[day] = true
+				}
+			}
+		}
+	}
+
+	if period > 0 {
+		h.updatePeriod = period / time.Duration(frequency)
+	}
+	return h
+}
+
+// parseCacheExpiry returns when an HTTP response says its content goes stale,
+// preferring Cache-Control's max-age over Expires. Zero means "no idea".
+func parseCacheExpiry(header http.Header, now time.Time) time.Time {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, "max-age=") {
+			if seconds, err := strconv.Atoi(directive[len("max-age="):]); err == nil {
+				return now.Add(time.Duration(seconds) * time.Second)
+			}
+		}
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		return expires
+	}
+	return time.Time{}
+}
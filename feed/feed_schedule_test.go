@@ -0,0 +1,64 @@
+package feed
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+const hintedFeed = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:sy="http://purl.org/rss/1.0/modules/syndication/">
+<channel>
+	<title>Hinted</title>
+	<ttl>60</ttl>
+	<sy:updatePeriod>daily</sy:updatePeriod>
+	<sy:updateFrequency>4</sy:updateFrequency>
+	<skipHours><hour>1</hour><hour>2</hour></skipHours>
+	<skipDays><day>Sunday</day></skipDays>
+	<item><title>Not a channel element</title><ttl>5</ttl></item>
+</channel>
+</rss>`
+
+func TestParseDocumentHints(t *testing.T) {
+	h := parseDocumentHints([]byte(hintedFeed))
+	if h.ttl != time.Hour {
+		t.Error("Unexpected ttl: ", h.ttl)
+	}
+	if h.updatePeriod != 6*time.Hour {
+		t.Error("Unexpected update period: ", h.updatePeriod)
+	}
+	if !h.skipHours[1] || !h.skipHours[2] || h.skipHours[3] {
+		t.Error("Unexpected skipHours: ", h.skipHours)
+	}
+	if !h.skipDays[time.Sunday] || h.skipDays[time.Monday] {
+		t.Error("Unexpected skipDays: ", h.skipDays)
+	}
+}
+
+func TestNextPoll(t *testing.T) {
+	// A Saturday, just before midnight GMT.
+	now := time.Date(2016, time.May, 28, 23, 0, 0, 0, time.UTC)
+	s := pollScheduler{doc: parseDocumentHints([]byte(hintedFeed))}
+
+	// Six hours from now is Sunday, which is skipped entirely.
+	next := s.nextPoll(now, time.Time{})
+	if e := time.Date(2016, time.May, 30, 0, 0, 0, 0, time.UTC); !next.Equal(e) {
+		t.Error("Unexpected next poll: ", next, ", expected ", e)
+	}
+
+	// Cache headers asking for longer than the feed win, up to a limit.
+	monday := time.Date(2016, time.May, 30, 10, 0, 0, 0, time.UTC)
+	header := http.Header{}
+	header.Set("Cache-Control", "public, max-age=172800")
+	next = s.nextPoll(monday, parseCacheExpiry(header, monday))
+	if e := monday.Add(maxPollInterval); !next.Equal(e) {
+		t.Error("Unexpected next poll: ", next, ", expected ", e)
+	}
+
+	// The user's choice beats everything.
+	s.override = 5 * time.Minute
+	next = s.nextPoll(now, time.Time{})
+	if e := now.Add(5 * time.Minute); !next.Equal(e) {
+		t.Error("Unexpected next poll: ", next, ", expected ", e)
+	}
+}
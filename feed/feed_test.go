@@ -0,0 +1,921 @@
+package feed
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+// fakeClock only moves when told to. Every call to After is announced on
+// "waiting", which lets tests know when a feed has finished a poll.
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan time.Duration
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	fire     chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2016, time.May, 30, 12, 0, 0, 0, time.UTC),
+		waiting: make(chan time.Duration, 10),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	fire := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{c.now.Add(d), fire})
+	c.lock.Unlock()
+	c.waiting <- d
+	return fire
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.fire <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// fixtureServer serves a single document, which tests may swap out.
+type fixtureServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	body     string
+	status   int
+	etag     string
+	requests []*http.Request
+}
+
+func newFixtureServer(body string) *fixtureServer {
+	s := &fixtureServer{body: body, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.requests = append(s.requests, r)
+		if s.etag != "" {
+			if r.Header.Get("If-None-Match") == s.etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", s.etag)
+		}
+		w.WriteHeader(s.status)
+		w.Write([]byte(s.body))
+	}))
+	return s
+}
+
+func (s *fixtureServer) set(body string, status int, etag string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.body, s.status, s.etag = body, status, etag
+}
+
+func (s *fixtureServer) requestCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.requests)
+}
+
+func (s *fixtureServer) lastRequest() *http.Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+// useTempDataDir runs the test from an empty directory, so storage's "data/"
+// files don't leak between tests.
+func useTempDataDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// Resolved up front, since tests change directories.
+var fixtureDir, _ = filepath.Abs("../test_server/test_files")
+
+func readFixture(t *testing.T, name string) string {
+	body, err := ioutil.ReadFile(filepath.Join(fixtureDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// collectPoll gathers the items sent by a single poll. It returns once the
+// feed starts waiting for its next poll.
+func collectPoll(t *testing.T, itemPipe chan *storage.RssEntry, clock *fakeClock) []*storage.RssEntry {
+	var items []*storage.RssEntry
+	for {
+		select {
+		case item := <-itemPipe:
+			items = append(items, item)
+		case <-clock.waiting:
+			// Everything the poll found is already queued.
+			for len(itemPipe) > 0 {
+				items = append(items, <-itemPipe)
+			}
+			return items
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a poll to finish")
+		}
+	}
+}
+
+// newFixtureFeed makes a feed which fetches from server, on clock's time.
+func newFixtureFeed(server *fixtureServer, clock *fakeClock) *Feed {
+	return &Feed{
+		Fetcher:        server.Client(),
+		Clock:          clock,
+		FetchScheduler: MakeFetchScheduler(context.Background(), 1, 1, 0, clock),
+	}
+}
+
+func startFixtureFeed(t *testing.T, server *fixtureServer, clock *fakeClock) (*Feed, chan *storage.RssEntry) {
+	f := newFixtureFeed(server, clock)
+	itemPipe, err := f.Start(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.End)
+	return f, itemPipe
+}
+
+const newHNItem = `<item><title>A brand new story</title><link>http://example.com/new</link><pubDate>Mon, 30 May 2016 21:00:00 +0000</pubDate></item>`
+
+func TestFeedFirstFetchAndDedupe(t *testing.T) {
+	useTempDataDir(t)
+	hn := readFixture(t, "hn_rss.txt")
+	server := newFixtureServer(hn)
+	defer server.Close()
+	clock := newFakeClock()
+
+	f, itemPipe := startFixtureFeed(t, server, clock)
+	if f.GetTitle() != "Hacker News" {
+		t.Error("Unexpected title: ", f.GetTitle())
+	}
+
+	// First fetch: everything is new.
+	items := collectPoll(t, itemPipe, clock)
+	if e := strings.Count(hn, "<item>"); len(items) != e {
+		t.Fatal("Unexpected number of items: ", len(items), ", expected ", e)
+	}
+	if items[0].FeedTitle != "Hacker News" || items[0].ItemTitle != "Alan Kay's reading list for his students" {
+		t.Error("Unexpected first item: ", *items[0])
+	}
+
+	// Same document again: nothing is new.
+	clock.Advance(maxPollInterval)
+	if items = collectPoll(t, itemPipe, clock); len(items) != 0 {
+		t.Error("Repeated items were delivered: ", len(items))
+	}
+
+	// One new story shows up on a later poll.
+	server.set(strings.Replace(hn, "<item>", newHNItem+"<item>", 1), http.StatusOK, "")
+	clock.Advance(maxPollInterval)
+	items = collectPoll(t, itemPipe, clock)
+	if len(items) != 1 || items[0].ItemTitle != "A brand new story" {
+		t.Error("Expected only the new item, got ", items)
+	}
+}
+
+func TestFeedDedupeSurvivesRestart(t *testing.T) {
+	useTempDataDir(t)
+	server := newFixtureServer(readFixture(t, "hn_rss.txt"))
+	defer server.Close()
+
+	clock := newFakeClock()
+	f, itemPipe := startFixtureFeed(t, server, clock)
+	if items := collectPoll(t, itemPipe, clock); len(items) == 0 {
+		t.Fatal("Expected items on the first fetch")
+	}
+	f.End()
+
+	// A new Feed reads the same history from disk.
+	clock = newFakeClock()
+	_, itemPipe = startFixtureFeed(t, server, clock)
+	if items := collectPoll(t, itemPipe, clock); len(items) != 0 {
+		t.Error("Items were delivered again after a restart: ", len(items))
+	}
+}
+
+func TestFeedAdoptsHistoryKeyedByLink(t *testing.T) {
+	useTempDataDir(t)
+	hn := readFixture(t, "hn_rss.txt")
+	server := newFixtureServer(hn)
+	defer server.Close()
+
+	// Recorded back when items without GUIDs went by their link.
+	doc, err := parseDocument("", []byte(hn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := storage.MakeFeedStorage(doc.Title, 1000)
+	for _, item := range doc.Items {
+		history.Add(item.Link, fingerprint(item))
+	}
+
+	clock := newFakeClock()
+	_, itemPipe := startFixtureFeed(t, server, clock)
+	if items := collectPoll(t, itemPipe, clock); len(items) != 0 {
+		t.Error("Items were delivered again under their new keys: ", len(items))
+	}
+}
+
+func TestFeedNotModified(t *testing.T) {
+	useTempDataDir(t)
+	server := newFixtureServer(readFixture(t, "hn_rss.txt"))
+	defer server.Close()
+	server.set(readFixture(t, "hn_rss.txt"), http.StatusOK, `"v1"`)
+	clock := newFakeClock()
+
+	_, itemPipe := startFixtureFeed(t, server, clock)
+	collectPoll(t, itemPipe, clock)
+
+	clock.Advance(maxPollInterval)
+	if items := collectPoll(t, itemPipe, clock); len(items) != 0 {
+		t.Error("Items were delivered for a 304: ", len(items))
+	}
+	if etag := server.lastRequest().Header.Get("If-None-Match"); etag != `"v1"` {
+		t.Error("Unexpected If-None-Match: ", etag)
+	}
+}
+
+func TestFeedEndedMidPollFetchesAgain(t *testing.T) {
+	useTempDataDir(t)
+	hn := readFixture(t, "hn_rss.txt")
+	server := newFixtureServer(hn)
+	defer server.Close()
+	server.set(hn, http.StatusOK, `"v1"`)
+
+	// Nobody reads the items, so the poll stalls once the pipe is full.
+	f, itemPipe := startFixtureFeed(t, server, newFakeClock())
+	deadline := time.Now().Add(5 * time.Second)
+	for len(itemPipe) < cap(itemPipe) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the item pipe to fill")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	f.End()
+
+	// The rest of the document was never sent, so it mustn't be "not
+	// modified" now.
+	clock := newFakeClock()
+	_, itemPipe = startFixtureFeed(t, server, clock)
+	items := collectPoll(t, itemPipe, clock)
+	if e := strings.Count(hn, "<item>") - cap(itemPipe); len(items) != e {
+		t.Error("Unexpected number of items: ", len(items), ", expected ", e)
+	}
+}
+
+func TestFeedRetriesAfterError(t *testing.T) {
+	useTempDataDir(t)
+	hn := readFixture(t, "hn_rss.txt")
+	server := newFixtureServer(hn)
+	defer server.Close()
+	clock := newFakeClock()
+
+	f, itemPipe := startFixtureFeed(t, server, clock)
+	collectPoll(t, itemPipe, clock)
+
+	server.set("Service Unavailable", http.StatusServiceUnavailable, "")
+	clock.Advance(maxPollInterval)
+	select {
+	case feedErr := <-f.GetChanErrors():
+		if feedErr.State != FeedRetrying {
+			t.Error("Unexpected state: ", feedErr.State)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an error")
+	}
+	collectPoll(t, itemPipe, clock)
+	if state, _ := f.GetState(); state != FeedRetrying {
+		t.Error("Unexpected state: ", state)
+	}
+
+	// Once the server is back, new items flow again.
+	server.set(strings.Replace(hn, "<item>", newHNItem+"<item>", 1), http.StatusOK, "")
+	clock.Advance(retryBackoffCap)
+	if items := collectPoll(t, itemPipe, clock); len(items) != 1 {
+		t.Error("Expected only the new item, got ", len(items))
+	}
+	if state, err := f.GetState(); state != FeedHealthy || err != nil {
+		t.Error("Unexpected state: ", state, err)
+	}
+}
+
+func TestFeedStartFailsForUnknownBrokenFeed(t *testing.T) {
+	useTempDataDir(t)
+	server := newFixtureServer("Not Found")
+	defer server.Close()
+	server.set("Not Found", http.StatusNotFound, "")
+
+	f := newFixtureFeed(server, newFakeClock())
+	if _, err := f.Start(context.Background(), server.URL); err == nil {
+		t.Error("Expected Start to fail")
+	}
+}
+
+func TestFeedAuthentication(t *testing.T) {
+	useTempDataDir(t)
+	hn := readFixture(t, "hn_rss.txt")
+	server := newFixtureServer(hn)
+	defer server.Close()
+	clock := newFakeClock()
+	t.Setenv("TOY_RSS_TEST_TOKEN", "first")
+	settings := storage.RequestSettings{
+		Auth:      storage.FeedAuth{Kind: storage.AuthBearer, SecretSource: "env:TOY_RSS_TEST_TOKEN"},
+		Headers:   map[string]string{"X-Team": "feeds"},
+		UserAgent: "toy-rss-test",
+	}
+
+	f := newFixtureFeed(server, clock)
+	f.SetRequestSettings(settings)
+	itemPipe, err := f.Start(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.End()
+	collectPoll(t, itemPipe, clock)
+
+	req := server.lastRequest()
+	if auth := req.Header.Get("Authorization"); auth != "Bearer first" {
+		t.Error("Unexpected Authorization: ", auth)
+	}
+	if team := req.Header.Get("X-Team"); team != "feeds" {
+		t.Error("Unexpected X-Team: ", team)
+	}
+	if ua := req.UserAgent(); ua != "toy-rss-test" {
+		t.Error("Unexpected User-Agent: ", ua)
+	}
+
+	// The token expires.
+	server.set("Unauthorized", http.StatusUnauthorized, "")
+	clock.Advance(maxPollInterval)
+	select {
+	case feedErr := <-f.GetChanErrors():
+		if feedErr.State != FeedUnauthorized {
+			t.Error("Unexpected state: ", feedErr.State)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an error")
+	}
+	collectPoll(t, itemPipe, clock)
+
+	// Fixing the credentials retries right away, without waiting out the
+	// backoff.
+	server.set(hn, http.StatusOK, "")
+	t.Setenv("TOY_RSS_TEST_TOKEN", "second")
+	f.SetRequestSettings(settings)
+	collectPoll(t, itemPipe, clock)
+	if state, err := f.GetState(); state != FeedHealthy || err != nil {
+		t.Error("Unexpected state: ", state, err)
+	}
+	if auth := server.lastRequest().Header.Get("Authorization"); auth != "Bearer second" {
+		t.Error("Unexpected Authorization: ", auth)
+	}
+}
+
+func TestRedirectsKeepCredentials(t *testing.T) {
+	t.Setenv("TOY_RSS_TEST_TOKEN", "s3cret")
+	hn := readFixture(t, "hn_rss.txt")
+	elsewhere := newFixtureServer(hn)
+	defer elsewhere.Close()
+	toElsewhere := func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, elsewhere.URL+"/feed", http.StatusFound)
+	}
+	plain := httptest.NewServer(http.HandlerFunc(toElsewhere))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(toElsewhere))
+	defer secure.Close()
+
+	for _, from := range []*httptest.Server{plain, secure} {
+		f := &Feed{URL: from.URL, Fetcher: secure.Client(), ctx: context.Background()}
+		f.SetRequestSettings(storage.RequestSettings{
+			Auth:    storage.FeedAuth{Kind: storage.AuthBearer, SecretSource: "env:TOY_RSS_TEST_TOKEN"},
+			Headers: map[string]string{"X-Api-Key": "k"},
+		})
+		if _, err := f.fetchConditionally(storage.SavedValidators{}); err != nil {
+			t.Fatal("Unexpected error following a redirect from ", from.URL, ": ", err)
+		}
+		req := elsewhere.lastRequest()
+		for _, name := range []string{"Authorization", "X-Api-Key"} {
+			if value := req.Header.Get(name); value != "" {
+				t.Error("Redirect from ", from.URL, " leaked ", name, ": ", value)
+			}
+		}
+	}
+
+	// Staying on the server, the credentials are still needed.
+	mux := http.NewServeMux()
+	mux.Handle("/old", http.RedirectHandler("/new", http.StatusFound))
+	var auth string
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(hn))
+	})
+	same := httptest.NewServer(mux)
+	defer same.Close()
+	f := &Feed{URL: same.URL + "/old", Fetcher: same.Client(), ctx: context.Background()}
+	f.SetRequestSettings(storage.RequestSettings{Auth: storage.FeedAuth{Kind: storage.AuthBearer, SecretSource: "env:TOY_RSS_TEST_TOKEN"}})
+	if _, err := f.fetchConditionally(storage.SavedValidators{}); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer s3cret" {
+		t.Error("Unexpected Authorization after a redirect on the same server: ", auth)
+	}
+}
+
+func TestLeavesOrigin(t *testing.T) {
+	from, _ := url.Parse("https://example.com/feed")
+	for to, expected := range map[string]bool{
+		"https://example.com/new":       false,
+		"https://EXAMPLE.com/new":       false,
+		"http://example.com/new":        true,
+		"https://example.com:8443/new":  true,
+		"https://elsewhere.example/new": true,
+	} {
+		u, _ := url.Parse(to)
+		if leaves := leavesOrigin(from, u); leaves != expected {
+			t.Error("Unexpected leavesOrigin(", from, ", ", to, "): ", leaves, ", expected ", expected)
+		}
+	}
+}
+
+func TestFeedHealthAndRefresh(t *testing.T) {
+	useTempDataDir(t)
+	hn := readFixture(t, "hn_rss.txt")
+	server := newFixtureServer(hn)
+	defer server.Close()
+	clock := newFakeClock()
+
+	f, itemPipe := startFixtureFeed(t, server, clock)
+	items := collectPoll(t, itemPipe, clock)
+	health := f.GetHealth()
+	if health.LastStatusCode != http.StatusOK || !health.LastSuccess.Equal(clock.Now()) || health.LastNewItem != health.LastSuccess {
+		t.Error("Unexpected health after the first poll: ", health)
+	}
+	if e := strings.Count(hn, "<item>"); health.ItemCount != e || health.NewItemCount != len(items) {
+		t.Error("Unexpected item counts: ", health.ItemCount, health.NewItemCount, ", expected ", e, len(items))
+	}
+
+	// Refreshing doesn't wait for the feed to be due.
+	server.set("Service Unavailable", http.StatusServiceUnavailable, "")
+	f.Refresh()
+	<-f.GetChanErrors()
+	collectPoll(t, itemPipe, clock)
+	health = f.GetHealth()
+	if health.LastStatusCode != http.StatusServiceUnavailable || health.ConsecutiveFailures != 1 || health.LastErrorMessage == "" {
+		t.Error("Unexpected health after a failed poll: ", health)
+	}
+	if health.LastSuccess.IsZero() {
+		t.Error("The last success was forgotten")
+	}
+
+	// It's all on disk, for feeds that aren't running.
+	f.End()
+	if saved := storage.MakeHealthStorage(server.URL).Get(); saved.ConsecutiveFailures != 1 || saved.NewItemCount != len(items) {
+		t.Error("Unexpected saved health: ", saved)
+	}
+}
+
+func TestFeedRefreshDuringRetry(t *testing.T) {
+	useTempDataDir(t)
+	hn := readFixture(t, "hn_rss.txt")
+	server := newFixtureServer(hn)
+	defer server.Close()
+	clock := newFakeClock()
+
+	f, itemPipe := startFixtureFeed(t, server, clock)
+	collectPoll(t, itemPipe, clock)
+	server.set("Service Unavailable", http.StatusServiceUnavailable, "")
+	clock.Advance(maxPollInterval)
+	<-f.GetChanErrors()
+	collectPoll(t, itemPipe, clock)
+
+	// The refresh cuts the retry short, and is used up by it.
+	server.set(hn, http.StatusOK, "")
+	f.Refresh()
+	collectPoll(t, itemPipe, clock)
+	if n := server.requestCount(); n != 3 {
+		t.Error("Unexpected requests: ", n, ", expected 3")
+	}
+}
+
+func TestFeedUpdatedItems(t *testing.T) {
+	useTempDataDir(t)
+	hn := readFixture(t, "hn_rss.txt")
+	server := newFixtureServer(hn)
+	defer server.Close()
+	clock := newFakeClock()
+
+	_, itemPipe := startFixtureFeed(t, server, clock)
+	original := collectPoll(t, itemPipe, clock)[0]
+
+	// The first story's title is edited.
+	edited := strings.Replace(hn, "reading list for his students", "reading list (updated)", 1)
+	server.set(edited, http.StatusOK, "")
+	clock.Advance(maxPollInterval)
+	items := collectPoll(t, itemPipe, clock)
+	if len(items) != 1 {
+		t.Fatal("Expected only the edited item, got ", len(items))
+	}
+	if !items[0].Updated || items[0].ItemID != original.ItemID || items[0].ItemTitle != "Alan Kay's reading list (updated)" {
+		t.Error("Unexpected updated item: ", *items[0])
+	}
+
+	// Once is enough.
+	clock.Advance(maxPollInterval)
+	if items = collectPoll(t, itemPipe, clock); len(items) != 0 {
+		t.Error("The edit was delivered again: ", len(items))
+	}
+}
+
+// churningRSS is a feed whose GUIDs (and tracking parameters) change on every
+// poll, even though its stories don't.
+func churningRSS(poll string, stories ...string) string {
+	body := `<?xml version="1.0"?><rss version="2.0"><channel><title>Churn</title><link>http://example.com/</link><description>IDs change</description>`
+	for _, story := range stories {
+		body += `<item><title>` + story + `</title><guid>` + poll + `-` + story + `</guid>` +
+			`<link>http://example.com/` + story + `?utm_source=` + poll + `</link></item>`
+	}
+	return body + `</channel></rss>`
+}
+
+func TestFeedSwitchesDedupeWhenIDsChurn(t *testing.T) {
+	useTempDataDir(t)
+	server := newFixtureServer(churningRSS("one", "a", "b", "c"))
+	defer server.Close()
+	clock := newFakeClock()
+
+	f := newFixtureFeed(server, clock)
+	f.SetDedupeStrategy(storage.DedupeAuto, "")
+	itemPipe, err := f.Start(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal("Unexpected error starting feed: ", err)
+	}
+	defer f.End()
+	if items := collectPoll(t, itemPipe, clock); len(items) != 3 {
+		t.Fatal("Unexpected number of items: ", len(items), ", expected 3")
+	}
+
+	// Same stories, new IDs: nothing is delivered, and the feed stops
+	// trusting its IDs.
+	server.set(churningRSS("two", "a", "b", "c"), http.StatusOK, "")
+	clock.Advance(maxPollInterval)
+	if items := collectPoll(t, itemPipe, clock); len(items) != 0 {
+		t.Error("Churned items were delivered again: ", len(items))
+	}
+	select {
+	case strategy := <-f.GetChanDedupe():
+		if strategy != storage.DedupeNormalizedLink {
+			t.Error("Unexpected strategy: ", strategy, ", expected ", storage.DedupeNormalizedLink)
+		}
+	default:
+		t.Error("The switch of strategy was not reported")
+	}
+
+	// From then on, only really new stories get through.
+	server.set(churningRSS("three", "a", "b", "c", "d"), http.StatusOK, "")
+	clock.Advance(maxPollInterval)
+	items := collectPoll(t, itemPipe, clock)
+	if len(items) != 1 || items[0].ItemTitle != "d" {
+		t.Error("Expected only the new item, got ", items)
+	}
+}
+
+func TestFeedStopsWhenContextCancelled(t *testing.T) {
+	useTempDataDir(t)
+	server := newFixtureServer(readFixture(t, "hn_rss.txt"))
+	defer server.Close()
+	clock := newFakeClock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := newFixtureFeed(server, clock)
+	itemPipe, err := f.Start(ctx, server.URL)
+	if err != nil {
+		t.Fatal("Unexpected error starting feed: ", err)
+	}
+	collectPoll(t, itemPipe, clock)
+
+	cancel()
+	select {
+	case _, ok := <-itemPipe:
+		if ok {
+			t.Error("Unexpected item after cancelling")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The item pipe was never closed")
+	}
+	// Already stopped, so this returns right away.
+	f.End()
+}
+
+func TestFeedStartCancelledMidFetch(t *testing.T) {
+	useTempDataDir(t)
+	requested := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		// Hangs until the client gives up.
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Feed{Fetcher: server.Client(), FetchScheduler: MakeFetchScheduler(context.Background(), 1, 1, 0, nil)}
+	started := make(chan error)
+	go func() {
+		_, err := f.Start(ctx, server.URL)
+		started <- err
+	}()
+
+	<-requested
+	cancel()
+	select {
+	case err := <-started:
+		if err == nil {
+			t.Error("Expected Start to fail once cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after cancelling")
+	}
+}
+
+// Run with -race; the feed is read and configured from other goroutines
+// while it polls.
+func TestFeedSpreadsFirstPoll(t *testing.T) {
+	useTempDataDir(t)
+	server := newFixtureServer(readFixture(t, "hn_rss.txt"))
+	defer server.Close()
+	clock := newFakeClock()
+
+	f := &Feed{
+		Fetcher:         server.Client(),
+		Clock:           clock,
+		FetchScheduler:  MakeFetchScheduler(context.Background(), 1, 1, time.Hour, clock),
+		SpreadFirstPoll: true,
+	}
+	started := make(chan error, 1)
+	go func() {
+		_, err := f.Start(context.Background(), server.URL)
+		started <- err
+	}()
+	defer f.End()
+
+	select {
+	case <-clock.waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The first poll wasn't put off")
+	}
+	if n := server.requestCount(); n != 0 {
+		t.Error("Unexpected requests before the first poll was due: ", n)
+	}
+	clock.Advance(time.Hour)
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal("Unexpected error starting: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start never returned")
+	}
+	if n := server.requestCount(); n != 1 {
+		t.Error("Unexpected number of requests: ", n, ", expected 1")
+	}
+}
+
+func TestFeedConcurrentAccess(t *testing.T) {
+	useTempDataDir(t)
+	server := newFixtureServer(readFixture(t, "hn_rss.txt"))
+	defer server.Close()
+	clock := newFakeClock()
+	f, itemPipe := startFixtureFeed(t, server, clock)
+
+	stop := make(chan bool)
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f.GetTitle()
+				f.GetState()
+				f.GetHealth()
+				f.GetMetadata()
+				f.SetRefreshInterval(0)
+				f.SetDedupeStrategy(storage.DedupeAuto, "")
+			}
+		}()
+	}
+	for poll := 0; poll < 5; poll++ {
+		collectPoll(t, itemPipe, clock)
+		clock.Advance(maxPollInterval)
+	}
+	close(stop)
+	readers.Wait()
+	if f.GetTitle() != "Hacker News" {
+		t.Error("Unexpected title: ", f.GetTitle())
+	}
+}
+
+// redirectServer serves the fixture at /new, redirecting /old there with
+// status, and counts requests for /old.
+func redirectServer(t *testing.T, status int) (*httptest.Server, *int32) {
+	hn := readFixture(t, "hn_rss.txt")
+	var oldRequests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&oldRequests, 1)
+		http.Redirect(w, r, "/new", status)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(hn))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &oldRequests
+}
+
+func TestFeedFollowsPermanentRedirect(t *testing.T) {
+	for _, status := range []int{http.StatusMovedPermanently, http.StatusPermanentRedirect} {
+		useTempDataDir(t)
+		server, oldRequests := redirectServer(t, status)
+		clock := newFakeClock()
+		f := &Feed{Fetcher: server.Client(), Clock: clock, FetchScheduler: MakeFetchScheduler(context.Background(), 1, 1, 0, clock)}
+		itemPipe, err := f.Start(context.Background(), server.URL+"/old")
+		if err != nil {
+			t.Fatal(err)
+		}
+		collectPoll(t, itemPipe, clock)
+
+		select {
+		case move := <-f.GetChanMoved():
+			if move.From != server.URL+"/old" || move.To != server.URL+"/new" {
+				t.Error("Unexpected move after ", status, ": ", move)
+			}
+		default:
+			t.Error("No move reported after ", status)
+		}
+		if URL := f.GetURL(); URL != server.URL+"/new" {
+			t.Error("Unexpected URL after ", status, ": ", URL, ", expected ", server.URL+"/new")
+		}
+		if validators := storage.MakeValidatorStorage(server.URL + "/new").Get(); validators.ETag != `"v1"` {
+			t.Error("Validators didn't move after ", status, ": ", validators)
+		}
+		if validators := storage.MakeValidatorStorage(server.URL + "/old").Get(); validators.ETag != "" {
+			t.Error("Validators left behind after ", status, ": ", validators)
+		}
+
+		// The dedupe history stays, and the old URL is left alone.
+		clock.Advance(maxPollInterval)
+		if items := collectPoll(t, itemPipe, clock); len(items) != 0 {
+			t.Error("Items were delivered again after moving: ", len(items))
+		}
+		if n := atomic.LoadInt32(oldRequests); n != 1 {
+			t.Error("Unexpected requests to the old URL after ", status, ": ", n, ", expected 1")
+		}
+		f.End()
+	}
+}
+
+func TestFeedKeepsCredentialsOnItsHost(t *testing.T) {
+	useTempDataDir(t)
+	elsewhere := newFixtureServer(readFixture(t, "hn_rss.txt"))
+	defer elsewhere.Close()
+	var oldRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&oldRequests, 1)
+		http.Redirect(w, r, elsewhere.URL+"/feed", http.StatusMovedPermanently)
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	f := &Feed{Fetcher: server.Client(), Clock: clock, FetchScheduler: MakeFetchScheduler(context.Background(), 1, 1, 0, clock)}
+	f.SetRequestSettings(storage.RequestSettings{Headers: map[string]string{"X-Api-Key": "secret"}})
+	itemPipe, err := f.Start(context.Background(), server.URL+"/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.End()
+	collectPoll(t, itemPipe, clock)
+
+	select {
+	case move := <-f.GetChanMoved():
+		if !move.Declined || move.To != elsewhere.URL+"/feed" {
+			t.Error("Unexpected move to another host: ", move)
+		}
+	default:
+		t.Error("Declined move wasn't reported")
+	}
+	if URL := f.GetURL(); URL != server.URL+"/old" {
+		t.Error("Unexpected URL after a move to another host: ", URL, ", expected ", server.URL+"/old")
+	}
+	if key := elsewhere.lastRequest().Header.Get("X-Api-Key"); key != "" {
+		t.Error("The redirect carried the feed's headers to another host: ", key)
+	}
+
+	// Still polled where the credentials belong, and only reported once.
+	clock.Advance(maxPollInterval)
+	collectPoll(t, itemPipe, clock)
+	if n := atomic.LoadInt32(&oldRequests); n != 2 {
+		t.Error("Unexpected requests to the old URL: ", n, ", expected 2")
+	}
+	select {
+	case move := <-f.GetChanMoved():
+		t.Error("Declined move was reported again: ", move)
+	default:
+	}
+}
+
+func TestSafeToMove(t *testing.T) {
+	f := &Feed{URL: "https://example.com/old"}
+	if !f.safeToMove("http://elsewhere.com/new") {
+		t.Error("A feed without credentials wasn't allowed to move")
+	}
+	f.SetRequestSettings(storage.RequestSettings{Auth: storage.FeedAuth{Kind: storage.AuthBearer, SecretSource: "env:TOKEN"}})
+	for URL, expected := range map[string]bool{
+		"https://example.com/new":   true,
+		"https://EXAMPLE.com/new":   true,
+		"http://example.com/new":    false,
+		"https://elsewhere.com/new": false,
+	} {
+		if safe := f.safeToMove(URL); safe != expected {
+			t.Error("Unexpected safeToMove(", URL, "): ", safe, ", expected ", expected)
+		}
+	}
+}
+
+func TestFeedForgetsTemporaryRedirect(t *testing.T) {
+	useTempDataDir(t)
+	server, oldRequests := redirectServer(t, http.StatusFound)
+	clock := newFakeClock()
+	f := &Feed{Fetcher: server.Client(), Clock: clock, FetchScheduler: MakeFetchScheduler(context.Background(), 1, 1, 0, clock)}
+	itemPipe, err := f.Start(context.Background(), server.URL+"/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.End()
+	collectPoll(t, itemPipe, clock)
+	clock.Advance(maxPollInterval)
+	collectPoll(t, itemPipe, clock)
+
+	select {
+	case move := <-f.GetChanMoved():
+		t.Error("Unexpected move after a temporary redirect: ", move)
+	default:
+	}
+	if URL := f.GetURL(); URL != server.URL+"/old" {
+		t.Error("Unexpected URL after a temporary redirect: ", URL)
+	}
+	if n := atomic.LoadInt32(oldRequests); n != 2 {
+		t.Error("Unexpected requests to the old URL: ", n, ", expected 2")
+	}
+}
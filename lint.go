@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/smklein/toy-rss/feed"
+)
+
+// runLint checks each feed named in args (URLs or files), printing a report
+// on each to out. It returns the exit status: 1 if any feed has errors, 2 if
+// there was nothing to check.
+func runLint(ctx context.Context, args []string, limits feed.FetchLimits, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(out, "Usage: toy-rss [flags] lint <url-or-file>...")
+		return 2
+	}
+	status := 0
+	for _, target := range args {
+		report := feed.Lint(ctx, target, limits)
+		printLintReport(report, out)
+		if report.Errors() > 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+func printLintReport(report *feed.LintReport, out io.Writer) {
+	fmt.Fprint(out, report.Target+": ")
+	if report.Title != "" {
+		fmt.Fprint(out, "\""+report.Title+"\", ")
+	}
+	fmt.Fprintln(out, plural(report.Items, "item"))
+	for _, p := range report.Problems {
+		where := "feed"
+		if p.Item != 0 {
+			where = "item " + strconv.Itoa(p.Item)
+			if p.ItemTitle != "" {
+				where += " (\"" + p.ItemTitle + "\")"
+			}
+		}
+		fmt.Fprintln(out, "  "+p.Severity.String()+": "+where+": "+p.Message)
+	}
+	fmt.Fprintln(out, "  "+plural(report.Errors(), "error")+", "+plural(report.Warnings(), "warning"))
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return strconv.Itoa(n) + " " + noun + "s"
+}
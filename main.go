@@ -1,38 +1,369 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/smklein/toy-rss/download"
 	"github.com/smklein/toy-rss/feed"
 	"github.com/smklein/toy-rss/storage"
 	"github.com/smklein/toy-rss/view"
 )
 
-func handleFeed(feed *feed.Feed, itemPipe chan *storage.RssEntry, newItemRequest chan *storage.RssEntry) {
-	log.Println("HANDLE FEED: ", feed.GetTitle())
+// Subscriptions for a brand-new install.
+// TODO(smklein): Use default colors
+var defaultFeedURLs = []string{
+	"http://feeds.arstechnica.com/arstechnica/index",
+	"https://news.ycombinator.com/rss",
+	"https://lwn.net/headlines/rss",
+	"http://feeds.feedburner.com/linuxjournalcom?format=xml",
+	"http://preshing.com/feed",
+	//"https://www.reddit.com/.rss",
+}
+
+var downloadDir = flag.String("download-dir", "downloads", "Where enclosures (like podcast episodes) are downloaded to")
+var downloadConcurrency = flag.Int("download-concurrency", 2, "How many enclosures to download at once")
+var maxFetches = flag.Int("max-fetches", 8, "How many feeds to fetch at once")
+var maxFetchesPerHost = flag.Int("max-fetches-per-host", 2, "How many feeds to fetch at once from any one server")
+var connectTimeout = flag.Duration("connect-timeout", feed.DefaultConnectTimeout, "How long to wait for a feed's server to accept a connection")
+var readTimeout = flag.Duration("read-timeout", feed.DefaultReadTimeout, "How long to wait for a feed's server to send more, once connected")
+var maxFeedSize = flag.Int64("max-feed-size", feed.DefaultMaxBodySize, "The largest feed, in bytes once decompressed, to accept")
+var maxDownloadSize = flag.Int64("max-download-size", download.DefaultMaxSize, "The largest enclosure, in bytes, to download")
+var timezone = flag.String("timezone", "", "Which timezone (like \"Europe/Paris\") to show dates in; the local one by default")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "How long to wait for feeds to stop when quitting")
+
+// runningFeed is a started feed, along with the handleFeed goroutine
+// forwarding its items.
+type runningFeed struct {
+	feed feed.FeedInterface
+	// Closed once handleFeed has forwarded the feed's last item.
+	handlerDone chan bool
+}
+
+func handleFeed(f feed.FeedInterface, itemPipe chan *storage.RssEntry, newItemRequest chan *storage.RssEntry, movedFeeds chan feed.FeedMove, subscriptions *storage.SubscriptionStorage, v view.ViewInterface, handlerDone chan bool) {
+	defer close(handlerDone)
+	log.Println("HANDLE FEED: ", f.GetTitle())
+	errorPipe := f.GetChanErrors()
+	metadataPipe := f.GetChanMetadata()
+	dedupePipe := f.GetChanDedupe()
+	movedPipe := f.GetChanMoved()
 	numReceived := 0
 	for {
-		item, ok := <-itemPipe
-		if !ok {
-			// TODO(smklein): handle removing feed here
-			return
+		select {
+		case item, ok := <-itemPipe:
+			if !ok {
+				// The feed has ended (see removeFeed).
+				return
+			}
+			numReceived++
+			log.Println("   ", numReceived, item.ItemTitle)
+			newItemRequest <- item
+		case feedErr, ok := <-errorPipe:
+			if !ok {
+				// Closed alongside the itemPipe; stop selecting on it.
+				errorPipe = nil
+				continue
+			}
+			v.SetStatus(view.StatusMsgStruct{Message: feedErr.Error(), Type: view.StatusError})
+		case metadata, ok := <-metadataPipe:
+			if !ok {
+				metadataPipe = nil
+				continue
+			}
+			v.SetChannelMetadata(f.GetTitle(), metadata)
+		case strategy, ok := <-dedupePipe:
+			if !ok {
+				dedupePipe = nil
+				continue
+			}
+			// Remembered, so the feed doesn't have to work it out again.
+			subscriptions.UpdateSettings(f.GetURL(), func(settings *storage.FeedSettings) {
+				settings.DetectedDedupe = strategy
+			})
+			v.SetStatus(view.StatusMsgStruct{Message: "IDs of [" + f.GetTitle() + "] keep changing; telling items apart by " + strategy, Type: view.StatusInfo})
+		case move, ok := <-movedPipe:
+			if !ok {
+				movedPipe = nil
+				continue
+			}
+			// Only main may re-key its feeds. It may be busy waiting for us
+			// to finish, so don't wait for it.
+			go func() {
+				select {
+				case movedFeeds <- move:
+				case <-handlerDone:
+				}
+			}()
 		}
-		numReceived++
-		log.Println("   ", numReceived, item.ItemTitle)
-		newItemRequest <- item
 	}
 }
 
-func addFeed(URL string, newItemRequest chan *storage.RssEntry) (feed.FeedInterface, error) {
-	feed := &feed.Feed{}
-	itemPipe, err := feed.Start(URL)
+// startFeed makes a feed for URL and starts it, which takes until its first
+// poll is over.
+func startFeed(ctx context.Context, URL string, settings storage.FeedSettings, spread bool, fetchScheduler *feed.FetchScheduler, limits feed.FetchLimits) (*feed.Feed, chan *storage.RssEntry, error) {
+	f := &feed.Feed{FetchScheduler: fetchScheduler, Limits: limits, SpreadFirstPoll: spread}
+	f.SetRefreshInterval(settings.RefreshInterval)
+	f.SetRequestSettings(settings.Request)
+	f.SetDedupeStrategy(settings.Dedupe, settings.DetectedDedupe)
+	itemPipe, err := f.Start(ctx, URL)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	go handleFeed(feed, itemPipe, newItemRequest)
-	return feed, nil
+	return f, itemPipe, nil
+}
+
+// startedFeed is a feed whose first poll is over, one way or another.
+type startedFeed struct {
+	URL, name, folder string
+	feed              *feed.Feed
+	itemPipe          chan *storage.RssEntry
+	err               error
+	// Says how it went; see subscribe.
+	report func(*runningFeed, error) view.StatusMsgStruct
+}
+
+// reader is everything main is in charge of: the running feeds, and the
+// subscriptions behind them. Only main's goroutine may touch it.
+type reader struct {
+	feedMap       map[string]*runningFeed /* URL --> Feed */
+	subscriptions *storage.SubscriptionStorage
+	// Feeds queued up by ":import", waiting for their turn to be added.
+	pendingImports map[string]*pendingImport /* URL --> Import */
+	// Feeds found on the last web page the user entered, for ":pick".
+	discovered []feed.Candidate
+	discoverer *feed.Discoverer
+	// What was found at URLs the user entered, looked for in the background.
+	discoveries chan discovery
+	downloads   *download.Queue
+	// Feeds whose first poll is underway, off main's goroutine, and where
+	// they go once it's over.
+	starting     map[string]bool /* URL */
+	startedFeeds chan startedFeed
+	// Waited for by shutdown, since those feeds aren't in feedMap yet.
+	starters sync.WaitGroup
+	// Shared by every feed, so they don't all fetch at once.
+	fetchScheduler *feed.FetchScheduler
+	fetchLimits    feed.FetchLimits
+	// Feeds stop when this is cancelled.
+	ctx context.Context
+
+	newItemRequest chan *storage.RssEntry
+	newFeedRequest chan string
+	// Feeds which have moved for good, waiting to be re-keyed.
+	movedFeeds chan feed.FeedMove
+	v          view.ViewInterface
+}
+
+// discovery is what was found at a URL the user entered.
+type discovery struct {
+	candidates []feed.Candidate
+	err        error
+}
+
+// queueNewFeeds adds subscriptions in the background, one at a time, through
+// the same path as URLs the user types in.
+func (r *reader) queueNewFeeds(subs []storage.Subscription) {
+	go func() {
+		for _, sub := range subs {
+			select {
+			case r.newFeedRequest <- sub.URL:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// subscribe starts polling URL, and once the first poll has worked,
+// remembers it for next time. If name is empty, the feed's title is used
+// instead. The first poll waits its turn like any other, so it happens in the
+// background; report says how it went, once main has taken the feed on (or
+// not). With spread, the first poll may wait a while longer, so feeds started
+// together don't keep polling together.
+func (r *reader) subscribe(URL, name, folder string, spread bool, report func(*runningFeed, error) view.StatusMsgStruct) error {
+	if _, ok := r.feedMap[URL]; ok || r.starting[URL] {
+		return errors.New("Already subscribed to " + URL)
+	}
+	sub, _ := r.subscriptions.Get(URL)
+	r.starting[URL] = true
+	r.starters.Add(1)
+	go func() {
+		defer r.starters.Done()
+		f, itemPipe, err := startFeed(r.ctx, URL, sub.Settings, spread, r.fetchScheduler, r.fetchLimits)
+		select {
+		case r.startedFeeds <- startedFeed{URL: URL, name: name, folder: folder, feed: f, itemPipe: itemPipe, err: err, report: report}:
+		case <-r.ctx.Done():
+			if err == nil {
+				// Nobody is left to take it on.
+				f.End()
+			}
+		}
+	}()
+	return nil
+}
+
+// finishSubscribing takes on a feed whose first poll is over, if it worked,
+// and tells the user how it went.
+func (r *reader) finishSubscribing(s startedFeed) {
+	delete(r.starting, s.URL)
+	var rf *runningFeed
+	if s.err == nil {
+		rf = &runningFeed{feed: s.feed, handlerDone: make(chan bool)}
+		go handleFeed(s.feed, s.itemPipe, r.newItemRequest, r.movedFeeds, r.subscriptions, r.v, rf.handlerDone)
+		title := s.feed.GetTitle()
+		name := s.name
+		if name == "" {
+			name = title
+		}
+		r.v.AddChannelInfo(title)
+		if sub, _ := r.subscriptions.Get(s.URL); sub.Name != "" && sub.Name != title {
+			// Renamed while it wasn't running.
+			r.v.SetChannelDisplayName(title, sub.Name)
+		}
+		r.feedMap[s.URL] = rf
+		r.subscriptions.Add(s.URL, name, s.folder)
+	}
+	if status := s.report(rf, s.err); status.Message != "" {
+		r.v.SetStatus(status)
+	}
+}
+
+// reportAdded says how subscribing to a feed the user asked for went.
+func reportAdded(rf *runningFeed, err error) view.StatusMsgStruct {
+	if err != nil {
+		return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+	}
+	return view.StatusMsgStruct{Message: "Added Feed [" + rf.feed.GetTitle() + "]", Type: view.StatusSuccess}
+}
+
+// restoreSubscriptions starts up everything we were subscribed to last time.
+func (r *reader) restoreSubscriptions() {
+	for _, sub := range r.subscriptions.GetAll() {
+		if err := r.subscribe(sub.URL, "", "", true, reportAdded); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// moveFeed follows a feed to its new URL: it's subscribed to, and found,
+// under that from now on. If the new URL was already subscribed to, the old
+// subscription is dropped instead. A declined move changes nothing, but the
+// user is told.
+func (r *reader) moveFeed(move feed.FeedMove) view.StatusMsgStruct {
+	rf, ok := r.feedMap[move.From]
+	if !ok {
+		// Removed in the meantime.
+		return view.StatusMsgStruct{}
+	}
+	title := rf.feed.GetTitle()
+	if move.Declined {
+		return view.StatusMsgStruct{Message: "[" + title + "] moved to " + move.To + ", where its credentials aren't safe to send; still polling the old URL. Subscribe to the new one if you trust it", Type: view.StatusError}
+	}
+	delete(r.feedMap, move.From)
+	if _, ok := r.feedMap[move.To]; ok {
+		rf.feed.End()
+		<-rf.handlerDone
+		r.subscriptions.Remove(move.From)
+		return view.StatusMsgStruct{Message: "[" + title + "] moved to " + move.To + ", which you already follow; dropped the old subscription", Type: view.StatusInfo}
+	}
+	r.feedMap[move.To] = rf
+	r.subscriptions.Move(move.From, move.To)
+	return view.StatusMsgStruct{Message: "[" + title + "] moved to " + move.To, Type: view.StatusInfo}
+}
+
+func (r *reader) handleNewFeedRequest(URL string) {
+	if pending, ok := r.pendingImports[URL]; ok {
+		delete(r.pendingImports, URL)
+		// Kept even if it doesn't work yet, like the rest of the file.
+		r.subscriptions.Add(URL, pending.entry.Title, pending.entry.Folder)
+		err := r.subscribe(URL, pending.entry.Title, pending.entry.Folder, false, func(rf *runningFeed, err error) view.StatusMsgStruct {
+			return pending.imp.finish(URL, err)
+		})
+		if err != nil {
+			r.v.SetStatus(pending.imp.finish(URL, err))
+		}
+		return
+	}
+
+	// We've never seen this URL; it might be a web page rather than a feed.
+	// Looking can take a while, so it's done in the background.
+	if _, ok := r.subscriptions.Get(URL); !ok {
+		go func() {
+			candidates, err := r.discoverer.Discover(r.ctx, URL)
+			select {
+			case r.discoveries <- discovery{candidates: candidates, err: err}:
+			case <-r.ctx.Done():
+			}
+		}()
+		r.v.SetStatus(view.StatusMsgStruct{Message: "Looking for feeds at " + URL, Type: view.StatusInfo})
+		return
+	}
+	r.v.SetStatus(r.addNewFeed(URL))
+}
+
+// handleDiscovery subscribes to the feed found at a URL the user entered, or
+// lets them pick if there were several.
+func (r *reader) handleDiscovery(d discovery) {
+	if d.err != nil {
+		r.v.SetStatus(view.StatusMsgStruct{Message: d.err.Error(), Type: view.StatusError})
+		return
+	}
+	if len(d.candidates) > 1 {
+		r.discovered = d.candidates
+		r.v.SetStatus(r.describeDiscovered())
+		return
+	}
+	r.v.SetStatus(r.addNewFeed(d.candidates[0].URL))
+}
+
+// addNewFeed subscribes to a feed the user asked for.
+func (r *reader) addNewFeed(URL string) view.StatusMsgStruct {
+	if err := r.subscribe(URL, "", "", false, reportAdded); err != nil {
+		return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+	}
+	return view.StatusMsgStruct{Message: "Adding " + URL, Type: view.StatusInfo}
+}
+
+// queueDownload downloads the item's first enclosure: the one the view shows.
+func (r *reader) queueDownload(item storage.RssEntry) view.StatusMsgStruct {
+	path, err := r.downloads.Add(item.Enclosures[0].URL, item.FeedTitle)
+	if err != nil {
+		return view.StatusMsgStruct{Message: err.Error(), Type: view.StatusError}
+	}
+	return view.StatusMsgStruct{Message: "Queued download to " + path, Type: view.StatusInfo}
+}
+
+// downloadStatus reports how a download is going.
+func downloadStatus(p download.Progress) view.StatusMsgStruct {
+	status := view.StatusMsgStruct{Message: p.String(), Type: view.StatusInfo}
+	if p.Err != nil {
+		status.Type = view.StatusError
+	} else if p.Done {
+		status.Type = view.StatusSuccess
+	}
+	return status
+}
+
+// describeDiscovered lists the candidates for ":pick".
+func (r *reader) describeDiscovered() view.StatusMsgStruct {
+	msg := "Found " + strconv.Itoa(len(r.discovered)) + " feeds, :pick one:"
+	for i, c := range r.discovered {
+		msg += " [" + strconv.Itoa(i+1) + "] "
+		if c.Title != "" {
+			msg += c.Title + " "
+		}
+		msg += c.URL
+	}
+	return view.StatusMsgStruct{Message: msg, Type: view.StatusInfo}
 }
 
 // Set up logging info.
@@ -48,40 +379,143 @@ func initLog() *os.File {
 	return f
 }
 
+// shutdown waits for everything to stop, in an order which loses nothing:
+// feeds first (ctx must already be cancelled), so the items they sent last
+// reach the view, then the view, once it has stored them. Gives up after
+// timeout, so a stuck feed can't keep the reader from quitting.
+func (r *reader) shutdown(timeout time.Duration) error {
+	stopped := make(chan bool)
+	go func() {
+		r.starters.Wait()
+		for _, rf := range r.feedMap {
+			rf.feed.End()
+			<-rf.handlerDone
+		}
+		// Nobody is left to send items.
+		close(r.newItemRequest)
+		<-r.v.Done()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("Shutdown: gave up waiting after " + timeout.String())
+	}
+}
+
+// loadTimezone finds the named timezone, or the local one if name is empty.
+// (time.LoadLocation takes "" to mean UTC.)
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// fetchLimits gathers the limits set by flags.
+func fetchLimits() feed.FetchLimits {
+	return feed.FetchLimits{
+		ConnectTimeout: *connectTimeout,
+		ReadTimeout:    *readTimeout,
+		MaxBodySize:    *maxFeedSize,
+	}
+}
+
+// downloadLimits gathers the limits set by flags, for enclosures.
+func downloadLimits() download.Limits {
+	return download.Limits{
+		ConnectTimeout: *connectTimeout,
+		ReadTimeout:    *readTimeout,
+		MaxSize:        *maxDownloadSize,
+	}
+}
+
 func main() {
+	flag.Parse()
+	if flag.Arg(0) == "lint" {
+		// Not interactive; nothing to set up.
+		os.Exit(runLint(context.Background(), flag.Args()[1:], fetchLimits(), os.Stdout))
+	}
+	loc, err := loadTimezone(*timezone)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unknown timezone: "+err.Error())
+		os.Exit(2)
+	}
 	logFile := initLog()
 	defer logFile.Close()
 
-	feedMap := make(map[string]feed.FeedInterface)
+	// Cancelled when it's time to quit: by the user, or by a signal.
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer cancel()
+
 	// Serialize new items
 	newItemRequest := make(chan *storage.RssEntry, 100)
 	newFeedRequest := make(chan string)
-
-	// DeathCountWg can be used by main.
-	// Add one if you need to run something before you die.
-	var deathWg sync.WaitGroup
-	// Waiting for
-	// 1) tb to close in view.
-	deathWg.Add(1)
+	commandRequest := make(chan view.Command)
 
 	v := view.GetView()
-	v.Start(newItemRequest, newFeedRequest, &deathWg)
+	v.SetTimezone(loc)
+	v.Start(ctx, newItemRequest, newFeedRequest, commandRequest)
+	go func() {
+		select {
+		case <-v.GetChanExitRequest():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	r := &reader{
+		feedMap:        make(map[string]*runningFeed),
+		subscriptions:  storage.MakeSubscriptionStorage("SUBSCRIPTIONS", defaultFeedURLs),
+		pendingImports: make(map[string]*pendingImport),
+		downloads:      download.MakeQueue(ctx, *downloadDir, *downloadConcurrency, downloadLimits(), nil),
+		fetchScheduler: feed.MakeFetchScheduler(ctx, *maxFetches, *maxFetchesPerHost, time.Minute, nil),
+		discoverer:     &feed.Discoverer{Limits: fetchLimits()},
+		discoveries:    make(chan discovery),
+		starting:       make(map[string]bool),
+		startedFeeds:   make(chan startedFeed),
+		fetchLimits:    fetchLimits(),
+		ctx:            ctx,
+		newItemRequest: newItemRequest,
+		newFeedRequest: newFeedRequest,
+		movedFeeds:     make(chan feed.FeedMove),
+		v:              v,
+	}
+
+	r.restoreSubscriptions()
 	// TODO(smklein): I find this loop kinda weird. What IS and ISN'T main in
 	// charge of handling?
 	for {
 		select {
 		case newURL := <-newFeedRequest:
-			f, err := addFeed(newURL, newItemRequest)
-			if err != nil {
-				v.SetStatus(view.StatusMsgStruct{err.Error(), view.StatusError})
-			} else {
-				v.SetStatus(view.StatusMsgStruct{"Added Feed [" + f.GetTitle() + "]", view.StatusSuccess})
-				v.AddChannelInfo(f.GetTitle())
-				feedMap[newURL] = f
+			r.handleNewFeedRequest(newURL)
+			v.Redraw()
+		case d := <-r.discoveries:
+			r.handleDiscovery(d)
+			v.Redraw()
+		case started := <-r.startedFeeds:
+			r.finishSubscribing(started)
+			v.Redraw()
+		case cmd := <-commandRequest:
+			if status := r.handleCommand(cmd); status.Message != "" {
+				v.SetStatus(status)
 			}
 			v.Redraw()
-		case <-v.GetChanExitRequest():
-			deathWg.Wait()
+		case move := <-r.movedFeeds:
+			if status := r.moveFeed(move); status.Message != "" {
+				v.SetStatus(status)
+			}
+			v.Redraw()
+		case item := <-v.GetChanDownloadRequest():
+			v.SetStatus(r.queueDownload(item))
+		case progress := <-r.downloads.GetChanProgress():
+			v.SetStatus(downloadStatus(progress))
+		case <-ctx.Done():
+			if err := r.shutdown(*shutdownTimeout); err != nil {
+				log.Println(err)
+			}
 			return
 		}
 	}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smklein/toy-rss/feed"
+	"github.com/smklein/toy-rss/storage"
+	"github.com/smklein/toy-rss/view"
+)
+
+// fakeView stores items the way the real view does, without a terminal.
+// Anything a test doesn't expect the reader to call panics.
+type fakeView struct {
+	view.ViewInterface
+	lock   sync.Mutex
+	items  []*storage.RssEntry
+	purges chan string
+	purged chan bool
+	done   chan bool
+}
+
+// startFakeView collects items until newItemPipe is closed.
+func startFakeView(newItemPipe chan *storage.RssEntry) *fakeView {
+	return startSlowFakeView(newItemPipe, 0)
+}
+
+// startSlowFakeView is startFakeView, taking delay over each item.
+func startSlowFakeView(newItemPipe chan *storage.RssEntry, delay time.Duration) *fakeView {
+	v := &fakeView{purges: make(chan string), purged: make(chan bool), done: make(chan bool)}
+	go func() {
+		defer close(v.done)
+		for {
+			select {
+			case item, ok := <-newItemPipe:
+				if !ok {
+					return
+				}
+				time.Sleep(delay)
+				v.add(item)
+			case title := <-v.purges:
+				// As the real view does, the purge catches what's queued.
+				for len(newItemPipe) > 0 {
+					v.add(<-newItemPipe)
+				}
+				v.lock.Lock()
+				kept := v.items[:0]
+				for _, item := range v.items {
+					if item.FeedTitle != title {
+						kept = append(kept, item)
+					}
+				}
+				v.items = kept
+				v.lock.Unlock()
+				v.purged <- true
+			}
+		}
+	}()
+	return v
+}
+
+func (v *fakeView) add(item *storage.RssEntry) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.items = append(v.items, item)
+}
+
+// count returns how many of the items came from the feed with the given title.
+func (v *fakeView) count(title string) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	n := 0
+	for _, item := range v.items {
+		if item.FeedTitle == title {
+			n++
+		}
+	}
+	return n
+}
+
+func (v *fakeView) PurgeFeed(title string) {
+	v.purges <- title
+	<-v.purged
+}
+
+func (v *fakeView) Done() chan bool                                            { return v.done }
+func (v *fakeView) SetStatus(status view.StatusMsgStruct)                      {}
+func (v *fakeView) AddChannelInfo(title string)                                {}
+func (v *fakeView) SetChannelDisplayName(title, name string)                   {}
+func (v *fakeView) SetChannelMetadata(title string, m storage.ChannelMetadata) {}
+
+// useTempDataDir runs the test from an empty directory, so storage's "data/"
+// files don't collide with anything real.
+func useTempDataDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// Resolved up front, since tests change directories.
+var fixtureDir, _ = filepath.Abs("test_server/test_files")
+
+func newFixtureServer(t *testing.T, name string) (*httptest.Server, string) {
+	b, err := ioutil.ReadFile(filepath.Join(fixtureDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(b)
+	}))
+	return server, string(b)
+}
+
+func newTestReader(ctx context.Context, v view.ViewInterface, newItemRequest chan *storage.RssEntry) *reader {
+	return &reader{
+		feedMap:        make(map[string]*runningFeed),
+		subscriptions:  storage.MakeSubscriptionStorage("SUBSCRIPTIONS", nil),
+		discoverer:     &feed.Discoverer{},
+		discoveries:    make(chan discovery),
+		starting:       make(map[string]bool),
+		startedFeeds:   make(chan startedFeed),
+		fetchScheduler: feed.MakeFetchScheduler(ctx, 1, 1, 0, nil),
+		ctx:            ctx,
+		newItemRequest: newItemRequest,
+		movedFeeds:     make(chan feed.FeedMove),
+		v:              v,
+	}
+}
+
+// awaitStarted hands main the next feed whose first poll is over, as main's
+// loop would.
+func awaitStarted(t *testing.T, r *reader) {
+	select {
+	case started := <-r.startedFeeds:
+		r.finishSubscribing(started)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a feed to start")
+	}
+}
+
+// subscribeNow subscribes to URL, and waits to see how it went.
+func subscribeNow(t *testing.T, r *reader, URL string) (*runningFeed, error) {
+	var rf *runningFeed
+	var err error
+	report := func(started *runningFeed, startErr error) view.StatusMsgStruct {
+		rf, err = started, startErr
+		return view.StatusMsgStruct{}
+	}
+	if err := r.subscribe(URL, "", "", false, report); err != nil {
+		return nil, err
+	}
+	awaitStarted(t, r)
+	return rf, err
+}
+
+func TestShutdownLosesNoItems(t *testing.T) {
+	useTempDataDir(t)
+	server, body := newFixtureServer(t, "hn_rss.txt")
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	newItemRequest := make(chan *storage.RssEntry, 100)
+	v := startFakeView(newItemRequest)
+	r := newTestReader(ctx, v, newItemRequest)
+	if _, err := subscribeNow(t, r, server.URL); err != nil {
+		t.Fatal("Unexpected error subscribing: ", err)
+	}
+
+	// Quit while the feed is still handing over its first items.
+	cancel()
+	if err := r.shutdown(5 * time.Second); err != nil {
+		t.Fatal("Unexpected error shutting down: ", err)
+	}
+	delivered := v.count("Hacker News")
+
+	// Whatever didn't make it to the view comes next time.
+	ctx, cancel = context.WithCancel(context.Background())
+	newItemRequest = make(chan *storage.RssEntry, 100)
+	r = newTestReader(ctx, &fakeView{}, newItemRequest)
+	rf, err := subscribeNow(t, r, server.URL)
+	if err != nil {
+		t.Fatal("Unexpected error subscribing again: ", err)
+	}
+	defer rf.feed.End()
+	defer cancel()
+	expected := strings.Count(body, "<item>")
+	for received := delivered; received < expected; received++ {
+		select {
+		case <-newItemRequest:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Items were lost: ", received, ", expected ", expected)
+		}
+	}
+}
+
+func TestShutdownGivesUp(t *testing.T) {
+	useTempDataDir(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// A view which never finishes.
+	v := &fakeView{done: make(chan bool)}
+	r := newTestReader(ctx, v, make(chan *storage.RssEntry))
+
+	start := time.Now()
+	if err := r.shutdown(50 * time.Millisecond); err == nil {
+		t.Error("Expected shutdown to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Shutdown took too long to give up: ", elapsed)
+	}
+}
+
+func TestDiscoveryDoesNotBlockMain(t *testing.T) {
+	useTempDataDir(t)
+	release := make(chan bool)
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stalled.Close()
+	defer close(release)
+	server, _ := newFixtureServer(t, "hn_rss.txt")
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newItemRequest := make(chan *storage.RssEntry, 100)
+	r := newTestReader(ctx, startFakeView(newItemRequest), newItemRequest)
+
+	start := time.Now()
+	r.handleNewFeedRequest(stalled.URL)
+	r.handleNewFeedRequest(server.URL)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Looking for feeds held up main for ", elapsed)
+	}
+
+	select {
+	case d := <-r.discoveries:
+		r.handleDiscovery(d)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The feed found never reached main")
+	}
+	awaitStarted(t, r)
+	rf, ok := r.feedMap[server.URL]
+	if !ok {
+		t.Fatal("Feed found by discovery wasn't subscribed to")
+	}
+	defer rf.feed.End()
+}
+
+func TestSubscribingDoesNotBlockMain(t *testing.T) {
+	useTempDataDir(t)
+	release := make(chan bool)
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer stalled.Close()
+	defer close(release)
+	server, _ := newFixtureServer(t, "hn_rss.txt")
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newItemRequest := make(chan *storage.RssEntry, 100)
+	r := newTestReader(ctx, startFakeView(newItemRequest), newItemRequest)
+	// Room for both; it's the scheduler's to say how many polls run at once.
+	r.fetchScheduler = feed.MakeFetchScheduler(ctx, 2, 1, 0, nil)
+	// Already subscribed, so there's nothing to discover.
+	r.subscriptions.Add(stalled.URL, "", "")
+	r.subscriptions.Add(server.URL, "", "")
+
+	start := time.Now()
+	r.handleNewFeedRequest(stalled.URL)
+	r.handleNewFeedRequest(server.URL)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("First polls held up main for ", elapsed)
+	}
+	if status := r.addNewFeed(server.URL); status.Type != view.StatusError {
+		t.Error("Subscribed twice to a feed still starting: ", status.Message)
+	}
+
+	awaitStarted(t, r)
+	rf, ok := r.feedMap[server.URL]
+	if !ok {
+		t.Fatal("Feed wasn't subscribed to once its first poll was over")
+	}
+	defer rf.feed.End()
+	if _, ok := r.feedMap[stalled.URL]; ok {
+		t.Error("Feed whose first poll is stuck was subscribed to")
+	}
+}
+
+func TestMovedFeedIsRekeyed(t *testing.T) {
+	useTempDataDir(t)
+	body, err := ioutil.ReadFile(filepath.Join(fixtureDir, "hn_rss.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/old", http.RedirectHandler("/new", http.StatusMovedPermanently))
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newItemRequest := make(chan *storage.RssEntry, 100)
+	r := newTestReader(ctx, startFakeView(newItemRequest), newItemRequest)
+	rf, err := subscribeNow(t, r, server.URL+"/old")
+	if err != nil {
+		t.Fatal("Unexpected error subscribing: ", err)
+	}
+	defer rf.feed.End()
+
+	select {
+	case move := <-r.movedFeeds:
+		if status := r.moveFeed(move); status.Message == "" {
+			t.Error("The user wasn't told the feed moved")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The move never reached main")
+	}
+	if r.feedMap[server.URL+"/new"] != rf {
+		t.Error("Feed wasn't re-keyed under its new URL")
+	}
+	if _, ok := r.feedMap[server.URL+"/old"]; ok {
+		t.Error("Feed is still kept under its old URL")
+	}
+	if _, ok := r.subscriptions.Get(server.URL + "/new"); !ok {
+		t.Error("Subscription wasn't moved to the new URL")
+	}
+	if _, ok := r.subscriptions.Get(server.URL + "/old"); ok {
+		t.Error("Subscription to the old URL remains")
+	}
+}
+
+// awaitFirstPoll waits until the feed at URL has finished its first poll,
+// and is sleeping until the next.
+func awaitFirstPoll(t *testing.T, URL string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for storage.MakeHealthStorage(URL).Get().LastPoll.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the first poll to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoveFeedPurge(t *testing.T) {
+	useTempDataDir(t)
+	server, _ := newFixtureServer(t, "hn_rss.txt")
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Slow enough that the feed is still handing over its items when it's
+	// removed.
+	newItemRequest := make(chan *storage.RssEntry)
+	v := startSlowFakeView(newItemRequest, time.Millisecond)
+	r := newTestReader(ctx, v, newItemRequest)
+	rf, err := subscribeNow(t, r, server.URL)
+	if err != nil {
+		t.Fatal("Unexpected error subscribing: ", err)
+	}
+
+	if status := r.removeFeed([]string{"-purge", server.URL}); status.Type != view.StatusSuccess {
+		t.Fatal("Unexpected status: ", status.Message)
+	}
+	if n := v.count("Hacker News"); n != 0 {
+		t.Error("Items left behind by a purge: ", n)
+	}
+	// Nothing comes after it, either.
+	<-rf.handlerDone
+	v.PurgeFeed("")
+	if n := v.count("Hacker News"); n != 0 {
+		t.Error("Items arrived after a purge: ", n)
+	}
+	if _, ok := r.feedMap[server.URL]; ok {
+		t.Error("Removed feed is still running")
+	}
+	if _, ok := r.subscriptions.Get(server.URL); ok {
+		t.Error("Removed feed is still subscribed to")
+	}
+}
+
+func TestRemoveFeedForget(t *testing.T) {
+	useTempDataDir(t)
+	server, _ := newFixtureServer(t, "hn_rss.txt")
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newItemRequest := make(chan *storage.RssEntry, 100)
+	r := newTestReader(ctx, startFakeView(newItemRequest), newItemRequest)
+	if _, err := subscribeNow(t, r, server.URL); err != nil {
+		t.Fatal("Unexpected error subscribing: ", err)
+	}
+	awaitFirstPoll(t, server.URL)
+	if storage.MakeValidatorStorage(server.URL).Get().Title != "Hacker News" {
+		t.Fatal("Validators weren't saved")
+	}
+	if _, err := os.Stat("data/Hacker News"); err != nil {
+		t.Fatal("History wasn't saved: ", err)
+	}
+
+	if status := r.removeFeed([]string{"-forget", "Hacker News"}); status.Type != view.StatusSuccess {
+		t.Fatal("Unexpected status: ", status.Message)
+	}
+	if _, err := os.Stat("data/Hacker News"); !os.IsNotExist(err) {
+		t.Error("History outlived -forget: ", err)
+	}
+	if validators := storage.MakeValidatorStorage(server.URL).Get(); validators != (storage.SavedValidators{}) {
+		t.Error("Validators outlived -forget: ", validators)
+	}
+	if health := storage.MakeHealthStorage(server.URL).Get(); !health.LastPoll.IsZero() {
+		t.Error("Health outlived -forget: ", health)
+	}
+}
+
+func TestRemoveSleepingFeed(t *testing.T) {
+	useTempDataDir(t)
+	server, _ := newFixtureServer(t, "hn_rss.txt")
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newItemRequest := make(chan *storage.RssEntry, 100)
+	r := newTestReader(ctx, startFakeView(newItemRequest), newItemRequest)
+	if _, err := subscribeNow(t, r, server.URL); err != nil {
+		t.Fatal("Unexpected error subscribing: ", err)
+	}
+	awaitFirstPoll(t, server.URL)
+
+	start := time.Now()
+	if status := r.removeFeed([]string{server.URL}); status.Type != view.StatusSuccess {
+		t.Fatal("Unexpected status: ", status.Message)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Removing a sleeping feed took ", elapsed)
+	}
+}
+
+func TestImportOPML(t *testing.T) {
+	useTempDataDir(t)
+	server, _ := newFixtureServer(t, "hn_rss.txt")
+	defer server.Close()
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+
+	name := filepath.Join(t.TempDir(), "subscriptions.opml")
+	list := `<?xml version="1.0"?>
+<opml version="2.0"><head><title>Feeds</title></head><body>
+	<outline text="HN" type="rss" xmlUrl="` + server.URL + `/feed"/>
+	<outline text="HN again" type="rss" xmlUrl="` + server.URL + `/feed/?utm_source=opml"/>
+	<outline text="Broken" type="rss" xmlUrl="` + broken.URL + `/feed"/>
+</body></opml>`
+	if err := ioutil.WriteFile(name, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newItemRequest := make(chan *storage.RssEntry, 100)
+	r := newTestReader(ctx, startFakeView(newItemRequest), newItemRequest)
+	r.newFeedRequest = make(chan string)
+	r.pendingImports = make(map[string]*pendingImport)
+
+	if status := r.importOPML([]string{name}); status.Type != view.StatusInfo {
+		t.Fatal("Unexpected status: ", status.Message)
+	}
+	imp := r.pendingImports[server.URL+"/feed"].imp
+	for i := 0; i < 2; i++ {
+		select {
+		case URL := <-r.newFeedRequest:
+			r.handleNewFeedRequest(URL)
+			awaitStarted(t, r)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Imported feeds never reached main")
+		}
+	}
+	if rf, ok := r.feedMap[server.URL+"/feed"]; ok {
+		defer rf.feed.End()
+	} else {
+		t.Error("Imported feed wasn't started")
+	}
+
+	if imp.added != 2 || imp.duplicates != 1 || imp.failed != 1 || imp.remaining != 0 {
+		t.Error("Unexpected import: ", *imp)
+	}
+	if sub, ok := r.subscriptions.Get(broken.URL + "/feed"); !ok || sub.Name != "Broken" {
+		t.Error("Feed whose first fetch failed wasn't kept: ", sub)
+	}
+	if n := len(r.subscriptions.GetAll()); n != 2 {
+		t.Error("Unexpected number of subscriptions: ", n, ", expected 2")
+	}
+}
+
+func TestRunLint(t *testing.T) {
+	var out bytes.Buffer
+	clean := filepath.Join(fixtureDir, "podcast_rss.txt")
+	if status := runLint(context.Background(), []string{clean}, feed.FetchLimits{}, &out); status != 0 {
+		t.Error("Unexpected exit status for a clean feed: ", status, "\n", out.String())
+	}
+	if !strings.Contains(out.String(), "2 items") {
+		t.Error("Item count missing from report: ", out.String())
+	}
+
+	out.Reset()
+	missing := filepath.Join(t.TempDir(), "missing.rss")
+	if status := runLint(context.Background(), []string{clean, missing}, feed.FetchLimits{}, &out); status != 1 {
+		t.Error("Unexpected exit status when a feed has errors: ", status, "\n", out.String())
+	}
+	if status := runLint(context.Background(), nil, feed.FetchLimits{}, &out); status != 2 {
+		t.Error("Unexpected exit status with nothing to lint: ", status)
+	}
+}
+
+func TestLoadTimezone(t *testing.T) {
+	if loc, err := loadTimezone(""); err != nil || loc != time.Local {
+		t.Error("Unexpected default timezone: ", loc, ", ", err, ", expected the local one")
+	}
+	if loc, err := loadTimezone("UTC"); err != nil || loc.String() != "UTC" {
+		t.Error("Unexpected timezone for UTC: ", loc, ", ", err)
+	}
+	if _, err := loadTimezone("Nowhere/Special"); err == nil {
+		t.Error("Expected an error for an unknown timezone")
+	}
+}
@@ -0,0 +1,146 @@
+// Package opml reads and writes OPML subscription lists, the format most feed
+// readers use to import and export what they follow.
+package opml
+
+import (
+	"encoding/xml"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FolderSeparator joins the titles of nested folders in Entry.Folder.
+const FolderSeparator = "/"
+
+// Entry is a single feed in a subscription list.
+type Entry struct {
+	URL   string
+	Title string
+	// The folders (outlines) the feed is nested in, outermost first, joined
+	// by FolderSeparator. Empty if the feed is at the top level.
+	Folder string
+}
+
+type document struct {
+	XMLName xml.Name  `xml:"opml"`
+	Version string    `xml:"version,attr"`
+	Head    head      `xml:"head"`
+	Body    []outline `xml:"body>outline"`
+}
+
+type head struct {
+	Title       string `xml:"title,omitempty"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+type outline struct {
+	Text     string    `xml:"text,attr"`
+	Title    string    `xml:"title,attr,omitempty"`
+	Type     string    `xml:"type,attr,omitempty"`
+	XMLURL   string    `xml:"xmlUrl,attr,omitempty"`
+	Outlines []outline `xml:"outline"`
+}
+
+func (o *outline) name() string {
+	if o.Title != "" {
+		return o.Title
+	}
+	return o.Text
+}
+
+// Parse reads every feed out of an OPML 1.0 or 2.0 document, flattening any
+// nested folders into Entry.Folder. Entries are returned in document order.
+func Parse(r io.Reader) ([]Entry, error) {
+	var doc document
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	var walk func(outlines []outline, folders []string)
+	walk = func(outlines []outline, folders []string) {
+		for i := range outlines {
+			o := &outlines[i]
+			if URL := strings.TrimSpace(o.XMLURL); URL != "" {
+				entries = append(entries, Entry{
+					URL:    URL,
+					Title:  o.name(),
+					Folder: strings.Join(folders, FolderSeparator),
+				})
+			}
+			if len(o.Outlines) > 0 {
+				walk(o.Outlines, append(folders[:len(folders):len(folders)], o.name()))
+			}
+		}
+	}
+	walk(doc.Body, nil)
+	return entries, nil
+}
+
+// Write produces an OPML 2.0 document listing entries, nesting them in
+// outlines according to their folders.
+func Write(w io.Writer, title string, entries []Entry) error {
+	doc := document{
+		Version: "2.0",
+		Head: head{
+			Title:       title,
+			DateCreated: time.Now().Format(time.RFC1123Z),
+		},
+	}
+
+	// Group by folder, so each folder becomes a single outline.
+	byFolder := make(map[string][]Entry)
+	var folders []string
+	for _, e := range entries {
+		if _, ok := byFolder[e.Folder]; !ok {
+			folders = append(folders, e.Folder)
+		}
+		byFolder[e.Folder] = append(byFolder[e.Folder], e)
+	}
+	sort.Strings(folders)
+
+	for _, folder := range folders {
+		parent := &doc.Body
+		if folder != "" {
+			for _, name := range strings.Split(folder, FolderSeparator) {
+				parent = findOrAddFolder(parent, name)
+			}
+		}
+		for _, e := range byFolder[folder] {
+			*parent = append(*parent, outline{
+				Text:   e.Title,
+				Title:  e.Title,
+				Type:   "rss",
+				XMLURL: e.URL,
+			})
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func findOrAddFolder(outlines *[]outline, name string) *[]outline {
+	for i := range *outlines {
+		o := &(*outlines)[i]
+		if o.XMLURL == "" && o.Text == name {
+			return &o.Outlines
+		}
+	}
+	*outlines = append(*outlines, outline{Text: name, Title: name})
+	return &(*outlines)[len(*outlines)-1].Outlines
+}
@@ -0,0 +1,62 @@
+package opml
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const nestedOPML = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<opml version="1.0">
+<head><title>Shared feeds</title></head>
+<body>
+	<outline text="Hacker News" type="rss" xmlUrl="https://news.ycombinator.com/rss"/>
+	<outline text="Tech">
+		<outline text="Linux">
+			<outline text="LWN" title="LWN.net" type="rss" xmlUrl="https://lwn.net/headlines/rss"/>
+		</outline>
+		<outline text="Ars" type="rss" xmlUrl=" http://feeds.arstechnica.com/arstechnica/index "/>
+	</outline>
+</body>
+</opml>`
+
+func verifyEntries(t *testing.T, entries, expected []Entry) {
+	if len(entries) != len(expected) {
+		t.Fatal("Unexpected entries: ", entries, ", expected ", expected)
+	}
+	for i := range entries {
+		if entries[i] != expected[i] {
+			t.Error("Unexpected entry: ", entries[i], ", expected ", expected[i])
+		}
+	}
+}
+
+func TestParseNested(t *testing.T) {
+	entries, err := Parse(strings.NewReader(nestedOPML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyEntries(t, entries, []Entry{
+		{URL: "https://news.ycombinator.com/rss", Title: "Hacker News"},
+		{URL: "https://lwn.net/headlines/rss", Title: "LWN.net", Folder: "Tech/Linux"},
+		{URL: "http://feeds.arstechnica.com/arstechnica/index", Title: "Ars", Folder: "Tech"},
+	})
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{URL: "https://lwn.net/headlines/rss", Title: "LWN.net", Folder: "Tech/Linux"},
+		{URL: "http://preshing.com/feed", Title: "Preshing on Programming", Folder: "Tech"},
+		{URL: "https://news.ycombinator.com/rss", Title: "Hacker News"},
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, "toy-rss", entries); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Top-level feeds come first, then folders, outermost first.
+	verifyEntries(t, parsed, []Entry{entries[2], entries[1], entries[0]})
+}
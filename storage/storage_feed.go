@@ -1,14 +1,19 @@
 package storage
 
 import (
+	"os"
 	"path"
+	"sync"
 
 	"github.com/smklein/toy-rss/agingmap"
 )
 
+// FeedStorage is safe to share: the map does its own locking, and lock keeps
+// dumps from overlapping.
 type FeedStorage struct {
 	filename string
 	Amap     agingmap.AgingMapInterface
+	lock     sync.Mutex
 }
 
 func MakeFeedStorage(filename string, cap int) *FeedStorage {
@@ -21,7 +26,20 @@ func MakeFeedStorage(filename string, cap int) *FeedStorage {
 	return s
 }
 
+// DeleteFeedStorage removes the on-disk history of the feed with the given
+// title, so its items will be seen as new if it is ever added again.
+// Nothing may be using the feed's FeedStorage at the time.
+func DeleteFeedStorage(filename string) error {
+	err := os.Remove("data/" + path.Clean(filename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
 func (s *FeedStorage) Add(key, value string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.Amap.Add(key, value)
 	s.DumpToStorage()
 }
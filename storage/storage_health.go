@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"os"
+	"sync"
+)
+
+// HealthStorage remembers how polling a feed URL has been going, so it can be
+// shown even for feeds which aren't running right now.
+type HealthStorage struct {
+	filename string
+	lock     sync.RWMutex
+	saved    FeedHealth
+}
+
+func healthFilename(URL string) string {
+	return urlFilename("health_", URL)
+}
+
+func MakeHealthStorage(URL string) *HealthStorage {
+	s := &HealthStorage{
+		filename: healthFilename(URL),
+	}
+	adoptLegacyFile("health_", URL, s.filename)
+	s.LoadFromStorage()
+	return s
+}
+
+func (s *HealthStorage) Get() FeedHealth {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.saved
+}
+
+func (s *HealthStorage) Set(health FeedHealth) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.saved = health
+	return s.DumpToStorage()
+}
+
+// Move makes this the storage for URL instead, taking what was saved along.
+func (s *HealthStorage) Move(URL string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old := s.filename
+	if old == healthFilename(URL) {
+		return nil
+	}
+	s.filename = healthFilename(URL)
+	if err := s.DumpToStorage(); err != nil {
+		return err
+	}
+	err := os.Remove(old)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DeleteHealthStorage forgets the health of URL.
+// Nothing may be using the URL's HealthStorage at the time.
+func DeleteHealthStorage(URL string) error {
+	err := os.Remove(healthFilename(URL))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
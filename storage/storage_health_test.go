@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHealthStorageLongURL(t *testing.T) {
+	useTempDataDir(t)
+	URL := "https://example.com/feed?q=" + strings.Repeat("x", 1000)
+
+	s := MakeHealthStorage(URL)
+	if err := s.Set(FeedHealth{ItemCount: 3}); err != nil {
+		t.Fatal("Unexpected error saving health: ", err)
+	}
+	if got := MakeHealthStorage(URL).Get(); got.ItemCount != 3 {
+		t.Error("Unexpected item count: ", got.ItemCount, ", expected 3")
+	}
+	if err := s.Move(URL + "/moved"); err != nil {
+		t.Fatal("Unexpected error moving health: ", err)
+	}
+	if got := MakeHealthStorage(URL + "/moved").Get(); got.ItemCount != 3 {
+		t.Error("Health didn't move along: ", got)
+	}
+}
@@ -7,6 +7,7 @@ package storage
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"os"
@@ -18,6 +19,21 @@ import (
 
 type ChannelInfo struct {
 	ChannelColor tb.Attribute
+	// What the user calls the channel, if not its title.
+	DisplayName string
+	Metadata    ChannelMetadata
+}
+
+// ChannelMetadata describes a feed as a whole, rather than any one item.
+type ChannelMetadata struct {
+	Description string
+	// The website the feed belongs to.
+	SiteLink    string
+	ImageURL    string
+	Language    string
+	Categories  []string
+	Generator   string
+	LastUpdated time.Time
 }
 
 type SavedViewStorage struct {
@@ -25,19 +41,143 @@ type SavedViewStorage struct {
 	ChannelInfoMap map[string]*ChannelInfo /* Title --> Info */
 }
 
+// FeedSettings are the per-feed choices a user can make.
+type FeedSettings struct {
+	// How often to poll the feed. Zero means "automatically".
+	RefreshInterval time.Duration
+	Request         RequestSettings
+	// How to tell whether an item has been seen before; one of the Dedupe*
+	// strategies. DedupeAuto lets the feed decide, and DetectedDedupe records
+	// what it decided.
+	Dedupe         string
+	DetectedDedupe string
+}
+
+// Dedupe strategies.
+const (
+	DedupeAuto = ""
+	// The item's GUID (or Atom ID), falling back to its link.
+	DedupeGUID = "guid"
+	DedupeLink = "link"
+	// The link, minus tracking parameters like utm_source.
+	DedupeNormalizedLink = "normalized-link"
+	DedupeTitleDate      = "title-date"
+	// What the item says; any edit makes it a new item.
+	DedupeContentHash = "content-hash"
+)
+
+// RequestSettings customize the HTTP requests made for a feed.
+type RequestSettings struct {
+	Auth FeedAuth
+	// Sent with every request, on top of the usual ones.
+	Headers   map[string]string
+	UserAgent string
+}
+
+// FeedAuth kinds.
+const (
+	AuthNone   = ""
+	AuthBasic  = "basic"
+	AuthBearer = "bearer"
+	AuthCookie = "cookie"
+)
+
+// FeedAuth is how to authenticate with a feed's server.
+type FeedAuth struct {
+	Kind string
+	// Only used by AuthBasic.
+	Username string
+	// Where the password, token or cookie is read from: "env:NAME" or
+	// "file:/path/to/secret". The secret itself is never saved.
+	SecretSource string
+}
+
+// Subscription is a single feed the user follows.
+type Subscription struct {
+	URL string
+	// What to call the feed. Filled in with its title once first fetched.
+	Name string
+	// Where the feed is filed, as "Outer/Inner". Empty for the top level.
+	Folder   string
+	AddedAt  time.Time
+	Settings FeedSettings
+}
+
+type SavedSubscriptions struct {
+	Subscriptions []*Subscription
+}
+
+// SavedValidators are the HTTP cache validators for a single feed URL.
+// The title is kept as well, so a "304 Not Modified" on the first poll after a
+// restart still tells us which feed we are looking at.
+type SavedValidators struct {
+	Title        string
+	ETag         string
+	LastModified string
+}
+
+// FeedHealth is how polling a single feed URL has been going.
+type FeedHealth struct {
+	LastPoll    time.Time
+	LastSuccess time.Time
+	LastError   time.Time
+	// Why the last failed poll failed.
+	LastErrorMessage string
+	// Of the last response; zero if there wasn't one.
+	LastStatusCode int
+	LastLatency    time.Duration
+	// When a poll last found something new.
+	LastNewItem time.Time
+	// Items in the last document fetched.
+	ItemCount int
+	// Items delivered, in total.
+	NewItemCount        int
+	ConsecutiveFailures int
+}
+
 // RssEntryState represents the viewing status of the entry.
 type RssEntryState uint8
 
+// Enclosure is a file attached to an entry, like a podcast episode.
+type Enclosure struct {
+	URL  string
+	Type string /* MIME type, if known */
+	// In bytes. Zero if the feed didn't say.
+	Length int64
+}
+
 // RssEntry represents OUR version of an entry.
 // It's in a form that can be easily dumped to the view.
 type RssEntry struct {
 	FeedTitle   string
+	ItemID      string
 	ItemTitle   string
 	ItemSummary string
 	ItemContent string
+	ItemAuthor  string
 	URL         string
 	ItemDate    time.Time
-	State       RssEntryState
+	// The date as the feed wrote it, if it did.
+	ItemRawDate string
+	// Set when the feed gave no date, or one in the future; ItemDate is when
+	// the item was first seen instead.
+	ItemDateEstimated bool
+	Enclosures        []Enclosure
+	State             RssEntryState
+	// Set when the feed changed the item after it was first seen.
+	Updated bool
+	// What the item said before its latest update, if it was updated.
+	Previous *RssEntryRevision
+	// Titles of the other feeds the same story came from. Rather than being
+	// shown again, their copies were folded into this one.
+	AlsoIn []string
+}
+
+// RssEntryRevision is an older version of an RssEntry's text.
+type RssEntryRevision struct {
+	ItemTitle   string
+	ItemSummary string
+	ItemContent string
 }
 
 // VIEW STORAGE
@@ -59,6 +199,7 @@ func (s *ViewStorage) LoadFromStorage() (loaded bool) {
 	}
 }
 
+// must hold s.itemLock and s.channelInfoLock, at least one for writing
 func (s *ViewStorage) DumpToStorage() {
 	b, err := json.Marshal(s.saved)
 	if err != nil {
@@ -111,3 +252,90 @@ func (s *FeedStorage) DumpToStorage() {
 	}
 	err = os.Rename(tempfilename, s.filename)
 }
+
+// SUBSCRIPTION STORAGE
+
+func (s *SubscriptionStorage) LoadFromStorage() (loaded bool) {
+	if f, err := ioutil.ReadFile(s.filename); err == nil {
+		log.Println("SubscriptionStorage Loading: ", s.filename)
+		err = json.Unmarshal(f, &s.saved)
+		if err != nil {
+			panic(err.Error())
+		}
+		return true
+	} else {
+		return false
+	}
+}
+
+func (s *SubscriptionStorage) DumpToStorage() {
+	b, err := json.Marshal(s.saved)
+	if err != nil {
+		panic(err)
+	}
+
+	tempfilename := s.filename + "_TEMP"
+	err = ioutil.WriteFile(tempfilename, b, 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Rename(tempfilename, s.filename)
+}
+
+// VALIDATOR STORAGE
+
+func (s *ValidatorStorage) LoadFromStorage() (loaded bool) {
+	if f, err := ioutil.ReadFile(s.filename); err == nil {
+		log.Println("ValidatorStorage Loading: ", s.filename)
+		err = json.Unmarshal(f, &s.saved)
+		if err != nil {
+			panic(err.Error())
+		}
+		return true
+	} else {
+		return false
+	}
+}
+
+func (s *ValidatorStorage) DumpToStorage() error {
+	b, err := json.Marshal(s.saved)
+	if err != nil {
+		return err
+	}
+
+	tempfilename := s.filename + "_TEMP"
+	err = ioutil.WriteFile(tempfilename, b, 0644)
+	if err != nil {
+		return errors.New("Saving validators failed: " + err.Error())
+	}
+	return os.Rename(tempfilename, s.filename)
+}
+
+// HEALTH STORAGE
+
+func (s *HealthStorage) LoadFromStorage() (loaded bool) {
+	if f, err := ioutil.ReadFile(s.filename); err == nil {
+		log.Println("HealthStorage Loading: ", s.filename)
+		err = json.Unmarshal(f, &s.saved)
+		if err != nil {
+			panic(err.Error())
+		}
+		return true
+	} else {
+		return false
+	}
+}
+
+func (s *HealthStorage) DumpToStorage() error {
+	b, err := json.Marshal(s.saved)
+	if err != nil {
+		return err
+	}
+
+	tempfilename := s.filename + "_TEMP"
+	err = ioutil.WriteFile(tempfilename, b, 0644)
+	if err != nil {
+		return errors.New("Saving feed health failed: " + err.Error())
+	}
+	return os.Rename(tempfilename, s.filename)
+}
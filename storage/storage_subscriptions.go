@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"path"
+	"sync"
+	"time"
+)
+
+// SubscriptionStorage is the persisted list of feeds the user follows.
+type SubscriptionStorage struct {
+	filename string
+	lock     sync.RWMutex
+	saved    *SavedSubscriptions
+}
+
+// MakeSubscriptionStorage loads the subscription list. If there is none yet
+// (a brand-new install), it is seeded with seedURLs.
+func MakeSubscriptionStorage(key string, seedURLs []string) *SubscriptionStorage {
+	s := &SubscriptionStorage{
+		filename: "data/" + path.Clean(key),
+	}
+	if !s.LoadFromStorage() {
+		s.saved = &SavedSubscriptions{
+			Subscriptions: make([]*Subscription, 0, len(seedURLs)),
+		}
+		for _, URL := range seedURLs {
+			s.saved.Subscriptions = append(s.saved.Subscriptions, &Subscription{
+				URL:     URL,
+				AddedAt: time.Now(),
+			})
+		}
+		s.DumpToStorage()
+	}
+	return s
+}
+
+// must hold s.lock
+func (s *SubscriptionStorage) find(URL string) *Subscription {
+	for _, sub := range s.saved.Subscriptions {
+		if sub.URL == URL {
+			return sub
+		}
+	}
+	return nil
+}
+
+// GetAll returns a copy of every subscription, oldest first.
+func (s *SubscriptionStorage) GetAll() []Subscription {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	subs := make([]Subscription, len(s.saved.Subscriptions))
+	for i := range subs {
+		subs[i] = *s.saved.Subscriptions[i]
+	}
+	return subs
+}
+
+// Get returns a copy of the subscription to URL, if there is one.
+func (s *SubscriptionStorage) Get(URL string) (Subscription, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if sub := s.find(URL); sub != nil {
+		return *sub, true
+	}
+	return Subscription{}, false
+}
+
+// Add subscribes to URL. If already subscribed, only an empty name is filled
+// in; the rest of the subscription is left alone.
+func (s *SubscriptionStorage) Add(URL, name, folder string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sub := s.find(URL); sub != nil {
+		if sub.Name == "" && name != "" {
+			sub.Name = name
+			s.DumpToStorage()
+		}
+		return
+	}
+	s.saved.Subscriptions = append(s.saved.Subscriptions, &Subscription{
+		URL:     URL,
+		Name:    name,
+		Folder:  folder,
+		AddedAt: time.Now(),
+	})
+	s.DumpToStorage()
+}
+
+// Remove unsubscribes from URL.
+func (s *SubscriptionStorage) Remove(URL string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, sub := range s.saved.Subscriptions {
+		if sub.URL == URL {
+			s.saved.Subscriptions = append(s.saved.Subscriptions[:i], s.saved.Subscriptions[i+1:]...)
+			s.DumpToStorage()
+			return
+		}
+	}
+}
+
+// Move points the subscription to from at to instead. If to is already
+// subscribed to, the subscription to from is dropped.
+func (s *SubscriptionStorage) Move(from, to string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sub := s.find(from)
+	if sub == nil {
+		return
+	}
+	if s.find(to) != nil {
+		for i := range s.saved.Subscriptions {
+			if s.saved.Subscriptions[i] == sub {
+				s.saved.Subscriptions = append(s.saved.Subscriptions[:i], s.saved.Subscriptions[i+1:]...)
+				break
+			}
+		}
+	} else {
+		sub.URL = to
+	}
+	s.DumpToStorage()
+}
+
+// Rename changes what the subscription to URL is called.
+func (s *SubscriptionStorage) Rename(URL, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sub := s.find(URL); sub != nil {
+		sub.Name = name
+		s.DumpToStorage()
+	}
+}
+
+// SetSettings replaces the settings of the subscription to URL.
+func (s *SubscriptionStorage) SetSettings(URL string, settings FeedSettings) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sub := s.find(URL); sub != nil {
+		sub.Settings = settings
+		s.DumpToStorage()
+	}
+}
+
+// UpdateSettings changes the settings of the subscription to URL in place, so
+// changes made elsewhere at the same time aren't lost.
+func (s *SubscriptionStorage) UpdateSettings(URL string, update func(*FeedSettings)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if sub := s.find(URL); sub != nil {
+		update(&sub.Settings)
+		s.DumpToStorage()
+	}
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+var seedURLs = []string{"https://one.example.com/feed", "https://two.example.com/feed"}
+
+func subscriptionURLs(s *SubscriptionStorage) []string {
+	var URLs []string
+	for _, sub := range s.GetAll() {
+		URLs = append(URLs, sub.URL)
+	}
+	return URLs
+}
+
+func TestSubscriptionStorageSeedsNewInstall(t *testing.T) {
+	useTempDataDir(t)
+	s := MakeSubscriptionStorage("SUBSCRIPTIONS", seedURLs)
+	if URLs := subscriptionURLs(s); len(URLs) != 2 || URLs[0] != seedURLs[0] || URLs[1] != seedURLs[1] {
+		t.Fatal("Unexpected subscriptions for a new install: ", URLs)
+	}
+
+	// Unsubscribing from everything is a choice; it isn't undone next time.
+	for _, URL := range seedURLs {
+		s.Remove(URL)
+	}
+	s = MakeSubscriptionStorage("SUBSCRIPTIONS", seedURLs)
+	if URLs := subscriptionURLs(s); len(URLs) != 0 {
+		t.Error("Defaults came back after being removed: ", URLs)
+	}
+}
+
+func TestSubscriptionStorageRoundTrip(t *testing.T) {
+	useTempDataDir(t)
+	s := MakeSubscriptionStorage("SUBSCRIPTIONS", nil)
+	s.Add("https://a.example.com/feed", "A", "News")
+	s.Add("https://b.example.com/feed", "", "")
+	s.Add("https://c.example.com/feed", "C", "")
+	s.Remove("https://c.example.com/feed")
+	s.Move("https://b.example.com/feed", "https://b.example.com/new-feed")
+	s.Rename("https://b.example.com/new-feed", "B")
+	settings := FeedSettings{
+		RefreshInterval: time.Hour,
+		Request: RequestSettings{
+			Auth:    FeedAuth{Kind: AuthBearer, SecretSource: "env:TOKEN"},
+			Headers: map[string]string{"X-Api-Key": "key"},
+		},
+		Dedupe: DedupeLink,
+	}
+	s.SetSettings("https://a.example.com/feed", settings)
+
+	s = MakeSubscriptionStorage("SUBSCRIPTIONS", seedURLs)
+	if URLs := subscriptionURLs(s); len(URLs) != 2 || URLs[0] != "https://a.example.com/feed" || URLs[1] != "https://b.example.com/new-feed" {
+		t.Fatal("Unexpected subscriptions after reloading: ", URLs)
+	}
+	a, _ := s.Get("https://a.example.com/feed")
+	if a.Name != "A" || a.Folder != "News" || a.AddedAt.IsZero() {
+		t.Error("Unexpected subscription: ", a)
+	}
+	if a.Settings.RefreshInterval != time.Hour || a.Settings.Dedupe != DedupeLink ||
+		a.Settings.Request.Auth != settings.Request.Auth || a.Settings.Request.Headers["X-Api-Key"] != "key" {
+		t.Error("Unexpected settings: ", a.Settings, ", expected ", settings)
+	}
+	if b, _ := s.Get("https://b.example.com/new-feed"); b.Name != "B" {
+		t.Error("Unexpected name after moving and renaming: ", b.Name)
+	}
+
+	// Adding again only fills in a missing name.
+	s.Add("https://a.example.com/feed", "Another A", "Elsewhere")
+	if a, _ := s.Get("https://a.example.com/feed"); a.Name != "A" || a.Folder != "News" {
+		t.Error("Re-adding changed the subscription: ", a)
+	}
+}
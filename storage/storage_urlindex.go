@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Query parameters which only say where a reader came from.
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"dclid":   true,
+	"msclkid": true,
+	"yclid":   true,
+	"igshid":  true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"_ga":     true,
+	"ref":     true,
+	"ref_src": true,
+}
+
+// CanonicalURL strips what varies between links to the same page: the
+// scheme, default ports, fragments, trailing slashes, tracking parameters
+// and the order of the rest.
+func CanonicalURL(link string) string {
+	link = strings.TrimSpace(link)
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link
+	}
+	host := strings.ToLower(u.Host)
+	host = strings.TrimSuffix(strings.TrimSuffix(host, ":80"), ":443")
+	query := u.Query()
+	for param := range query {
+		lower := strings.ToLower(param)
+		if strings.HasPrefix(lower, "utm_") || trackingParams[lower] {
+			query.Del(param)
+		}
+	}
+	canonical := host + strings.TrimSuffix(u.EscapedPath(), "/")
+	if len(query) > 0 {
+		canonical += "?" + query.Encode()
+	}
+	return canonical
+}
+
+// URLIndex remembers which feeds each story (by canonical URL) has come
+// from, for a while after the story has left the view, so a story syndicated
+// to several feeds is only shown once.
+type URLIndex struct {
+	history *FeedStorage
+}
+
+// MakeURLIndex loads the index, which keeps up to cap stories.
+func MakeURLIndex(key string, cap int) *URLIndex {
+	return &URLIndex{history: MakeFeedStorage(key, cap)}
+}
+
+// Sources returns the titles of the feeds the story at URL has come from,
+// oldest first.
+func (i *URLIndex) Sources(URL string) []string {
+	sources := i.history.Get(CanonicalURL(URL))
+	if sources == "" {
+		return nil
+	}
+	return strings.Split(sources, "\n")
+}
+
+// AddSource records that the story at URL came from the feed with the given
+// title.
+func (i *URLIndex) AddSource(URL, feedTitle string) {
+	sources := i.Sources(URL)
+	for _, source := range sources {
+		if source == feedTitle {
+			return
+		}
+	}
+	i.history.Add(CanonicalURL(URL), strings.Join(append(sources, feedTitle), "\n"))
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// ValidatorStorage remembers the HTTP cache validators a server handed back
+// for a feed URL. Sending them on the next poll lets the server answer with
+// "304 Not Modified" instead of the whole document.
+//
+// Unlike FeedStorage, this is keyed by URL rather than title: after a restart,
+// the very first poll happens before we know the feed's title.
+type ValidatorStorage struct {
+	filename string
+	lock     sync.RWMutex
+	saved    SavedValidators
+}
+
+// readableFilenameLength is how much of a URL is kept in its files' names,
+// for anyone looking around the data directory.
+const readableFilenameLength = 64
+
+// urlFilename names a file about URL. URLs can be too long for a filename, so
+// it's told apart from the rest by a hash of the canonical URL.
+func urlFilename(prefix, URL string) string {
+	readable := url.QueryEscape(CanonicalURL(URL))
+	if len(readable) > readableFilenameLength {
+		readable = readable[:readableFilenameLength]
+	}
+	sum := sha256.Sum256([]byte(CanonicalURL(URL)))
+	return "data/" + prefix + readable + "_" + hex.EncodeToString(sum[:16])
+}
+
+// adoptLegacyFile renames the file which used to be about URL, named after
+// the whole URL, to filename, unless there's one there already.
+func adoptLegacyFile(prefix, URL, filename string) {
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		return
+	}
+	os.Rename("data/"+prefix+url.QueryEscape(URL), filename)
+}
+
+func validatorFilename(URL string) string {
+	return urlFilename("validators_", URL)
+}
+
+func MakeValidatorStorage(URL string) *ValidatorStorage {
+	s := &ValidatorStorage{
+		filename: validatorFilename(URL),
+	}
+	adoptLegacyFile("validators_", URL, s.filename)
+	s.LoadFromStorage()
+	return s
+}
+
+func (s *ValidatorStorage) Get() SavedValidators {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.saved
+}
+
+// Set records new validators, only touching the disk if they changed.
+func (s *ValidatorStorage) Set(validators SavedValidators) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.saved == validators {
+		return nil
+	}
+	s.saved = validators
+	return s.DumpToStorage()
+}
+
+// Move makes this the storage for URL instead, taking what was saved along.
+func (s *ValidatorStorage) Move(URL string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old := s.filename
+	if old == validatorFilename(URL) {
+		return nil
+	}
+	s.filename = validatorFilename(URL)
+	if err := s.DumpToStorage(); err != nil {
+		return err
+	}
+	err := os.Remove(old)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// DeleteValidatorStorage forgets the validators for URL.
+// Nothing may be using the URL's ValidatorStorage at the time.
+func DeleteValidatorStorage(URL string) error {
+	err := os.Remove(validatorFilename(URL))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
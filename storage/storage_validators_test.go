@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidatorStorageLongURL(t *testing.T) {
+	useTempDataDir(t)
+	URL := "https://example.com/feed?q=" + strings.Repeat("x", 1000)
+
+	s := MakeValidatorStorage(URL)
+	saved := SavedValidators{Title: "Long", ETag: `"1"`}
+	if err := s.Set(saved); err != nil {
+		t.Fatal("Unexpected error saving validators: ", err)
+	}
+	if got := MakeValidatorStorage(URL).Get(); got != saved {
+		t.Error("Unexpected validators: ", got, ", expected ", saved)
+	}
+	if other := MakeValidatorStorage(URL + "y").Get(); other != (SavedValidators{}) {
+		t.Error("Validators shared with another URL: ", other)
+	}
+
+	if err := DeleteValidatorStorage(URL); err != nil {
+		t.Fatal(err)
+	}
+	if got := MakeValidatorStorage(URL).Get(); got != (SavedValidators{}) {
+		t.Error("Validators outlived their deletion: ", got)
+	}
+}
+
+func TestValidatorStorageAdoptsLegacyFile(t *testing.T) {
+	useTempDataDir(t)
+	URL := "https://example.com/feed"
+	legacy := "data/validators_" + url.QueryEscape(URL)
+	if err := ioutil.WriteFile(legacy, []byte(`{"Title":"Old","ETag":"\"1\""}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := MakeValidatorStorage(URL).Get(); got.Title != "Old" || got.ETag != `"1"` {
+		t.Error("Unexpected validators: ", got)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Error("Legacy file left behind: ", err)
+	}
+}
@@ -12,10 +12,14 @@ type ViewStorage struct {
 	filename        string
 	itemBufferedCap int
 
+	// Always taken in this order. Writing to disk needs both, with at
+	// least one of them held for writing, so writes don't overlap.
 	itemLock        sync.RWMutex
 	channelInfoLock sync.RWMutex
 
 	saved *SavedViewStorage
+	// Which feeds each story has come from; guarded by itemLock.
+	urlIndex *URLIndex
 }
 
 const (
@@ -53,6 +57,9 @@ func MakeViewStorage(key string, cap int) *ViewStorage {
 	s := &ViewStorage{
 		filename:        "data/" + path.Clean(key),
 		itemBufferedCap: cap,
+		// Stories are remembered long after they leave the view, since
+		// other feeds can be slow to pick them up.
+		urlIndex: MakeURLIndex(key+"_URL_INDEX", 10*cap),
 	}
 	if !s.LoadFromStorage() {
 		s.saved = &SavedViewStorage{
@@ -64,6 +71,15 @@ func MakeViewStorage(key string, cap int) *ViewStorage {
 	return s
 }
 
+// Flush writes everything out once more, after any write in progress.
+func (s *ViewStorage) Flush() {
+	s.itemLock.Lock()
+	defer s.itemLock.Unlock()
+	s.channelInfoLock.Lock()
+	defer s.channelInfoLock.Unlock()
+	s.DumpToStorage()
+}
+
 func (s *ViewStorage) GetCopyOfSomeItems(n int) []RssEntry {
 	s.itemLock.RLock()
 	defer s.itemLock.RUnlock()
@@ -78,20 +94,92 @@ func (s *ViewStorage) GetCopyOfSomeItems(n int) []RssEntry {
 	return itemListCopy
 }
 
+// AddItem places item at the back of the list. If another feed already
+// brought us the same story, item is folded into that entry instead; if that
+// entry has since been deleted, item is dropped.
 func (s *ViewStorage) AddItem(item *RssEntry) {
 	s.itemLock.Lock()
 	defer s.itemLock.Unlock()
+	s.channelInfoLock.RLock()
+	defer s.channelInfoLock.RUnlock()
+	s.addItem(item)
+	s.DumpToStorage()
+}
+
+// must hold s.itemLock
+func (s *ViewStorage) addItem(item *RssEntry) {
+	if item.URL == "" {
+		s.appendItem(item)
+		return
+	}
+	sources := s.urlIndex.Sources(item.URL)
+	s.urlIndex.AddSource(item.URL, item.FeedTitle)
+
+	canonical := CanonicalURL(item.URL)
+	for _, existing := range s.saved.ItemList {
+		if existing.FeedTitle == item.FeedTitle || CanonicalURL(existing.URL) != canonical {
+			continue
+		}
+		for _, title := range existing.AlsoIn {
+			if title == item.FeedTitle {
+				return
+			}
+		}
+		existing.AlsoIn = append(existing.AlsoIn, item.FeedTitle)
+		return
+	}
+	for _, source := range sources {
+		if source != item.FeedTitle {
+			// Shown once already, from another feed, and deleted since.
+			return
+		}
+	}
+	s.appendItem(item)
+}
+
+// must hold s.itemLock
+func (s *ViewStorage) appendItem(item *RssEntry) {
 	// Place new items at the BACK of the itemList.
 	s.saved.ItemList = append(s.saved.ItemList, item)
 	if len(s.saved.ItemList) > s.itemBufferedCap {
 		s.saved.ItemList = s.saved.ItemList[1:]
 	}
-	s.DumpToStorage()
+}
+
+// UpdateItem replaces the item with the same feed and ID as item, keeping its
+// place in the list and remembering what it said before. If it's no longer
+// in the list (the user deleted it, or it aged out), the update is dropped.
+func (s *ViewStorage) UpdateItem(item *RssEntry) {
+	s.itemLock.Lock()
+	defer s.itemLock.Unlock()
+	s.channelInfoLock.RLock()
+	defer s.channelInfoLock.RUnlock()
+	for i, existing := range s.saved.ItemList {
+		if existing.FeedTitle != item.FeedTitle || existing.ItemID != item.ItemID {
+			continue
+		}
+		item.State = existing.State
+		item.AlsoIn = existing.AlsoIn
+		if item.ItemDateEstimated && existing.ItemDateEstimated {
+			// It was first seen back then, not now.
+			item.ItemDate = existing.ItemDate
+		}
+		item.Previous = &RssEntryRevision{
+			ItemTitle:   existing.ItemTitle,
+			ItemSummary: existing.ItemSummary,
+			ItemContent: existing.ItemContent,
+		}
+		s.saved.ItemList[i] = item
+		s.DumpToStorage()
+		return
+	}
 }
 
 func (s *ViewStorage) DeleteItem(index int) error {
 	s.itemLock.Lock()
 	defer s.itemLock.Unlock()
+	s.channelInfoLock.RLock()
+	defer s.channelInfoLock.RUnlock()
 	if index < 0 || len(s.saved.ItemList) <= index {
 		return errors.New("DeleteItem: Attempting to access out of range item")
 	}
@@ -100,6 +188,38 @@ func (s *ViewStorage) DeleteItem(index int) error {
 	return nil
 }
 
+// PurgeFeed deletes every item which came from the feed with the given title,
+// along with the feed's channel info. Stories which other feeds also brought
+// us stay, under the next of those feeds.
+func (s *ViewStorage) PurgeFeed(title string) {
+	s.itemLock.Lock()
+	defer s.itemLock.Unlock()
+	s.channelInfoLock.Lock()
+	defer s.channelInfoLock.Unlock()
+
+	kept := s.saved.ItemList[:0]
+	for _, item := range s.saved.ItemList {
+		// A new slice, since copies handed out share the old one.
+		var alsoIn []string
+		for _, other := range item.AlsoIn {
+			if other != title {
+				alsoIn = append(alsoIn, other)
+			}
+		}
+		item.AlsoIn = alsoIn
+		if item.FeedTitle == title {
+			if len(item.AlsoIn) == 0 {
+				continue
+			}
+			item.FeedTitle, item.AlsoIn = item.AlsoIn[0], item.AlsoIn[1:]
+		}
+		kept = append(kept, item)
+	}
+	s.saved.ItemList = kept
+	delete(s.saved.ChannelInfoMap, title)
+	s.DumpToStorage()
+}
+
 func (s *ViewStorage) ChangeColor(index int) error {
 	s.itemLock.RLock()
 	defer s.itemLock.RUnlock()
@@ -142,16 +262,76 @@ func (s *ViewStorage) ChangeItemState(index int, expand bool) (RssEntryState, st
 	return s.saved.ItemList[index].State, ""
 }
 
+// GetChannelInfo returns a copy of the channel's info, or nil if the channel
+// isn't registered.
 func (s *ViewStorage) GetChannelInfo(title string) *ChannelInfo {
 	s.channelInfoLock.RLock()
 	defer s.channelInfoLock.RUnlock()
-	info := s.saved.ChannelInfoMap[title]
-	return info
+	info, ok := s.saved.ChannelInfoMap[title]
+	if !ok {
+		return nil
+	}
+	infoCopy := *info
+	return &infoCopy
+}
+
+// SetChannelMetadata records what a feed says about itself. The channel must
+// already have been registered with SetChannelInfo.
+func (s *ViewStorage) SetChannelMetadata(title string, metadata ChannelMetadata) {
+	s.itemLock.RLock()
+	defer s.itemLock.RUnlock()
+	s.channelInfoLock.Lock()
+	defer s.channelInfoLock.Unlock()
+	if info, ok := s.saved.ChannelInfoMap[title]; ok {
+		info.Metadata = metadata
+		s.DumpToStorage()
+	}
+}
+
+// SetChannelDisplayName changes what the channel is called on screen. An
+// empty name goes back to the channel's title.
+func (s *ViewStorage) SetChannelDisplayName(title, name string) {
+	s.itemLock.RLock()
+	defer s.itemLock.RUnlock()
+	s.channelInfoLock.Lock()
+	defer s.channelInfoLock.Unlock()
+	if info, ok := s.saved.ChannelInfoMap[title]; ok {
+		info.DisplayName = name
+		s.DumpToStorage()
+	}
+}
+
+// CountItemsByFeed returns how many items from each feed (by title) are
+// waiting in the view.
+func (s *ViewStorage) CountItemsByFeed() map[string]int {
+	s.itemLock.RLock()
+	defer s.itemLock.RUnlock()
+	counts := make(map[string]int)
+	for _, item := range s.saved.ItemList {
+		counts[item.FeedTitle]++
+	}
+	return counts
 }
 
 func (s *ViewStorage) SetChannelInfo(title string, info *ChannelInfo) {
+	s.itemLock.RLock()
+	defer s.itemLock.RUnlock()
+	s.channelInfoLock.Lock()
+	defer s.channelInfoLock.Unlock()
+	s.saved.ChannelInfoMap[title] = info
+	s.DumpToStorage()
+}
+
+// AddChannelInfo registers the channel with info, unless it's registered
+// already.
+func (s *ViewStorage) AddChannelInfo(title string, info *ChannelInfo) {
+	s.itemLock.RLock()
+	defer s.itemLock.RUnlock()
 	s.channelInfoLock.Lock()
 	defer s.channelInfoLock.Unlock()
+	if _, ok := s.saved.ChannelInfoMap[title]; ok {
+		return
+	}
 	s.saved.ChannelInfoMap[title] = info
 	s.DumpToStorage()
 }
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTempDataDir runs the test from an empty directory, so storage files
+// land somewhere harmless.
+func useTempDataDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestCanonicalURL(t *testing.T) {
+	tests := map[string]string{
+		"https://Example.com/post/1/?utm_source=rss&utm_medium=feed": "example.com/post/1",
+		"http://example.com:80/post/1#comments":                      "example.com/post/1",
+		"https://example.com/post?b=2&fbclid=xyz&a=1":                "example.com/post?a=1&b=2",
+		"not a link": "not a link",
+	}
+	for link, expected := range tests {
+		if canonical := CanonicalURL(link); canonical != expected {
+			t.Error("Unexpected canonical URL for ", link, ": ", canonical, ", expected ", expected)
+		}
+	}
+}
+
+func TestViewStorageFoldsDuplicates(t *testing.T) {
+	useTempDataDir(t)
+	s := MakeViewStorage("VIEW_STORAGE", 10)
+
+	s.AddItem(&RssEntry{FeedTitle: "Blog", ItemTitle: "A post", URL: "https://blog.example.com/a-post"})
+	s.AddItem(&RssEntry{FeedTitle: "Aggregator", ItemTitle: "A post", URL: "http://blog.example.com/a-post/?utm_source=agg"})
+	s.AddItem(&RssEntry{FeedTitle: "Aggregator", ItemTitle: "Another post", URL: "https://elsewhere.example.com/"})
+
+	items := s.GetCopyOfSomeItems(10)
+	if len(items) != 2 {
+		t.Fatal("Unexpected number of items: ", len(items), ", expected 2")
+	}
+	if len(items[0].AlsoIn) != 1 || items[0].AlsoIn[0] != "Aggregator" {
+		t.Error("Unexpected sources for the folded item: ", items[0].AlsoIn)
+	}
+
+	// Once deleted, the story stays gone, whichever feed brings it next.
+	if err := s.DeleteItem(0); err != nil {
+		t.Fatal(err)
+	}
+	s.AddItem(&RssEntry{FeedTitle: "Planet", ItemTitle: "A post", URL: "https://blog.example.com/a-post"})
+	if items = s.GetCopyOfSomeItems(10); len(items) != 1 || items[0].ItemTitle != "Another post" {
+		t.Error("A deleted story came back: ", items)
+	}
+}
+
+func TestViewStoragePurgeKeepsFoldedItems(t *testing.T) {
+	useTempDataDir(t)
+	s := MakeViewStorage("VIEW_STORAGE", 10)
+
+	s.AddItem(&RssEntry{FeedTitle: "Aggregator", ItemTitle: "A post", URL: "https://blog.example.com/a-post"})
+	s.AddItem(&RssEntry{FeedTitle: "Blog", ItemTitle: "A post", URL: "https://blog.example.com/a-post"})
+	s.PurgeFeed("Aggregator")
+
+	items := s.GetCopyOfSomeItems(10)
+	if len(items) != 1 || items[0].FeedTitle != "Blog" || len(items[0].AlsoIn) != 0 {
+		t.Error("Unexpected items after purge: ", items)
+	}
+}
+
+// Run with -race; items arrive, channels change and the view draws, all at
+// once.
+func TestViewStorageConcurrentAccess(t *testing.T) {
+	useTempDataDir(t)
+	s := MakeViewStorage("VIEW_STORAGE", 50)
+	s.AddChannelInfo("Blog", &ChannelInfo{})
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.AddItem(&RssEntry{FeedTitle: "Blog", ItemTitle: "Post", URL: "https://blog.example.com/" + strconv.Itoa(i)})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.SetChannelDisplayName("Blog", "My blog "+strconv.Itoa(i))
+			s.ChangeColor(0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			for _, item := range s.GetCopyOfSomeItems(10) {
+				if info := s.GetChannelInfo(item.FeedTitle); info == nil {
+					t.Error("Channel went missing")
+				}
+			}
+		}
+	}()
+	wg.Wait()
+
+	if items := s.GetCopyOfSomeItems(100); len(items) != 50 {
+		t.Error("Unexpected number of items: ", len(items), ", expected 50")
+	}
+}
+
+func TestViewStorageKeepsFirstSeenDate(t *testing.T) {
+	useTempDataDir(t)
+	s := MakeViewStorage("VIEW_STORAGE", 10)
+	firstSeen := time.Date(2016, 5, 31, 12, 0, 0, 0, time.UTC)
+
+	s.AddItem(&RssEntry{FeedTitle: "Blog", ItemID: "1", ItemTitle: "Undated", ItemDate: firstSeen, ItemDateEstimated: true})
+	s.UpdateItem(&RssEntry{FeedTitle: "Blog", ItemID: "1", ItemTitle: "Still undated", ItemDate: firstSeen.Add(time.Hour), ItemDateEstimated: true})
+	if items := s.GetCopyOfSomeItems(10); !items[0].ItemDate.Equal(firstSeen) {
+		t.Error("Unexpected date after an update: ", items[0].ItemDate, ", expected ", firstSeen)
+	}
+
+	// A real date, once there is one, wins.
+	published := firstSeen.Add(-time.Hour)
+	s.UpdateItem(&RssEntry{FeedTitle: "Blog", ItemID: "1", ItemTitle: "Dated", ItemDate: published})
+	if items := s.GetCopyOfSomeItems(10); !items[0].ItemDate.Equal(published) {
+		t.Error("Unexpected date after dating: ", items[0].ItemDate, ", expected ", published)
+	}
+}
+
+func TestViewStorageDropsUpdatesToDeletedItems(t *testing.T) {
+	useTempDataDir(t)
+	s := MakeViewStorage("VIEW_STORAGE", 10)
+
+	s.AddItem(&RssEntry{FeedTitle: "Blog", ItemID: "1", ItemTitle: "Post"})
+	if err := s.DeleteItem(0); err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateItem(&RssEntry{FeedTitle: "Blog", ItemID: "1", ItemTitle: "Post, edited"})
+	if items := s.GetCopyOfSomeItems(10); len(items) != 0 {
+		t.Error("Deleted item came back when it was edited: ", items[0].ItemTitle)
+	}
+}
+
+func TestFeedStorageConcurrentAccess(t *testing.T) {
+	useTempDataDir(t)
+	s := MakeFeedStorage("Feed", 50)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := strconv.Itoa(w*50 + i)
+				s.Add(key, key)
+				s.Get(strconv.Itoa(i))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// What was dumped last is all of it.
+	reloaded := MakeFeedStorage("Feed", 50)
+	if pairs := reloaded.Amap.Serialize(); len(pairs) != 50 {
+		t.Error("Unexpected number of items after reloading: ", len(pairs), ", expected 50")
+	}
+}
@@ -1,27 +1,21 @@
 package view
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
 
 	tb "github.com/nsf/termbox-go"
+	"github.com/smklein/toy-rss/download"
 	"github.com/smklein/toy-rss/storage"
 )
 
-// TODO(smklein): Use default colors
-var defaultFeedURLs = [...]string{
-	"http://feeds.arstechnica.com/arstechnica/index",
-	"https://news.ycombinator.com/rss",
-	"https://lwn.net/headlines/rss",
-	"http://feeds.feedburner.com/linuxjournalcom?format=xml",
-	"http://preshing.com/feed",
-	//"https://www.reddit.com/.rss",
-}
-
 func check(e error) {
 	if e != nil {
 		panic(e)
@@ -36,9 +30,24 @@ type view struct {
 	// Status Message
 	status StatusMsgStruct
 
+	// If set, the feed whose details are shown in place of the items.
+	detailsTitle string
+	// If set, every feed is listed in place of the items.
+	feedStatuses []FeedStatus
+	// If set, what changed in an updated item, shown in place of the items.
+	itemDiff []diffLine
+	// Where dates are shown in. Only set before Start.
+	timezone *time.Location
+
 	// Synchronization tools
 	viewLock sync.RWMutex
-	deathWg  *sync.WaitGroup
+	// Cancelled when it's time to stop. Requests made after that are
+	// dropped, since nobody is left to handle them.
+	ctx context.Context
+	// Counts drawLoop and listUpdater. Once both have returned, "done" is
+	// closed.
+	stopped sync.WaitGroup
+	done    chan bool
 
 	// Mechanism to interact with input (presumeably keyboard)
 	inputManager *InputManager
@@ -46,24 +55,29 @@ type view struct {
 	// Blocks redraw loop, closes termbox, opens browser.
 	openArticleRequest chan string
 
-	// When this is closed, GTFO.
+	// Closed when the user asks to quit.
 	exitRequest chan bool
 
 	// INCOMING
 	setStatusRequest   chan StatusMsgStruct
 	redrawRequest      chan bool
-	deleteItemRequest  chan int /* Item Index */
-	changeColorRequest chan int /* Item Index */
+	deleteItemRequest  chan int    /* Item Index */
+	changeColorRequest chan int    /* Item Index */
+	purgeFeedRequest   chan string /* Feed Title */
+
+	// OUTGOING
+	downloadRequest chan storage.RssEntry
 }
 
 // Start launches the view. Undefined to call multiple times.
-func (v *view) Start(newItemPipe chan *storage.RssEntry, newFeedRequest chan string, deathWg *sync.WaitGroup) {
+func (v *view) Start(ctx context.Context, newItemPipe chan *storage.RssEntry, newFeedRequest chan string, commandRequest chan Command) {
 	log.Println("View Start called")
 	v.viewLock.Lock()
 	// TODO(smklein): This size should be configurable.
 	v.storage = storage.MakeViewStorage("VIEW_STORAGE", 200)
 
-	v.deathWg = deathWg
+	v.ctx = ctx
+	v.done = make(chan bool)
 
 	v.inputManager = new(InputManager)
 	v.openArticleRequest = make(chan string)
@@ -73,45 +87,161 @@ func (v *view) Start(newItemPipe chan *storage.RssEntry, newFeedRequest chan str
 	v.redrawRequest = make(chan bool)
 	v.deleteItemRequest = make(chan int)
 	v.changeColorRequest = make(chan int)
+	v.purgeFeedRequest = make(chan string)
+	v.downloadRequest = make(chan storage.RssEntry, 10)
 	v.viewLock.Unlock()
 
-	v.inputManager.Start(newFeedRequest, v)
+	v.inputManager.Start(ctx, newFeedRequest, commandRequest, v)
 
+	v.stopped.Add(2)
 	go v.listUpdater(newItemPipe)
 	go v.drawLoop()
-
-	// First, register the default feeds that we want to have enabled.
-	// TODO(smklein): This will... probably change form once we have a
-	// persistant storage story.
 	go func() {
-		for i := range defaultFeedURLs {
-			newFeedRequest <- defaultFeedURLs[i]
-		}
+		v.stopped.Wait()
+		close(v.done)
 	}()
 	log.Println("View Start Complete")
 }
 
+func (v *view) SetTimezone(loc *time.Location) {
+	v.timezone = loc
+}
+
+// Long enough to tell items apart, short enough for a column.
+const itemDateLayout = "Mon Jan _2 15:04:05"
+
+// formatDate shows t in the user's timezone.
+func (v *view) formatDate(t time.Time, layout string) string {
+	if v.timezone != nil {
+		t = t.In(v.timezone)
+	} else {
+		t = t.Local()
+	}
+	return t.Format(layout)
+}
+
+func (v *view) Done() chan bool {
+	return v.done
+}
+
 func (v *view) GetChanExitRequest() chan bool {
 	return v.exitRequest
 }
+func (v *view) GetChanDownloadRequest() chan storage.RssEntry {
+	return v.downloadRequest
+}
 func (v *view) DeleteItem(i int) {
-	v.deleteItemRequest <- i
+	select {
+	case v.deleteItemRequest <- i:
+	case <-v.ctx.Done():
+	}
 }
 func (v *view) SetStatus(status StatusMsgStruct) {
-	v.setStatusRequest <- status
+	select {
+	case v.setStatusRequest <- status:
+	case <-v.ctx.Done():
+	}
 }
 func (v *view) ChangeColor(i int) {
-	v.changeColorRequest <- i
+	select {
+	case v.changeColorRequest <- i:
+	case <-v.ctx.Done():
+	}
+}
+func (v *view) PurgeFeed(title string) {
+	select {
+	case v.purgeFeedRequest <- title:
+	case <-v.ctx.Done():
+	}
 }
 func (v *view) Redraw() {
-	v.redrawRequest <- true
+	select {
+	case v.redrawRequest <- true:
+	case <-v.ctx.Done():
+	}
 }
 func (v *view) AddChannelInfo(title string) {
 	info := &storage.ChannelInfo{
 		ChannelColor: fgColor,
 	}
-	if v.storage.GetChannelInfo(title) == nil {
-		v.storage.SetChannelInfo(title, info)
+	v.storage.AddChannelInfo(title, info)
+}
+func (v *view) SetChannelMetadata(title string, metadata storage.ChannelMetadata) {
+	// Metadata can beat AddChannelInfo here; register the channel if so.
+	v.AddChannelInfo(title)
+	v.storage.SetChannelMetadata(title, metadata)
+	v.Redraw()
+}
+func (v *view) SetChannelDisplayName(title, name string) {
+	v.AddChannelInfo(title)
+	v.storage.SetChannelDisplayName(title, name)
+	v.Redraw()
+}
+func (v *view) ShowFeedStatuses(statuses []FeedStatus) {
+	v.viewLock.Lock()
+	v.feedStatuses = statuses
+	v.viewLock.Unlock()
+	v.Redraw()
+}
+func (v *view) HideFeedStatuses() {
+	v.viewLock.Lock()
+	v.feedStatuses = nil
+	v.viewLock.Unlock()
+}
+func (v *view) GetFeedStatusURL(index int) string {
+	v.viewLock.RLock()
+	defer v.viewLock.RUnlock()
+	if index < 0 || len(v.feedStatuses) <= index {
+		return ""
+	}
+	return v.feedStatuses[index].URL
+}
+func (v *view) ShowFeedDetails(index int) {
+	items := v.storage.GetCopyOfSomeItems(index + 1)
+	if index < 0 || len(items) <= index {
+		return
+	}
+	v.viewLock.Lock()
+	v.detailsTitle = items[index].FeedTitle
+	v.viewLock.Unlock()
+}
+func (v *view) ShowItemDiff(index int) bool {
+	items := v.storage.GetCopyOfSomeItems(index + 1)
+	if index < 0 || len(items) <= index {
+		return false
+	}
+	diff := diffItem(items[index])
+	if diff == nil {
+		v.SetStatus(StatusMsgStruct{Message: "This item has not been updated", Type: StatusError})
+		return false
+	}
+	v.viewLock.Lock()
+	v.itemDiff = diff
+	v.viewLock.Unlock()
+	return true
+}
+func (v *view) HideItemDiff() {
+	v.viewLock.Lock()
+	v.itemDiff = nil
+	v.viewLock.Unlock()
+}
+func (v *view) HideFeedDetails() {
+	v.viewLock.Lock()
+	v.detailsTitle = ""
+	v.viewLock.Unlock()
+}
+func (v *view) DownloadEnclosure(index int) {
+	items := v.storage.GetCopyOfSomeItems(index + 1)
+	if index < 0 || len(items) <= index {
+		return
+	}
+	if len(items[index].Enclosures) == 0 {
+		v.SetStatus(StatusMsgStruct{Message: "Nothing to download for this item", Type: StatusError})
+		return
+	}
+	select {
+	case v.downloadRequest <- items[index]:
+	case <-v.ctx.Done():
 	}
 }
 func (v *view) CollapseItem(index int) {
@@ -125,7 +255,10 @@ func (v *view) ExpandItem(index int) {
 	if newState == storage.BrowserEntryState {
 		//cmd := exec.Command("w3m -dump", url)
 		log.Println("Would have shown: ", url)
-		v.openArticleRequest <- url
+		select {
+		case v.openArticleRequest <- url:
+		case <-v.ctx.Done():
+		}
 
 		/*
 			cmd := exec.Command("tmux", "split-window", "-h", "\"w3m -dump test_server/test_files/birds.html | less\"")
@@ -141,11 +274,35 @@ func (v *view) ExpandItem(index int) {
 	}
 }
 
+func (v *view) addOrUpdateItem(item *storage.RssEntry) {
+	if item.Updated {
+		v.storage.UpdateItem(item)
+	} else {
+		v.storage.AddItem(item)
+	}
+}
+
+// listUpdater stores items until newItemPipe is closed, which happens once
+// every feed has stopped; it outlives the drawLoop, so no item is lost.
 func (v *view) listUpdater(newItemPipe chan *storage.RssEntry) {
+	defer v.stopped.Done()
 	for {
-		item := <-newItemPipe
-		v.storage.AddItem(item)
-		v.redrawRequest <- true
+		select {
+		case item, ok := <-newItemPipe:
+			if !ok {
+				v.storage.Flush()
+				return
+			}
+			v.addOrUpdateItem(item)
+		case title := <-v.purgeFeedRequest:
+			// Anything the feed sent before it ended is already queued. Add
+			// it first, so the purge catches it too.
+			for len(newItemPipe) > 0 {
+				v.addOrUpdateItem(<-newItemPipe)
+			}
+			v.storage.PurgeFeed(title)
+		}
+		v.Redraw()
 	}
 }
 
@@ -170,6 +327,7 @@ func (v *view) tryToChangeItemColor(index int) {
 }
 
 func (v *view) drawLoop() {
+	defer v.stopped.Done()
 	// Initialize termbox-go
 	check(tb.Init())
 
@@ -196,9 +354,10 @@ func (v *view) drawLoop() {
 			}
 
 			tb.Init()
-		case <-v.exitRequest:
+		case <-v.ctx.Done():
+			// Wake up reactToKeys, so it notices too.
+			tb.Interrupt()
 			tb.Close()
-			v.deathWg.Done()
 			return
 		}
 	}
@@ -218,11 +377,19 @@ func getStatusColor(sType StatusType) tb.Attribute {
 }
 
 func formatToLen(r []rune, l int) []rune {
-	if len(r) > l {
-		return append(r[:l-3], []rune("...")...)
-	} else {
+	if len(r) <= l {
 		return r
 	}
+	if l < 3 {
+		// No room for an ellipsis; on a narrow enough terminal, none at
+		// all.
+		if l < 0 {
+			l = 0
+		}
+		return r[:l]
+	}
+	// Copied, so the caller's runes aren't overwritten.
+	return append(append([]rune{}, r[:l-3]...), []rune("...")...)
 }
 
 type lineElement struct {
@@ -259,7 +426,7 @@ func (v *view) redrawCollapsedState(width, startLine int, item storage.RssEntry,
 	// [Time] [Feed Title] [ItemTitle]
 	redrawLine(width, startLine, []lineElement{
 		{
-			contents: []rune(item.ItemDate.Format(time.UnixDate))[:20],
+			contents: []rune(v.formatDate(item.ItemDate, itemDateLayout)),
 			maxLen:   20,
 			color:    fgColor,
 		},
@@ -282,7 +449,7 @@ func (v *view) redrawStandardState(width, startLine int, item storage.RssEntry,
 	//   [ItemTitle]
 	redrawLine(width, startLine-1, []lineElement{
 		{
-			contents: []rune(item.ItemDate.Format(time.UnixDate))[:20],
+			contents: []rune(v.formatDate(item.ItemDate, itemDateLayout)),
 			maxLen:   20,
 			color:    fgColor,
 		},
@@ -303,18 +470,24 @@ func (v *view) redrawStandardState(width, startLine int, item storage.RssEntry,
 }
 
 func (v *view) redrawExpandedState(width, startLine int, item storage.RssEntry, itemFgColor, metadataFgColor tb.Attribute) int {
-	// [Time] [Feed Title]
+	// [Time] [Feed Title] [Date as published]
 	//   [ItemTitle]
 	//   [URL]
+	//   [Enclosure] (if any)
 	redrawLine(width, startLine-2, []lineElement{
 		{
-			contents: []rune(item.ItemDate.Format(time.UnixDate))[:20],
+			contents: []rune(v.formatDate(item.ItemDate, itemDateLayout)),
 			maxLen:   20,
 			color:    fgColor,
 		},
 		{
 			contents: []rune(item.FeedTitle),
-			maxLen:   80,
+			maxLen:   60,
+			color:    metadataFgColor,
+		},
+		{
+			contents: []rune(publishedAs(item)),
+			maxLen:   60,
 			color:    metadataFgColor,
 		},
 	})
@@ -326,7 +499,7 @@ func (v *view) redrawExpandedState(width, startLine int, item storage.RssEntry,
 		},
 	})
 
-	redrawLine(width, startLine, []lineElement{
+	redrawLine(width, startLine-enclosureLines(item), []lineElement{
 		{
 			contents: append([]rune("  "), []rune(item.URL)...),
 			maxLen:   120,
@@ -334,7 +507,57 @@ func (v *view) redrawExpandedState(width, startLine int, item storage.RssEntry,
 		},
 	})
 
-	return 3
+	if enclosureLines(item) == 0 {
+		return 3
+	}
+	// [Type, Length] [Enclosure URL]
+	enclosure := item.Enclosures[0]
+	description := enclosure.Type
+	if enclosure.Length > 0 {
+		if description != "" {
+			description += ", "
+		}
+		description += download.FormatSize(enclosure.Length)
+	}
+	if len(item.Enclosures) > 1 {
+		description += " +" + strconv.Itoa(len(item.Enclosures)-1) + " more"
+	}
+	redrawLine(width, startLine, []lineElement{
+		{
+			contents: []rune("  [" + description + "]"),
+			maxLen:   40,
+			color:    metadataFgColor,
+		},
+		{
+			contents: []rune(enclosure.URL),
+			maxLen:   100,
+			color:    itemFgColor,
+		},
+	})
+	return 4
+}
+
+// publishedAs explains the item's date, if the one shown isn't simply the
+// feed's.
+func publishedAs(item storage.RssEntry) string {
+	switch {
+	case item.ItemDateEstimated && item.ItemRawDate == "":
+		return "(undated; first seen)"
+	case item.ItemDateEstimated:
+		return "(dated " + item.ItemRawDate + "; first seen)"
+	case item.ItemRawDate != "":
+		return "(published " + item.ItemRawDate + ")"
+	}
+	return ""
+}
+
+// enclosureLines is how many extra lines the expanded state needs to show the
+// item's attachments.
+func enclosureLines(item storage.RssEntry) int {
+	if len(item.Enclosures) == 0 {
+		return 0
+	}
+	return 1
 }
 
 func (v *view) redrawRssItem(width, startLine, itemIndex, inputItemIndex int, inputMode InputType, itemListCopy []storage.RssEntry) int {
@@ -348,6 +571,22 @@ func (v *view) redrawRssItem(width, startLine, itemIndex, inputItemIndex int, in
 	}
 	if chInfo := v.storage.GetChannelInfo(item.FeedTitle); chInfo != nil {
 		metadataFgColor = chInfo.ChannelColor
+		if chInfo.DisplayName != "" {
+			item.FeedTitle = chInfo.DisplayName
+		}
+	}
+	if item.Updated {
+		item.ItemTitle = "(updated) " + item.ItemTitle
+	}
+	if len(item.AlsoIn) > 0 {
+		names := make([]string, len(item.AlsoIn))
+		for i, title := range item.AlsoIn {
+			names[i] = title
+			if chInfo := v.storage.GetChannelInfo(title); chInfo != nil && chInfo.DisplayName != "" {
+				names[i] = chInfo.DisplayName
+			}
+		}
+		item.ItemTitle += " (also in: " + strings.Join(names, ", ") + ")"
 	}
 
 	linesUsed := 0
@@ -368,7 +607,7 @@ func (v *view) redrawRssItem(width, startLine, itemIndex, inputItemIndex int, in
 			linesUsed = v.redrawStandardState(
 				width, startLine, item, itemFgColor, metadataFgColor)
 		case storage.ExpandedEntryState:
-			if startLine <= 3 {
+			if startLine <= 3+enclosureLines(item) {
 				state = storage.CollapseEntryState(state)
 				continue
 			}
@@ -383,6 +622,157 @@ func (v *view) redrawRssItem(width, startLine, itemIndex, inputItemIndex int, in
 	return linesUsed
 }
 
+// redrawFeedDetails shows everything we know about a single feed, from the
+// bottom up, ending at lastLine.
+func (v *view) redrawFeedDetails(width, lastLine int, title string) {
+	titleColor := fgColor
+	var metadata storage.ChannelMetadata
+	if chInfo := v.storage.GetChannelInfo(title); chInfo != nil {
+		titleColor = chInfo.ChannelColor
+		metadata = chInfo.Metadata
+	}
+	lastUpdated := "unknown"
+	if !metadata.LastUpdated.IsZero() {
+		lastUpdated = v.formatDate(metadata.LastUpdated, time.UnixDate)
+	}
+
+	details := [][2]string{
+		{"Feed", title},
+		{"Description", metadata.Description},
+		{"Site", metadata.SiteLink},
+		{"Image", metadata.ImageURL},
+		{"Language", metadata.Language},
+		{"Categories", strings.Join(metadata.Categories, ", ")},
+		{"Generator", metadata.Generator},
+		{"Last updated", lastUpdated},
+		{"", "[any key]:Back"},
+	}
+	line := lastLine - len(details) + 1
+	for _, detail := range details {
+		if line > 0 {
+			redrawLine(width, line, []lineElement{
+				{
+					contents: []rune(detail[0]),
+					maxLen:   14,
+					color:    titleColor,
+				},
+				{
+					contents: []rune(detail[1]),
+					maxLen:   width - 16,
+					color:    fgColor,
+				},
+			})
+		}
+		line++
+	}
+}
+
+// redrawItemDiff shows what changed in an item, ending at lastLine.
+func (v *view) redrawItemDiff(width, lastLine int, diff []diffLine) {
+	if lastLine < 1 {
+		return
+	}
+	// Show as much as fits, from the top.
+	if len(diff) > lastLine-1 {
+		diff = diff[:lastLine-1]
+	}
+	line := lastLine - len(diff)
+	for _, d := range diff {
+		prefix, color := "  ", fgColor
+		switch d.op {
+		case diffAdd:
+			prefix, color = "+ ", tb.ColorGreen|tb.AttrBold
+		case diffRemove:
+			prefix, color = "- ", tb.ColorRed
+		}
+		redrawLine(width, line, []lineElement{
+			{
+				contents: []rune(prefix + d.text),
+				maxLen:   width,
+				color:    color,
+			},
+		})
+		line++
+	}
+	redrawLine(width, lastLine, []lineElement{
+		{
+			contents: []rune("[any key]:Back"),
+			maxLen:   width,
+			color:    fgColor,
+		},
+	})
+}
+
+// redrawFeedStatuses lists every feed, from the bottom up, starting at
+// startLine. Returns how many feeds fit.
+func (v *view) redrawFeedStatuses(width, startLine, inputItemIndex int, inputMode InputType, statuses []FeedStatus) int {
+	unread := v.storage.CountItemsByFeed()
+
+	line := startLine
+	index := 0
+	for ; index < len(statuses) && line > 1; index++ {
+		status := statuses[index]
+		nameColor := fgColor
+		if chInfo := v.storage.GetChannelInfo(status.Title); chInfo != nil {
+			nameColor = chInfo.ChannelColor
+		}
+		if inputMode == FeedsStatusMode && inputItemIndex == index {
+			nameColor = tb.ColorBlue | tb.AttrUnderline
+		}
+		stateColor := tb.ColorGreen
+		if status.State != "healthy" {
+			stateColor = tb.ColorRed
+		}
+		lastNew := "never"
+		if !status.Health.LastNewItem.IsZero() {
+			lastNew = v.formatDate(status.Health.LastNewItem, "Jan _2 15:04")
+		}
+		problem := ""
+		if status.Health.ConsecutiveFailures > 0 {
+			problem = status.Health.LastErrorMessage
+		}
+
+		redrawLine(width, line, []lineElement{
+			{
+				contents: []rune(status.State),
+				maxLen:   12,
+				color:    stateColor,
+			},
+			{
+				contents: []rune(status.Name),
+				maxLen:   30,
+				color:    nameColor,
+			},
+			{
+				contents: []rune(strconv.Itoa(unread[status.Title]) + " unread"),
+				maxLen:   12,
+				color:    fgColor,
+			},
+			{
+				contents: []rune("new: " + lastNew),
+				maxLen:   17,
+				color:    fgColor,
+			},
+			{
+				contents: []rune(problem),
+				maxLen:   width,
+				color:    tb.ColorRed,
+			},
+		})
+		line--
+	}
+	if line > 0 {
+		redrawLine(width, line, []lineElement{
+			{
+				contents: []rune("Feeds (" + strconv.Itoa(len(statuses)) + ")"),
+				maxLen:   width,
+				color:    fgColor | tb.AttrBold,
+			},
+		})
+	}
+	return index
+}
+
 var fgColor tb.Attribute = tb.ColorGreen
 var blankFgColor tb.Attribute = tb.ColorGreen
 var bgColor tb.Attribute = tb.ColorDefault
@@ -439,6 +829,9 @@ func (v *view) redrawAll() {
 	v.viewLock.RLock()
 	statusString := v.status.Message
 	statusColor := getStatusColor(v.status.Type)
+	detailsTitle := v.detailsTitle
+	feedStatuses := v.feedStatuses
+	itemDiff := v.itemDiff
 	v.viewLock.RUnlock()
 
 	// The largest possible number of items in view.
@@ -461,7 +854,21 @@ func (v *view) redrawAll() {
 
 	// While another entry can fit...
 	itemIndex := 0
-	for rssEntryLine > 1 {
+	showingItems := false
+	switch {
+	case feedStatuses != nil:
+		itemIndex = v.redrawFeedStatuses(w, rssEntryLine, inputItemIndex, inputMode, feedStatuses)
+	case itemDiff != nil:
+		v.redrawItemDiff(w, rssEntryLine, itemDiff)
+		itemIndex = numItemsInView
+	case detailsTitle != "":
+		v.redrawFeedDetails(w, rssEntryLine, detailsTitle)
+		// Leave the selection where it was.
+		itemIndex = numItemsInView
+	default:
+		showingItems = true
+	}
+	for showingItems && rssEntryLine > 1 {
 		if itemIndex >= numItemsInView {
 			break
 		}
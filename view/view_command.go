@@ -0,0 +1,23 @@
+package view
+
+import "strings"
+
+// Command is an instruction typed into the entry line instead of a URL.
+// Commands are written as ":name arg1 arg2 ...".
+type Command struct {
+	Name string
+	Args []string
+}
+
+// parseCommand splits up the user's input, if it is a command.
+func parseCommand(input string) (cmd Command, ok bool) {
+	input = strings.TrimSpace(input)
+	if !strings.HasPrefix(input, ":") {
+		return cmd, false
+	}
+	fields := strings.Fields(input[1:])
+	if len(fields) == 0 {
+		return cmd, false
+	}
+	return Command{Name: fields[0], Args: fields[1:]}, true
+}
@@ -0,0 +1,103 @@
+package view
+
+// This file works out what changed when a feed updates an item.
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+// diffOp says whether a line was kept, added or removed.
+type diffOp uint8
+
+const (
+	diffKeep diffOp = iota
+	diffAdd
+	diffRemove
+)
+
+type diffLine struct {
+	op   diffOp
+	text string
+}
+
+var (
+	htmlBreakRegexp = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|li|h[1-6]|tr|blockquote)>`)
+	htmlTagRegexp   = regexp.MustCompile(`<[^>]*>`)
+)
+
+// revisionLines turns an item's text into lines worth comparing, dropping
+// HTML markup.
+func revisionLines(revision storage.RssEntryRevision) []string {
+	lines := []string{"Title: " + revision.ItemTitle}
+	for _, text := range []string{revision.ItemSummary, revision.ItemContent} {
+		text = htmlBreakRegexp.ReplaceAllString(text, "\n")
+		text = html.UnescapeString(htmlTagRegexp.ReplaceAllString(text, ""))
+		for _, line := range strings.Split(text, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines
+}
+
+// diffLines compares two versions of some text, line by line, using their
+// longest common subsequence.
+func diffLines(before, after []string) []diffLine {
+	// common[i][j] is the LCS length of before[i:] and after[j:].
+	common := make([][]int, len(before)+1)
+	for i := range common {
+		common[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			if before[i] == after[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	var diff []diffLine
+	i, j := 0, 0
+	for i < len(before) && j < len(after) {
+		switch {
+		case before[i] == after[j]:
+			diff = append(diff, diffLine{diffKeep, before[i]})
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			diff = append(diff, diffLine{diffRemove, before[i]})
+			i++
+		default:
+			diff = append(diff, diffLine{diffAdd, after[j]})
+			j++
+		}
+	}
+	for ; i < len(before); i++ {
+		diff = append(diff, diffLine{diffRemove, before[i]})
+	}
+	for ; j < len(after); j++ {
+		diff = append(diff, diffLine{diffAdd, after[j]})
+	}
+	return diff
+}
+
+// diffItem shows what changed in the item's latest update.
+func diffItem(item storage.RssEntry) []diffLine {
+	if item.Previous == nil {
+		return nil
+	}
+	return diffLines(revisionLines(*item.Previous), revisionLines(storage.RssEntryRevision{
+		ItemTitle:   item.ItemTitle,
+		ItemSummary: item.ItemSummary,
+		ItemContent: item.ItemContent,
+	}))
+}
@@ -0,0 +1,52 @@
+package view
+
+import (
+	"testing"
+
+	"github.com/smklein/toy-rss/storage"
+)
+
+func TestDiffLines(t *testing.T) {
+	before := []string{"a", "b", "c", "d"}
+	after := []string{"a", "c", "d", "e"}
+	expected := []diffLine{
+		{diffKeep, "a"},
+		{diffRemove, "b"},
+		{diffKeep, "c"},
+		{diffKeep, "d"},
+		{diffAdd, "e"},
+	}
+	diff := diffLines(before, after)
+	if len(diff) != len(expected) {
+		t.Fatal("Unexpected diff: ", diff, ", expected ", expected)
+	}
+	for i := range expected {
+		if diff[i] != expected[i] {
+			t.Error("Unexpected diff line ", i, ": ", diff[i], ", expected ", expected[i])
+		}
+	}
+}
+
+func TestDiffItem(t *testing.T) {
+	item := storage.RssEntry{
+		ItemTitle:   "Live: the launch",
+		ItemContent: "<p>T-minus 10</p><p>Liftoff!</p>",
+		Previous: &storage.RssEntryRevision{
+			ItemTitle:   "Live: the launch",
+			ItemContent: "<p>T-minus 10</p>",
+		},
+	}
+	diff := diffItem(item)
+	if len(diff) != 3 || diff[2] != (diffLine{diffAdd, "Liftoff!"}) {
+		t.Error("Unexpected diff: ", diff)
+	}
+	for _, line := range diff[:2] {
+		if line.op != diffKeep {
+			t.Error("Unexpected change: ", line)
+		}
+	}
+
+	if diff := diffItem(storage.RssEntry{ItemTitle: "Never updated"}); diff != nil {
+		t.Error("Unexpected diff for an item that was never updated: ", diff)
+	}
+}
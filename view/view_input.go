@@ -6,6 +6,7 @@ package view
 //  while using the RSS reader.
 
 import (
+	"context"
 	"log"
 	"os"
 	"sync"
@@ -22,6 +23,12 @@ const (
 	RssEntryMode InputType = iota
 	// RssSelectionMode means the user is picking an RSS entry.
 	RssSelectionMode
+	// FeedDetailsMode means the user is looking at the details of one feed.
+	FeedDetailsMode
+	// FeedsStatusMode means the user is picking from the list of feeds.
+	FeedsStatusMode
+	// ItemDiffMode means the user is looking at what changed in an item.
+	ItemDiffMode
 )
 
 type InputManager struct {
@@ -30,81 +37,145 @@ type InputManager struct {
 	inputTextLock sync.RWMutex
 	// Is the user in typing, selection mode, or... ?
 	inputMode InputType
+	// A feed the user asked to remove, waiting for them to say yes or no.
+	// Only reactToKeys touches it.
+	pendingRemoval string
 	// The item the user is selecting (and the max item they CAN select).
 	inputItemIndex       int
 	inputNumItemsVisible int
+	// Guards inputMode, inputItemIndex and inputNumItemsVisible: keys change
+	// them, while the view reads them to draw. Never held while calling the
+	// view, which may be waiting to call us.
+	stateLock sync.RWMutex
 
 	// Outgoing requests (made BY the InputManager)
 	sharedChanNewFeedRequest chan string /* Whatever the user has inputted */
+	sharedChanCommandRequest chan Command
 
 	// View which created us.
 	view ViewInterface
 
-	// Incoming requests (made TO the InputManager)
-	chanSetLastSeenNumItems chan int
-	chanGetSelectionMode    chan InputType
-	chanGetItemIndex        chan int
-	chanGetInputString      chan string
-
-	// Global exit request. When this is closed, GTFO.
+	// Closed when the user asks to quit.
 	exitRequest chan bool
+	exitOnce    sync.Once
+	// Cancelled once the reader is shutting down.
+	ctx context.Context
 }
 
-func (im *InputManager) Start(sharedChanNewFeedRequest chan string, v ViewInterface) {
+func (im *InputManager) Start(ctx context.Context, sharedChanNewFeedRequest chan string, sharedChanCommandRequest chan Command, v ViewInterface) {
 	log.Println("InputManager Start")
+	im.ctx = ctx
 	im.sharedChanNewFeedRequest = sharedChanNewFeedRequest
+	im.sharedChanCommandRequest = sharedChanCommandRequest
 
 	im.view = v
-	im.chanSetLastSeenNumItems = make(chan int)
-	im.chanGetSelectionMode = make(chan InputType)
-	im.chanGetItemIndex = make(chan int)
-	im.chanGetInputString = make(chan string)
 	im.exitRequest = v.GetChanExitRequest()
 
-	// These two threads comprise the entire input.
-	go im.respondToView()
+	// This thread comprises the entire input.
 	go im.reactToKeys()
 	log.Println("InputManager Start complete")
 }
 
-// Channel requests (no response expected)
+// Requests from the view.
 
 func (im *InputManager) SetLastSeenNumItems(i int) {
-	im.chanSetLastSeenNumItems <- i
+	im.stateLock.Lock()
+	defer im.stateLock.Unlock()
+	im.inputNumItemsVisible = i
+	if im.inputItemIndex >= i {
+		im.inputItemIndex = i - 1
+	}
 }
 
-// Channel requests (responses expected)
-
 func (im *InputManager) GetSelectionMode() InputType {
-	im.chanGetSelectionMode <- 0
-	return <-im.chanGetSelectionMode
+	im.stateLock.RLock()
+	defer im.stateLock.RUnlock()
+	return im.inputMode
 }
 func (im *InputManager) GetItemIndex() int {
-	im.chanGetItemIndex <- 0
-	return <-im.chanGetItemIndex
+	im.stateLock.RLock()
+	defer im.stateLock.RUnlock()
+	return im.inputItemIndex
 }
 func (im *InputManager) GetInputString() string {
-	im.chanGetInputString <- ""
-	return <-im.chanGetInputString
+	return im.inputTextAsString()
+}
+
+// setInputMode switches modes. If resetIndex is set, the selection goes back
+// to the first item.
+func (im *InputManager) setInputMode(mode InputType, resetIndex bool) {
+	im.stateLock.Lock()
+	defer im.stateLock.Unlock()
+	im.inputMode = mode
+	if resetIndex {
+		im.inputItemIndex = 0
+	}
+}
+
+// requestExit tells main the user wants to quit. Keys pressed while it shuts
+// down can ask again.
+func (im *InputManager) requestExit() {
+	im.exitOnce.Do(func() { close(im.exitRequest) })
+}
+
+// sendCommand hands cmd to main, unless it has stopped listening.
+func (im *InputManager) sendCommand(cmd Command) {
+	select {
+	case im.sharedChanCommandRequest <- cmd:
+	case <-im.ctx.Done():
+	}
 }
 
 // Functions for switching Selection Modes
 
 func (im *InputManager) enterRssSelectionMode() {
-	im.inputMode = RssSelectionMode
-	im.inputItemIndex = 0
-	im.view.SetStatus(StatusMsgStruct{"[↑/↓/j/k]:Move [→/l/ENTER]:Expand [←/h/q]:Collapse [BACKSPACE]:Delete [SPACE]:Color [TAB]:URL entry", StatusInfo})
+	im.setInputMode(RssSelectionMode, true)
+	im.view.HideFeedStatuses()
+	im.view.SetStatus(StatusMsgStruct{"[↑/↓/j/k]:Move [→/l/ENTER]:Expand [←/h/q]:Collapse [BACKSPACE]:Delete [SPACE]:Color [d]:Download [c]:Changes [i]:Feed details [f]:Feeds [TAB]:URL entry", StatusInfo})
+}
+
+func (im *InputManager) enterFeedDetailsMode() {
+	im.setInputMode(FeedDetailsMode, false)
+	im.view.ShowFeedDetails(im.GetItemIndex())
+}
+
+func (im *InputManager) leaveFeedDetailsMode() {
+	im.view.HideFeedDetails()
+	im.enterRssSelectionMode()
+}
+
+func (im *InputManager) enterItemDiffMode() {
+	if im.view.ShowItemDiff(im.GetItemIndex()) {
+		im.setInputMode(ItemDiffMode, false)
+	}
+}
+
+func (im *InputManager) leaveItemDiffMode() {
+	im.view.HideItemDiff()
+	im.enterRssSelectionMode()
+}
+
+const feedsStatusHelp = "[↑/↓/j/k]:Move [r]:Refresh [n]:Rename [BACKSPACE/x]:Remove [←/h/q/TAB]:Back"
+
+func (im *InputManager) enterFeedsStatusMode() {
+	im.setInputMode(FeedsStatusMode, true)
+	im.pendingRemoval = ""
+	im.view.SetStatus(StatusMsgStruct{feedsStatusHelp, StatusInfo})
+	// Whoever handles commands fills in the screen.
+	im.sendCommand(Command{Name: "feeds"})
 }
 
 func (im *InputManager) enterRssEntryMode() {
-	im.inputMode = RssEntryMode
-	im.view.SetStatus(StatusMsgStruct{"Enter the URL of an RSS feed to follow [ENTER]:Submit [TAB]:Item Selection Mode", StatusInfo})
+	im.setInputMode(RssEntryMode, false)
+	im.view.SetStatus(StatusMsgStruct{"Enter the URL of an RSS feed to follow, or a :command (:help lists them) [ENTER]:Submit [TAB]:Item Selection Mode", StatusInfo})
 
 }
 
 // Key actions
 
 func (im *InputManager) keyActionUpSelectionMode() {
+	im.stateLock.Lock()
+	defer im.stateLock.Unlock()
 	im.inputItemIndex += 1
 	if im.inputItemIndex >= im.inputNumItemsVisible {
 		im.inputItemIndex = im.inputNumItemsVisible - 1
@@ -112,6 +183,8 @@ func (im *InputManager) keyActionUpSelectionMode() {
 }
 
 func (im *InputManager) keyActionDownSelectionMode() {
+	im.stateLock.Lock()
+	defer im.stateLock.Unlock()
 	im.inputItemIndex -= 1
 	if im.inputItemIndex < 0 {
 		im.inputItemIndex = 0
@@ -119,19 +192,71 @@ func (im *InputManager) keyActionDownSelectionMode() {
 }
 
 func (im *InputManager) keyActionDeleteItem() {
-	im.view.DeleteItem(im.inputItemIndex)
+	im.view.DeleteItem(im.GetItemIndex())
 }
 
 func (im *InputManager) keyActionCollapseSelectionMode() {
-	im.view.CollapseItem(im.inputItemIndex)
+	im.view.CollapseItem(im.GetItemIndex())
 }
 
 func (im *InputManager) keyActionExpandSelectionMode() {
-	im.view.ExpandItem(im.inputItemIndex)
+	im.view.ExpandItem(im.GetItemIndex())
+}
+
+func (im *InputManager) keyActionDownloadSelectionMode() {
+	im.view.DownloadEnclosure(im.GetItemIndex())
 }
 
 func (im *InputManager) keyActionUpdateColorSelectionMode() {
-	im.view.ChangeColor(im.inputItemIndex)
+	im.view.ChangeColor(im.GetItemIndex())
+}
+
+// keyActionFeedsStatusMode runs the command named by action against the
+// selected feed, then lists the feeds again to show how it went.
+func (im *InputManager) keyActionFeedsStatusMode(action string) {
+	URL := im.view.GetFeedStatusURL(im.GetItemIndex())
+	if URL == "" {
+		return
+	}
+	im.sendCommand(Command{Name: action, Args: []string{URL}})
+	im.sendCommand(Command{Name: "feeds"})
+}
+
+// keyActionRemoveFeedsStatusMode asks before removing the selected feed; the
+// next key answers.
+func (im *InputManager) keyActionRemoveFeedsStatusMode() {
+	URL := im.view.GetFeedStatusURL(im.GetItemIndex())
+	if URL == "" {
+		return
+	}
+	im.pendingRemoval = URL
+	im.view.SetStatus(StatusMsgStruct{"Remove " + URL + "? [y]:Yes [any other key]:No", StatusError})
+}
+
+// confirmRemoval removes the feed the user asked about, if they said yes.
+func (im *InputManager) confirmRemoval(yes bool) {
+	URL := im.pendingRemoval
+	im.pendingRemoval = ""
+	if !yes {
+		im.view.SetStatus(StatusMsgStruct{feedsStatusHelp, StatusInfo})
+		return
+	}
+	im.sendCommand(Command{Name: "remove", Args: []string{URL}})
+	im.sendCommand(Command{Name: "feeds"})
+}
+
+// keyActionRenameFeedsStatusMode starts a ":rename" for the user to finish.
+func (im *InputManager) keyActionRenameFeedsStatusMode() {
+	URL := im.view.GetFeedStatusURL(im.GetItemIndex())
+	if URL == "" {
+		return
+	}
+	im.view.HideFeedStatuses()
+	im.enterRssEntryMode()
+	im.inputTextMakeEmpty()
+	for _, r := range ":rename " + URL + " " {
+		im.inputTextAddRune(r)
+	}
 }
 
 // All functions which modify input text
@@ -167,34 +292,21 @@ func (im *InputManager) inputTextAsString() string {
 
 // Functions responsible for reacting to certain actions
 
-func (im *InputManager) respondToView() {
-	for {
-		select {
-		case numItemsVisible := <-im.chanSetLastSeenNumItems:
-			// TODO THIS IS UNLOCKED. IF SHOULD DEF BE LOCKED.
-			im.inputNumItemsVisible = numItemsVisible
-			if im.inputItemIndex >= numItemsVisible {
-				im.inputItemIndex = numItemsVisible - 1
-			}
-		case <-im.chanGetSelectionMode:
-			im.chanGetSelectionMode <- im.inputMode
-		case <-im.chanGetItemIndex:
-			im.chanGetItemIndex <- im.inputItemIndex
-		case <-im.chanGetInputString:
-			im.chanGetInputString <- im.inputTextAsString()
-		}
-	}
-}
-
 func (im *InputManager) reactToKeys() {
-	for {
+	for im.ctx.Err() == nil {
 		switch ev := tb.PollEvent(); ev.Type {
 		case tb.EventKey:
-			switch im.inputMode {
+			switch im.GetSelectionMode() {
 			case RssSelectionMode:
 				im.reactToKeySelectionMode(ev.Key, ev.Ch)
 			case RssEntryMode:
 				im.reactToKeyEntryMode(ev.Key, ev.Ch)
+			case FeedDetailsMode:
+				im.reactToKeyFeedDetailsMode(ev.Key, ev.Ch)
+			case FeedsStatusMode:
+				im.reactToKeyFeedsStatusMode(ev.Key, ev.Ch)
+			case ItemDiffMode:
+				im.reactToKeyItemDiffMode(ev.Key, ev.Ch)
 			}
 		case tb.EventError:
 			log.Println("Received erroneous event while reacing to keys:")
@@ -209,7 +321,7 @@ func (im *InputManager) reactToKeys() {
 func (im *InputManager) reactToKeySelectionMode(k tb.Key, r rune) {
 	switch k {
 	case tb.KeyEsc, tb.KeyCtrlC:
-		close(im.exitRequest)
+		im.requestExit()
 		return
 	case tb.KeyBackspace, tb.KeyBackspace2:
 		im.keyActionDeleteItem()
@@ -240,17 +352,89 @@ func (im *InputManager) reactToKeySelectionMode(k tb.Key, r rune) {
 			im.keyActionCollapseSelectionMode()
 		case "l":
 			im.keyActionExpandSelectionMode()
+		case "d":
+			im.keyActionDownloadSelectionMode()
+		case "i":
+			im.enterFeedDetailsMode()
+		case "f":
+			im.enterFeedsStatusMode()
+		case "c":
+			im.enterItemDiffMode()
+		}
+	}
+}
+
+func (im *InputManager) reactToKeyItemDiffMode(k tb.Key, r rune) {
+	switch k {
+	case tb.KeyEsc, tb.KeyCtrlC:
+		im.requestExit()
+		return
+	default:
+		im.leaveItemDiffMode()
+	}
+}
+
+func (im *InputManager) reactToKeyFeedsStatusMode(k tb.Key, r rune) {
+	if k == tb.KeyEsc || k == tb.KeyCtrlC {
+		im.requestExit()
+		return
+	}
+	if im.pendingRemoval != "" {
+		im.confirmRemoval(k == 0 && (r == 'y' || r == 'Y'))
+		return
+	}
+	switch k {
+	case tb.KeyBackspace, tb.KeyBackspace2:
+		im.keyActionRemoveFeedsStatusMode()
+	case tb.KeyTab, tb.KeyArrowLeft:
+		im.enterRssSelectionMode()
+	case tb.KeyArrowUp:
+		im.keyActionUpSelectionMode()
+	case tb.KeyArrowDown:
+		im.keyActionDownSelectionMode()
+	default:
+		switch runeToAsciiChar(r) {
+		case "k":
+			im.keyActionUpSelectionMode()
+		case "j":
+			im.keyActionDownSelectionMode()
+		case "h", "q":
+			im.enterRssSelectionMode()
+		case "r":
+			im.keyActionFeedsStatusMode("refresh")
+		case "x":
+			im.keyActionRemoveFeedsStatusMode()
+		case "n":
+			im.keyActionRenameFeedsStatusMode()
 		}
 	}
 }
 
+func (im *InputManager) reactToKeyFeedDetailsMode(k tb.Key, r rune) {
+	switch k {
+	case tb.KeyEsc, tb.KeyCtrlC:
+		im.requestExit()
+		return
+	default:
+		im.leaveFeedDetailsMode()
+	}
+}
+
 func (im *InputManager) reactToKeyEntryMode(k tb.Key, r rune) {
 	switch k {
 	case tb.KeyEsc, tb.KeyCtrlC:
-		close(im.exitRequest)
+		im.requestExit()
 		return
 	case tb.KeyEnter:
-		im.sharedChanNewFeedRequest <- im.inputTextAsString()
+		input := im.inputTextAsString()
+		if cmd, ok := parseCommand(input); ok {
+			im.sendCommand(cmd)
+		} else {
+			select {
+			case im.sharedChanNewFeedRequest <- input:
+			case <-im.ctx.Done():
+			}
+		}
 		im.inputTextMakeEmpty()
 	case tb.KeyTab:
 		im.enterRssSelectionMode()
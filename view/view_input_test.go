@@ -0,0 +1,112 @@
+package view
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	tb "github.com/nsf/termbox-go"
+)
+
+// fakeView stands in for the real view, which needs a terminal. Anything a
+// test doesn't expect the InputManager to call panics.
+type fakeView struct {
+	ViewInterface
+}
+
+func (v *fakeView) SetStatus(status StatusMsgStruct) {}
+func (v *fakeView) HideFeedStatuses()                {}
+func (v *fakeView) Redraw()                          {}
+
+func newTestInputManager() *InputManager {
+	return &InputManager{view: &fakeView{}, ctx: context.Background()}
+}
+
+func TestInputManagerSelectionBounds(t *testing.T) {
+	im := newTestInputManager()
+	im.SetLastSeenNumItems(3)
+	for i := 0; i < 10; i++ {
+		im.reactToKeySelectionMode(tb.KeyArrowUp, 0)
+	}
+	if index := im.GetItemIndex(); index != 2 {
+		t.Error("Unexpected index: ", index, ", expected 2")
+	}
+	im.SetLastSeenNumItems(1)
+	if index := im.GetItemIndex(); index != 0 {
+		t.Error("Unexpected index after items went away: ", index, ", expected 0")
+	}
+}
+
+// Run with -race; keys are handled in one goroutine while the view draws
+// from another.
+func TestInputManagerConcurrentAccess(t *testing.T) {
+	im := newTestInputManager()
+	im.SetLastSeenNumItems(10)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			switch i % 4 {
+			case 0, 1:
+				im.reactToKeySelectionMode(tb.KeyArrowUp, 0)
+			case 2:
+				im.reactToKeySelectionMode(tb.KeyTab, 0)
+			case 3:
+				im.reactToKeyEntryMode(tb.KeyTab, 0)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			im.SetLastSeenNumItems(5 + i%10)
+			if index := im.GetItemIndex(); index < 0 || index >= 15 {
+				t.Error("Index out of range: ", index)
+			}
+			if mode := im.GetSelectionMode(); mode != RssSelectionMode && mode != RssEntryMode {
+				t.Error("Unexpected mode: ", mode)
+			}
+			im.GetInputString()
+		}
+	}()
+	wg.Wait()
+}
+
+// feedsView lists a single feed, and remembers the last status set.
+type feedsView struct {
+	fakeView
+	status StatusMsgStruct
+}
+
+func (v *feedsView) SetStatus(status StatusMsgStruct) { v.status = status }
+func (v *feedsView) GetFeedStatusURL(index int) string {
+	return "http://example.com/feed"
+}
+
+func TestInputManagerConfirmsRemoval(t *testing.T) {
+	v := &feedsView{}
+	commands := make(chan Command, 10)
+	im := &InputManager{view: v, ctx: context.Background(), sharedChanCommandRequest: commands}
+	im.setInputMode(FeedsStatusMode, true)
+
+	// Anything but "y" keeps the feed.
+	im.reactToKeyFeedsStatusMode(0, 'x')
+	if len(commands) != 0 || v.status.Type != StatusError {
+		t.Error("Unexpected removal without asking: ", len(commands), " commands, status ", v.status)
+	}
+	im.reactToKeyFeedsStatusMode(0, 'n')
+	if len(commands) != 0 {
+		t.Error("Unexpected commands after saying no: ", len(commands))
+	}
+
+	im.reactToKeyFeedsStatusMode(tb.KeyBackspace2, 0)
+	im.reactToKeyFeedsStatusMode(0, 'y')
+	if len(commands) != 2 {
+		t.Fatal("Unexpected commands after saying yes: ", len(commands), ", expected 2")
+	}
+	if cmd := <-commands; cmd.Name != "remove" || len(cmd.Args) != 1 || cmd.Args[0] != "http://example.com/feed" {
+		t.Error("Unexpected command: ", cmd)
+	}
+}
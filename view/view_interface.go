@@ -1,7 +1,8 @@
 package view
 
 import (
-	"sync"
+	"context"
+	"time"
 
 	"github.com/smklein/toy-rss/storage"
 )
@@ -23,25 +24,67 @@ type StatusMsgStruct struct {
 	Type    StatusType
 }
 
+// FeedStatus is one line of the feeds screen.
+type FeedStatus struct {
+	URL string
+	// What the user calls the feed.
+	Name string
+	// The feed's own title; empty if it has never been fetched.
+	Title  string
+	State  string
+	Health storage.FeedHealth
+}
+
 type ViewInterface interface {
-	// Initialization.
-	Start(newItemPipe chan *storage.RssEntry, newFeedRequest chan string, deathWg *sync.WaitGroup)
+	// Initialization. Once ctx is cancelled, the view restores the terminal
+	// and stops drawing; it keeps storing items from newItemPipe until that
+	// is closed.
+	Start(ctx context.Context, newItemPipe chan *storage.RssEntry, newFeedRequest chan string, commandRequest chan Command)
+	// Closed once the view has stopped, and stored every item it was sent.
+	Done() chan bool
 
 	// Methods relating to drawing.
 	SetStatus(status StatusMsgStruct)
 	Redraw()
+	// Dates are shown in loc (by default, the local timezone). Must be
+	// called before Start.
+	SetTimezone(loc *time.Location)
 
 	// Method which pairs additional information with a single channel.
 	AddChannelInfo(title string)
+	SetChannelMetadata(title string, metadata storage.ChannelMetadata)
+	// An empty name shows the channel's title again.
+	SetChannelDisplayName(title, name string)
+	// Removes every item from a channel, along with its info. The channel
+	// must have stopped sending items already.
+	PurgeFeed(title string)
 
 	// Methods operating on items.
 	DeleteItem(index int)
 	ChangeColor(index int)
 	CollapseItem(index int)
 	ExpandItem(index int)
+	// Asks for the item's enclosure to be downloaded, through the pipe below.
+	DownloadEnclosure(index int)
+	// Shows the details of the feed an item came from, instead of the items.
+	ShowFeedDetails(index int)
+	HideFeedDetails()
+	// Shows what changed in an updated item, instead of the items. Returns
+	// false if the item was never updated.
+	ShowItemDiff(index int) bool
+	HideItemDiff()
+
+	// Methods relating to the feeds screen, which replaces the items while
+	// shown.
+	ShowFeedStatuses(statuses []FeedStatus)
+	HideFeedStatuses()
+	// The URL of the feed on the given line of the feeds screen, if any.
+	GetFeedStatusURL(index int) string
 
-	// Plumbs the exit channel.
+	// Closed when the user asks to quit.
 	GetChanExitRequest() chan bool
+	// Items whose enclosures the user wants downloaded.
+	GetChanDownloadRequest() chan storage.RssEntry
 }
 
 // Returns a particular implementation of this interface.
@@ -0,0 +1,27 @@
+package view
+
+import "testing"
+
+func TestFormatToLen(t *testing.T) {
+	for _, c := range []struct {
+		in       string
+		l        int
+		expected string
+	}{
+		{"short", 10, "short"},
+		{"much too long", 8, "much ..."},
+		{"narrow", 2, "na"},
+		{"narrow", 0, ""},
+		{"narrower", -5, ""},
+	} {
+		if got := string(formatToLen([]rune(c.in), c.l)); got != c.expected {
+			t.Error("Unexpected formatToLen(", c.in, ", ", c.l, "): ", got, ", expected ", c.expected)
+		}
+	}
+
+	r := []rune("left alone")
+	formatToLen(r, 6)
+	if string(r) != "left alone" {
+		t.Error("Unexpected change to the runes formatted: ", string(r))
+	}
+}